@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
 	"log"
+	"os/signal"
+	"syscall"
 
 	"github.com/abdelmounim-dev/go-tshirt/internal/api"
+	"github.com/abdelmounim-dev/go-tshirt/internal/api/middleware"
 	"github.com/abdelmounim-dev/go-tshirt/internal/config"
 	"github.com/abdelmounim-dev/go-tshirt/internal/db"
+	"github.com/abdelmounim-dev/go-tshirt/internal/service/carts"
+	"github.com/abdelmounim-dev/go-tshirt/internal/service/inventory"
+	"github.com/abdelmounim-dev/go-tshirt/internal/service/notify"
 )
 
 func main() {
@@ -16,7 +23,38 @@ func main() {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
 
-	router := api.SetupRouter(database)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	notifier, err := notify.New(database, notify.Options{
+		Kind:           cfg.LowStockNotifier,
+		WebhookURL:     cfg.LowStockWebhookURL,
+		EmailRecipient: cfg.LowStockEmail,
+	})
+	if err != nil {
+		log.Fatalf("Failed to configure low stock notifier: %v", err)
+	}
+
+	inv := inventory.NewService(database, inventory.Options{
+		ReservationTTL:      cfg.ReservationTTL,
+		Notifier:            notifier,
+		BackInStockCooldown: cfg.BackInStockCooldown,
+	})
+	cartService := carts.NewService(database, inv, carts.Options{
+		IdleTTL:         cfg.CartIdleTTL,
+		CookieSecret:    cfg.CartCookieSecret,
+		MaxLineQuantity: cfg.CartMaxLineQuantity,
+		MaxCartQuantity: cfg.CartMaxQuantity,
+		MaxCartLines:    cfg.CartMaxLines,
+		ShareTTL:        cfg.CartShareTTL,
+	})
+	idempotency := middleware.NewIdempotency(database, cfg.IdempotencyKeyTTL)
+	router := api.SetupRouter(database, cfg, inv, cartService, idempotency)
+
+	go inv.RunSweeper(ctx, cfg.ReservationSweepInterval)
+	go cartService.RunSweeper(ctx, cfg.CartSweepInterval)
+	go idempotency.RunSweeper(ctx, cfg.IdempotencySweepInterval)
+	go notify.NewDispatcher(database, nil, cfg.LowStockWebhookURL).Run(ctx, cfg.OutboxInterval)
 
 	log.Printf("Server starting on %s", cfg.ServerAddress)
 	if err := router.Run(cfg.ServerAddress); err != nil {
@@ -2,156 +2,715 @@ package handlers
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
-	"strconv"
+	"slices"
+	"time"
+	"unicode/utf8"
 
+	"github.com/abdelmounim-dev/go-tshirt/internal/db"
+	apperrors "github.com/abdelmounim-dev/go-tshirt/internal/errors"
 	"github.com/abdelmounim-dev/go-tshirt/internal/models"
+	"github.com/abdelmounim-dev/go-tshirt/internal/service/carts"
+	"github.com/abdelmounim-dev/go-tshirt/internal/service/inventory"
+	"github.com/abdelmounim-dev/go-tshirt/internal/service/pricing"
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
 	"gorm.io/gorm"
 )
 
 type CartHandler struct {
-	db       *gorm.DB
-	validate *validator.Validate
+	db        *gorm.DB
+	inventory *inventory.Service
+	pricing   *pricing.Engine
+	carts     *carts.Service
+	validate  *validator.Validate
 }
 
-func NewCartHandler(db *gorm.DB) *CartHandler {
+func NewCartHandler(db *gorm.DB, inv *inventory.Service, prices *pricing.Engine, cartService *carts.Service) *CartHandler {
 	return &CartHandler{
-		db:       db,
-		validate: validator.New(),
+		db:        db,
+		inventory: inv,
+		pricing:   prices,
+		carts:     cartService,
+		validate:  validator.New(),
 	}
 }
 
+// cartResponse is a cart with its price breakdown and the changes affecting
+// its lines since they were added.
+type cartResponse struct {
+	models.Cart
+	Totals   pricing.Quote   `json:"totals"`
+	Warnings []carts.Warning `json:"warnings"`
+}
+
 func (h *CartHandler) Register(r *gin.RouterGroup) {
 	cartRoutes := r.Group("/cart")
 	{
 		cartRoutes.POST("", h.CreateCart)
-		cartRoutes.GET("/:cart_id", h.GetCart)
-		cartRoutes.POST("/:cart_id/items", h.AddItem)
-		cartRoutes.DELETE("/:cart_id/items/:item_id", h.RemoveItem)
-		cartRoutes.DELETE("/:cart_id", h.DeleteCart)
+		cartRoutes.GET("", h.GetCart)
+		cartRoutes.GET("/:token", h.GetCart)
+		cartRoutes.POST("/:token/items", h.AddItem)
+		cartRoutes.POST("/:token/items/batch", h.AddItems)
+		cartRoutes.PATCH("/:token/items/:item_id", h.UpdateItem)
+		cartRoutes.DELETE("/:token/items/:item_id", h.RemoveItem)
+		cartRoutes.POST("/:token/items/:item_id/save-for-later", h.SaveForLater)
+		cartRoutes.POST("/:token/items/:item_id/move-to-cart", h.MoveToCart)
+		cartRoutes.DELETE("/:token", h.DeleteCart)
+		cartRoutes.POST("/:token/merge", h.MergeCart)
+		cartRoutes.POST("/:token/validate", h.ValidateCart)
+		cartRoutes.POST("/:token/share", h.ShareCart)
+		cartRoutes.POST("/:token/clone", h.CloneSharedCart)
 	}
+	r.GET("/shared-carts/:share_token", h.GetSharedCart)
 }
 
 func (h *CartHandler) DeleteCart(c *gin.Context) {
-	cartID := c.Param("cart_id")
-
-	// First, delete all items in the cart
-	if err := h.db.Where("cart_id = ?", cartID).Delete(&models.CartItem{}).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete cart items"})
-		return
-	}
-
-	// Then, delete the cart itself
-	result := h.db.Delete(&models.Cart{}, cartID)
-	if result.Error != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error.Error()})
+	cart, ok := h.activeCart(c)
+	if !ok {
 		return
 	}
 
-	if result.RowsAffected == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Cart not found"})
+	var released []uint
+	err := db.Transaction(h.db, func(tx *gorm.DB) error {
+		var err error
+		released, err = h.carts.Delete(tx, cart.ID)
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Cart not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete cart"})
 		return
 	}
+	h.inventory.CheckLowStock(c.Request.Context(), released...)
 
 	c.Status(http.StatusNoContent)
 }
 
-
 func (h *CartHandler) CreateCart(c *gin.Context) {
 	var cart models.Cart
 	if err := h.db.Create(&cart).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	h.carts.FillExpiry(&cart)
+	h.setCartCookie(c, cart.Token)
 	c.JSON(http.StatusCreated, cart)
 }
 
-func (h *CartHandler) AddItem(c *gin.Context) {
-	cartID := c.Param("cart_id")
+// setCartCookie issues the signed cart cookie when a cookie secret is configured.
+func (h *CartHandler) setCartCookie(c *gin.Context, token string) {
+	if cookie := h.carts.Cookie(token); cookie != nil {
+		cookie.Secure = c.Request.TLS != nil
+		http.SetCookie(c.Writer, cookie)
+	}
+}
+
+// activeCart loads the cart whose token is in the URL or, on routes without
+// one, in the signed cart cookie. When it does not exist or has expired it
+// responds with an error and returns false.
+func (h *CartHandler) activeCart(c *gin.Context) (models.Cart, bool) {
+	return activeCart(c, h.db, h.carts)
+}
+
+// activeCart implements CartHandler.activeCart for every handler working on
+// carts.
+func activeCart(c *gin.Context, db *gorm.DB, cartService *carts.Service) (models.Cart, bool) {
+	var cart models.Cart
+	token := c.Param("token")
+	if token == "" {
+		if value, err := c.Cookie(carts.CookieName); err == nil {
+			token, _ = cartService.TokenFromCookie(value)
+		}
+	}
+	if token == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Cart not found"})
+		return cart, false
+	}
+	if err := db.Where("token = ?", token).First(&cart).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Cart not found"})
+			return cart, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return cart, false
+	}
+	if cartService.Expired(cart) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Cart has expired"})
+		return cart, false
+	}
+	return cart, true
+}
 
+func (h *CartHandler) AddItem(c *gin.Context) {
 	var item models.CartItem
 	if err := c.ShouldBindJSON(&item); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	item.CartID = 0 // Reset to avoid any passed in value
-	if _, err := strconv.Atoi(cartID); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cart ID"})
+	cart, ok := h.activeCart(c)
+	if !ok {
+		return
+	}
+	item.CartID = cart.ID
+
+	perUnit, err := h.prepareItem(&item)
+	if err != nil {
+		respondItemError(c, err)
+		return
+	}
+
+	var line models.CartItem
+	err = db.Transaction(h.db, func(tx *gorm.DB) error {
+		if err := h.carts.Touch(tx, cart.ID); err != nil {
+			return err
+		}
+		var err error
+		line, err = h.addLine(tx, item, perUnit)
+		return err
+	})
+	if err != nil {
+		respondItemError(c, err)
+		return
+	}
+	h.inventory.CheckLowStock(c.Request.Context(), sortedKeys(perUnit)...)
+
+	c.JSON(http.StatusCreated, line)
+}
+
+// Outcomes of a line in a batch add.
+const (
+	batchAdded   = "added"
+	batchFailed  = "failed"
+	batchSkipped = "skipped"
+)
+
+type addItemsRequest struct {
+	Items []models.CartItem `json:"items" validate:"required,min=1,max=50"`
+	// Atomic adds either every item or none of them.
+	Atomic bool `json:"atomic"`
+}
+
+// batchResult is the outcome of one item of a batch add, in request order.
+type batchResult struct {
+	Index  int              `json:"index"`
+	Status string           `json:"status"`
+	Item   *models.CartItem `json:"item,omitempty"`
+	Code   string           `json:"code,omitempty"`
+	Error  string           `json:"error,omitempty"`
+}
+
+// fail records why the item could not be added.
+func (r *batchResult) fail(err error) {
+	var validationErr *apperrors.ValidationError
+	var notFoundErr *apperrors.NotFoundError
+	r.Status, r.Item, r.Error = batchFailed, nil, err.Error()
+	switch {
+	case errors.As(err, &validationErr) && validationErr.Code != "":
+		r.Code = validationErr.Code
+	case errors.As(err, &validationErr):
+		r.Code = "invalid"
+	case errors.As(err, &notFoundErr):
+		r.Code = "not_found"
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		r.Code, r.Error = "not_found", "Product variant not found"
+	default:
+		r.Code = "error"
+	}
+}
+
+// addItemsResponse is the cart after a batch add with the outcome of each item.
+type addItemsResponse struct {
+	cartResponse
+	Results []batchResult `json:"results"`
+}
+
+// AddItems adds several items to a cart at once. Items are applied in order
+// as AddItem would. In atomic mode nothing is added unless every item can be;
+// otherwise each item is added on its own and failures are reported per item.
+func (h *CartHandler) AddItems(c *gin.Context) {
+	var req addItemsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.validate.Struct(req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	cart, ok := h.activeCart(c)
+	if !ok {
+		return
+	}
+
+	results := make([]batchResult, len(req.Items))
+	perUnit := make([]map[uint]uint, len(req.Items))
+	prepared := true
+	for i := range req.Items {
+		results[i] = batchResult{Index: i, Status: batchSkipped}
+		req.Items[i].CartID = cart.ID
+		var err error
+		if perUnit[i], err = h.prepareItem(&req.Items[i]); err != nil {
+			var validationErr *apperrors.ValidationError
+			var notFoundErr *apperrors.NotFoundError
+			if !errors.As(err, &validationErr) && !errors.As(err, &notFoundErr) {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			results[i].fail(err)
+			prepared = false
+		}
+	}
+
+	var err error
+	if req.Atomic && prepared {
+		err = db.Transaction(h.db, func(tx *gorm.DB) error {
+			if err := h.carts.Touch(tx, cart.ID); err != nil {
+				return err
+			}
+			for i := range results {
+				results[i] = batchResult{Index: i, Status: batchSkipped}
+			}
+			for i, item := range req.Items {
+				line, err := h.addLine(tx, item, perUnit[i])
+				if err != nil {
+					results[i].fail(err)
+					return err
+				}
+				results[i].Status, results[i].Item = batchAdded, &line
+			}
+			return nil
+		})
+		if err != nil {
+			// Nothing was kept
+			for i := range results {
+				if results[i].Status == batchAdded {
+					results[i].Status, results[i].Item = batchSkipped, nil
+				}
+			}
+		}
+	} else if !req.Atomic {
+		for i, item := range req.Items {
+			if results[i].Status == batchFailed {
+				continue
+			}
+			var line models.CartItem
+			err = db.Transaction(h.db, func(tx *gorm.DB) error {
+				if err := h.carts.Touch(tx, cart.ID); err != nil {
+					return err
+				}
+				var err error
+				line, err = h.addLine(tx, item, perUnit[i])
+				return err
+			})
+			if err != nil {
+				// Nothing more can be added once the cart is gone; any other
+				// failure only affects this item
+				if errors.Is(err, carts.ErrCartNotFound) {
+					break
+				}
+				results[i].fail(err)
+				err = nil
+				continue
+			}
+			results[i].Status, results[i].Item = batchAdded, &line
+		}
+	}
+	var validationErr *apperrors.ValidationError
+	if err != nil && !errors.As(err, &validationErr) {
+		respondItemError(c, err)
+		return
+	}
+
+	var added []uint
+	for i, r := range results {
+		if r.Status == batchAdded {
+			added = append(added, sortedKeys(perUnit[i])...)
+		}
+	}
+	h.inventory.CheckLowStock(c.Request.Context(), added...)
+
+	if req.Atomic && len(added) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No items were added", "results": results})
+		return
+	}
+	view, err := h.cartView(cart.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	
-	cid, _ := strconv.Atoi(cartID)
-	item.CartID = uint(cid)
+	c.JSON(http.StatusOK, addItemsResponse{cartResponse: view, Results: results})
+}
 
+// prepareItem checks an item about to be added against the catalog, fills in
+// its derived fields and returns the quantity of each variant one unit of it
+// consumes. Unknown variants and bundles are reported as not found, other
+// problems as validation errors.
+func (h *CartHandler) prepareItem(item *models.CartItem) (map[uint]uint, error) {
+	item.ID = 0
+	item.FulfillmentLocationID = nil
+	item.InventoryPolicy, item.BackorderedQuantity, item.ExpectedShipDate = "", 0, nil
+	// Lines are added active and priced by the server, whatever the client sent
+	item.SavedAt, item.UnitPrice, item.ProductVariant = nil, 0, models.ProductVariant{}
+	if item.Quantity == 0 {
+		return nil, &apperrors.ValidationError{Message: "Quantity must be at least 1"}
+	}
+	if item.BundleProductID != nil {
+		return h.prepareBundleItem(item)
+	}
+	item.BundleSelections = nil
 
-	// Check if product variant exists and has enough stock
 	var variant models.ProductVariant
 	if err := h.db.First(&variant, item.ProductVariantID).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Product variant not found"})
-			return
+			return nil, &apperrors.NotFoundError{Message: "Product variant not found"}
+		}
+		return nil, err
+	}
+
+	if variant.ArchivedAt != nil {
+		return nil, &apperrors.ValidationError{Message: "Product variant is archived"}
+	}
+
+	// An attached mockup must have been rendered for the same product. Only
+	// gallery mockups can be attached by ID; a customer's design needs its
+	// token.
+	if item.MockupToken != "" || item.MockupID != nil {
+		query := h.db.Where("product_id = ?", variant.ProductID)
+		if item.MockupToken != "" {
+			query = query.Where("token = ?", item.MockupToken)
+		} else {
+			query = query.Where("id = ? AND gallery = ?", *item.MockupID, true)
 		}
+		var mockup models.Mockup
+		if err := query.First(&mockup).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, &apperrors.ValidationError{Message: "Mockup not found for this product"}
+			}
+			return nil, err
+		}
+		item.MockupID = &mockup.ID
+	}
+
+	// Validate personalization against the product's field definitions
+	var fields []models.PersonalizationField
+	if err := h.db.Where("product_id = ?", variant.ProductID).Find(&fields).Error; err != nil {
+		return nil, err
+	}
+	surcharge, err := validatePersonalization(fields, item.Personalization)
+	if err != nil {
+		return nil, err
+	}
+	item.PersonalizationSurcharge = surcharge
+	item.PersonalizationKey = item.Personalization.Key()
+	return map[uint]uint{variant.ID: 1}, nil
+}
+
+// prepareBundleItem checks a bundle item's selections against the bundle's
+// components. Stock is drawn from each selected component variant.
+func (h *CartHandler) prepareBundleItem(item *models.CartItem) (map[uint]uint, error) {
+	var bundle models.Product
+	if err := h.db.Preload("BundleComponents").First(&bundle, *item.BundleProductID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &apperrors.NotFoundError{Message: "Bundle not found"}
+		}
+		return nil, err
+	}
+	if bundle.Type != models.ProductTypeBundle {
+		return nil, &apperrors.ValidationError{Message: "Product is not a bundle"}
+	}
+
+	needed, err := validateBundleSelections(h.db, bundle.BundleComponents, item.BundleSelections)
+	if err != nil {
+		return nil, err
+	}
+
+	item.ProductVariantID = 0
+	item.Personalization = nil
+	item.PersonalizationKey = ""
+	item.PersonalizationSurcharge = 0
+	item.MockupID, item.MockupToken = nil, ""
+	for i := range item.BundleSelections {
+		item.BundleSelections[i].ID = 0
+		item.BundleSelections[i].ProductVariant = models.ProductVariant{}
+		if item.BundleSelections[i].Quantity == 0 {
+			item.BundleSelections[i].Quantity = 1
+		}
+	}
+	return needed, nil
+}
+
+// addLine adds a prepared item to its cart within tx and holds stock for the
+// resulting line. An item for a variant already in the cart with the same
+// personalization and mockup is merged into that line; bundle lines are never
+// merged. The resulting line must be within the purchase limits.
+func (h *CartHandler) addLine(tx *gorm.DB, item models.CartItem, perUnit map[uint]uint) (models.CartItem, error) {
+	line := item
+	line.BundleSelections = append([]models.BundleSelection(nil), item.BundleSelections...)
+
+	// The lookup runs inside the transaction so concurrent requests cannot
+	// both create the line.
+	var existingItem models.CartItem
+	if line.BundleProductID == nil {
+		query := tx.Where("cart_id = ? AND product_variant_id = ? AND personalization_key = ? AND saved_at IS NULL", line.CartID, line.ProductVariantID, line.PersonalizationKey)
+		if line.MockupID != nil {
+			query = query.Where("mockup_id = ?", *line.MockupID)
+		} else {
+			query = query.Where("mockup_id IS NULL")
+		}
+		if err := query.Limit(1).Find(&existingItem).Error; err != nil {
+			return line, err
+		}
+	}
+
+	limited, quantity := line, line.Quantity
+	if existingItem.ID != 0 {
+		limited, quantity = existingItem, existingItem.Quantity+line.Quantity
+	}
+	if err := h.carts.CheckLimits(tx, limited, quantity); err != nil {
+		return line, err
+	}
+
+	if existingItem.ID == 0 {
+		if err := tx.Create(&line).Error; err != nil {
+			return line, err
+		}
+	} else {
+		err := tx.Model(&existingItem).Update("quantity", gorm.Expr("quantity + ?", line.Quantity)).Error
+		if err != nil {
+			return line, err
+		}
+		if err := tx.First(&line, existingItem.ID).Error; err != nil {
+			return line, err
+		}
+	}
+
+	// Hold stock for the line's full quantity
+	if err := h.carts.ReserveLine(tx, &line, perUnit); err != nil {
+		return line, err
+	}
+	return line, h.snapshotPrice(tx, &line)
+}
+
+// respondItemError responds with the status matching an error from changing
+// a cart's items. Validation errors carry their code, when they have one.
+func respondItemError(c *gin.Context, err error) {
+	var validationErr *apperrors.ValidationError
+	var notFoundErr *apperrors.NotFoundError
+	switch {
+	case errors.As(err, &validationErr):
+		body := gin.H{"error": err.Error()}
+		if validationErr.Code != "" {
+			body["code"] = validationErr.Code
+		}
+		c.JSON(http.StatusBadRequest, body)
+	case errors.As(err, &notFoundErr):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, carts.ErrCartNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Cart not found"})
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		// The cart exists, so the record that went missing is a variant
+		// deleted while the item was being added
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product variant not found"})
+	default:
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
 	}
+}
 
-	if variant.Stock < item.Quantity {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Insufficient stock"})
+func (h *CartHandler) GetCart(c *gin.Context) {
+	cart, ok := h.activeCart(c)
+	if !ok {
 		return
 	}
 
-	// Check if the item already exists in the cart
-	var existingItem models.CartItem
-	err := h.db.Where("cart_id = ? AND product_variant_id = ?", item.CartID, item.ProductVariantID).First(&existingItem).Error
-	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+	// Reading a cart keeps it alive
+	if err := h.carts.Touch(h.db, cart.ID); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	view, err := h.cartView(cart.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, view)
+}
+
+// cartView loads a cart with both sections of items, its expiry and the
+// totals of the items being bought for a response.
+func (h *CartHandler) cartView(cartID uint) (cartResponse, error) {
+	var cart models.Cart
+	err := h.db.Preload("Items", "saved_at IS NULL").Preload("Items.ProductVariant").Preload("Items.BundleSelections.ProductVariant").
+		Preload("SavedItems", "saved_at IS NOT NULL").Preload("SavedItems.ProductVariant").Preload("SavedItems.BundleSelections.ProductVariant").
+		First(&cart, cartID).Error
+	if err != nil {
+		return cartResponse{}, err
+	}
+	h.carts.FillExpiry(&cart)
+	if err := carts.FillMockupTokens(h.db, cart.Items); err != nil {
+		return cartResponse{}, err
+	}
+	if err := carts.FillMockupTokens(h.db, cart.SavedItems); err != nil {
+		return cartResponse{}, err
+	}
+
+	totals, err := h.pricing.Price(h.db, cart.Items)
+	if err != nil {
+		return cartResponse{}, err
+	}
+	warnings, err := h.carts.Warnings(h.db, totals)
+	return cartResponse{Cart: cart, Totals: totals, Warnings: warnings}, err
+}
+
+// snapshotPrice records the line's current unit price on it, so later price
+// changes can be pointed out to the shopper. A line that already has a price,
+// because quantity was merged into it, keeps it: a rise since then must still
+// be accepted.
+func (h *CartHandler) snapshotPrice(tx *gorm.DB, line *models.CartItem) error {
+	if line.UnitPrice != 0 {
+		return nil
+	}
+	quote, err := h.pricing.Price(tx, []models.CartItem{*line})
+	if err != nil {
+		return err
+	}
+	line.UnitPrice = quote.Lines[0].UnitPrice
+	return tx.Model(line).Update("unit_price", line.UnitPrice).Error
+}
 
-	tx := h.db.Begin()
+type mergeCartRequest struct {
+	CustomerID string `json:"customer_id" validate:"required"`
+	// CartToken is the token of the customer's own cart, which the caller
+	// must already hold.
+	CartToken string `json:"cart_token"`
+}
+
+// mergeResponse is the cart lines were merged or cloned into, with the lines
+// that could not be added at their full quantity.
+type mergeResponse struct {
+	cartResponse
+	Adjustments []carts.Adjustment `json:"adjustments"`
+}
 
-	if errors.Is(err, gorm.ErrRecordNotFound) {
-		// Create new cart item
-		if err := tx.Create(&item).Error; err != nil {
-			tx.Rollback()
+// MergeCart combines an anonymous cart into the customer's cart when they
+// sign in, and returns the customer's cart. There is no authentication yet,
+// so the customer's cart is only ever found by its token, never by the
+// customer ID; without one the cart is simply tagged with the customer.
+func (h *CartHandler) MergeCart(c *gin.Context) {
+	var req mergeCartRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.validate.Struct(req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	from, ok := h.activeCart(c)
+	if !ok {
+		return
+	}
+	var customerCart models.Cart
+	if req.CartToken != "" {
+		if err := h.db.Where("token = ?", req.CartToken).First(&customerCart).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Customer cart not found"})
+				return
+			}
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-	} else {
-		// Update quantity of existing item
-		existingItem.Quantity += item.Quantity
-		if err := tx.Save(&existingItem).Error; err != nil {
-			tx.Rollback()
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		if h.carts.Expired(customerCart) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Customer cart has expired"})
 			return
 		}
-		item = existingItem
 	}
 
-	// Decrement stock
-	variant.Stock -= item.Quantity
-	if err := tx.Save(&variant).Error; err != nil {
-		tx.Rollback()
+	var into models.Cart
+	var adjustments []carts.Adjustment
+	var changed []uint
+	err := db.Transaction(h.db, func(tx *gorm.DB) error {
+		var err error
+		into, adjustments, changed, err = h.carts.Merge(tx, from, customerCart, req.CustomerID)
+		return err
+	})
+	if err != nil {
+		var validationErr *apperrors.ValidationError
+		if errors.As(err, &validationErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	h.inventory.CheckLowStock(c.Request.Context(), changed...)
 
-	if err := tx.Commit().Error; err != nil {
+	view, err := h.cartView(into.ID)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	h.setCartCookie(c, into.Token)
+	if adjustments == nil {
+		adjustments = []carts.Adjustment{}
+	}
+	c.JSON(http.StatusOK, mergeResponse{cartResponse: view, Adjustments: adjustments})
+}
 
-	c.JSON(http.StatusCreated, item)
+type validateCartRequest struct {
+	Fix bool `json:"fix"`
 }
 
-func (h *CartHandler) GetCart(c *gin.Context) {
-	cartID := c.Param("cart_id")
+// validateResponse is a cart with the problems found on its lines. The cart
+// reflects any fixes that were applied.
+type validateResponse struct {
+	cartResponse
+	Valid    bool            `json:"valid"`
+	Problems []carts.Warning `json:"problems"`
+}
 
-	var cart models.Cart
-	if err := h.db.Preload("Items.ProductVariant").First(&cart, cartID).Error; err != nil {
+// ValidateCart re-checks every line of a cart before checkout and, when asked
+// to, fixes what it can. The cart is valid when no blocking problem is left.
+func (h *CartHandler) ValidateCart(c *gin.Context) {
+	var req validateCartRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	cart, ok := h.activeCart(c)
+	if !ok {
+		return
+	}
+
+	var problems []carts.Warning
+	var changed []uint
+	err := db.Transaction(h.db, func(tx *gorm.DB) error {
+		changed = nil
+		if err := h.carts.Touch(tx, cart.ID); err != nil {
+			return err
+		}
+		var items []models.CartItem
+		if err := tx.Preload("BundleSelections").Where("cart_id = ? AND saved_at IS NULL", cart.ID).Order("id").Find(&items).Error; err != nil {
+			return err
+		}
+		quote, err := h.pricing.Price(tx, items)
+		if err != nil {
+			return err
+		}
+		if problems, err = h.carts.Warnings(tx, quote); err != nil || !req.Fix {
+			return err
+		}
+		changed, err = h.carts.Fix(tx, quote, problems)
+		return err
+	})
+	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Cart not found"})
 			return
@@ -159,15 +718,228 @@ func (h *CartHandler) GetCart(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, cart)
+	h.inventory.CheckLowStock(c.Request.Context(), changed...)
+
+	valid := true
+	for _, p := range problems {
+		if p.Blocking && p.Fix == "" {
+			valid = false
+		}
+	}
+	view, err := h.cartView(cart.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, validateResponse{cartResponse: view, Valid: valid, Problems: problems})
+}
+
+type shareCartRequest struct {
+	// ExpiresInHours shortens the share's lifetime; zero uses the default.
+	ExpiresInHours uint `json:"expires_in_hours" validate:"lte=720"`
+}
+
+// sharedCartResponse is a shared cart with its lines' product variants and
+// their current totals.
+type sharedCartResponse struct {
+	models.CartShare
+	Totals pricing.Quote `json:"totals"`
+}
+
+// ShareCart snapshots a cart's lines into a read-only share whose token can
+// be sent to someone else.
+func (h *CartHandler) ShareCart(c *gin.Context) {
+	var req shareCartRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if err := h.validate.Struct(req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	cart, ok := h.activeCart(c)
+	if !ok {
+		return
+	}
+
+	var share models.CartShare
+	err := db.Transaction(h.db, func(tx *gorm.DB) error {
+		if err := h.carts.Touch(tx, cart.ID); err != nil {
+			return err
+		}
+		var err error
+		share, err = h.carts.Share(tx, cart.ID, time.Duration(req.ExpiresInHours)*time.Hour)
+		return err
+	})
+	if err != nil {
+		respondItemError(c, err)
+		return
+	}
+	view, err := h.sharedCartView(share)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, view)
+}
+
+// GetSharedCart returns a shared cart. It does not require the token of the
+// cart it was taken from.
+func (h *CartHandler) GetSharedCart(c *gin.Context) {
+	share, err := h.carts.SharedCart(h.db, c.Param("share_token"))
+	if err != nil {
+		respondItemError(c, err)
+		return
+	}
+	view, err := h.sharedCartView(share)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, view)
+}
+
+// sharedCartView loads the product variants of a share's lines and prices
+// them at current prices for a response.
+func (h *CartHandler) sharedCartView(share models.CartShare) (sharedCartResponse, error) {
+	var ids []uint
+	for _, item := range share.Items {
+		ids = append(ids, item.ProductVariantID)
+		for _, sel := range item.BundleSelections {
+			ids = append(ids, sel.ProductVariantID)
+		}
+	}
+	var variants []models.ProductVariant
+	if err := h.db.Find(&variants, ids).Error; err != nil {
+		return sharedCartResponse{}, err
+	}
+	byID := make(map[uint]models.ProductVariant, len(variants))
+	for _, v := range variants {
+		byID[v.ID] = v
+	}
+	for i := range share.Items {
+		item := &share.Items[i]
+		item.ProductVariant = byID[item.ProductVariantID]
+		for j := range item.BundleSelections {
+			item.BundleSelections[j].ProductVariant = byID[item.BundleSelections[j].ProductVariantID]
+		}
+	}
+
+	totals, err := h.pricing.Price(h.db, share.Items)
+	return sharedCartResponse{CartShare: share, Totals: totals}, err
+}
+
+type cloneCartRequest struct {
+	ShareToken string `json:"share_token" validate:"required"`
+}
+
+// CloneSharedCart copies the lines of a shared cart into the cart in the URL.
+// Lines are checked against the current catalog as if they were being added,
+// and clamped to the stock available instead of failing; every line that
+// could not be added in full is reported.
+func (h *CartHandler) CloneSharedCart(c *gin.Context) {
+	var req cloneCartRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.validate.Struct(req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	cart, ok := h.activeCart(c)
+	if !ok {
+		return
+	}
+	share, err := h.carts.SharedCart(h.db, req.ShareToken)
+	if err != nil {
+		respondItemError(c, err)
+		return
+	}
+
+	items := share.Items
+	perUnit := make([]map[uint]uint, len(items))
+	var unavailable []carts.Adjustment
+	for i := range items {
+		items[i].CartID = cart.ID
+		if perUnit[i], err = h.prepareItem(&items[i]); err != nil {
+			var validationErr *apperrors.ValidationError
+			var notFoundErr *apperrors.NotFoundError
+			if !errors.As(err, &validationErr) && !errors.As(err, &notFoundErr) {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			unavailable = append(unavailable, carts.Adjustment{
+				ProductVariantID: items[i].ProductVariantID,
+				BundleProductID:  items[i].BundleProductID,
+				Requested:        items[i].Quantity,
+				Reason:           carts.AdjustmentUnavailable,
+			})
+			perUnit[i] = nil
+		}
+	}
+
+	var adjustments []carts.Adjustment
+	var changed []uint
+	err = db.Transaction(h.db, func(tx *gorm.DB) error {
+		adjustments = append([]carts.Adjustment{}, unavailable...)
+		changed = nil
+		if err := h.carts.Touch(tx, cart.ID); err != nil {
+			return err
+		}
+		for i, item := range items {
+			if perUnit[i] == nil {
+				continue
+			}
+			line, added, reason, err := h.carts.AddAvailable(tx, item, perUnit[i])
+			if err != nil {
+				return err
+			}
+			if added < item.Quantity {
+				adjustments = append(adjustments, carts.Adjustment{
+					CartItemID:       line.ID,
+					ProductVariantID: item.ProductVariantID,
+					BundleProductID:  item.BundleProductID,
+					Requested:        item.Quantity,
+					Quantity:         added,
+					Reason:           reason,
+				})
+			}
+			if line.ID == 0 {
+				continue
+			}
+			changed = append(changed, sortedKeys(perUnit[i])...)
+			if err := h.snapshotPrice(tx, &line); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		respondItemError(c, err)
+		return
+	}
+	h.inventory.CheckLowStock(c.Request.Context(), changed...)
+
+	view, err := h.cartView(cart.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, mergeResponse{cartResponse: view, Adjustments: adjustments})
 }
 
 func (h *CartHandler) RemoveItem(c *gin.Context) {
-	cartID := c.Param("cart_id")
-	itemID := c.Param("item_id")
+	cart, ok := h.activeCart(c)
+	if !ok {
+		return
+	}
 
 	var cartItem models.CartItem
-	if err := h.db.Where("cart_id = ? AND id = ?", cartID, itemID).First(&cartItem).Error; err != nil {
+	if err := h.db.Where("cart_id = ? AND id = ?", cart.ID, c.Param("item_id")).First(&cartItem).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Cart item not found"})
 			return
@@ -176,14 +948,265 @@ func (h *CartHandler) RemoveItem(c *gin.Context) {
 		return
 	}
 
-	result := h.db.Delete(&cartItem)
-	if result.Error != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error.Error()})
+	var result *gorm.DB
+	var released []uint
+	err := db.Transaction(h.db, func(tx *gorm.DB) error {
+		if err := h.carts.Touch(tx, cart.ID); err != nil {
+			return err
+		}
+		var err error
+		if released, err = h.inventory.Release(tx, cartItem.ID); err != nil {
+			return err
+		}
+		if err := tx.Where("cart_item_id = ?", cartItem.ID).Delete(&models.BundleSelection{}).Error; err != nil {
+			return err
+		}
+		result = tx.Delete(&cartItem)
+		return result.Error
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Cart not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 	if result.RowsAffected == 0 {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Cart item not found"})
 		return
 	}
+	h.inventory.CheckLowStock(c.Request.Context(), released...)
 	c.Status(http.StatusNoContent)
 }
+
+// SaveForLater moves a line to the cart's saved-for-later section, releasing
+// the stock it holds, and returns the cart.
+func (h *CartHandler) SaveForLater(c *gin.Context) {
+	h.moveItem(c, true)
+}
+
+// MoveToCart moves a saved line back into the cart, holding stock for it
+// again, and returns the cart.
+func (h *CartHandler) MoveToCart(c *gin.Context) {
+	h.moveItem(c, false)
+}
+
+// moveItem moves a line between the cart's sections.
+func (h *CartHandler) moveItem(c *gin.Context, save bool) {
+	cart, ok := h.activeCart(c)
+	if !ok {
+		return
+	}
+
+	var line models.CartItem
+	if err := h.db.Preload("BundleSelections").Where("cart_id = ? AND id = ?", cart.ID, c.Param("item_id")).First(&line).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Cart item not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// A line already where it was asked to go is left alone
+	var changed []uint
+	if (line.SavedAt != nil) != save {
+		err := db.Transaction(h.db, func(tx *gorm.DB) error {
+			if err := h.carts.Touch(tx, cart.ID); err != nil {
+				return err
+			}
+			var err error
+			if save {
+				_, changed, err = h.carts.SaveForLater(tx, line)
+			} else {
+				_, changed, err = h.carts.MoveToCart(tx, line)
+			}
+			return err
+		})
+		if err != nil {
+			respondItemError(c, err)
+			return
+		}
+	}
+	h.inventory.CheckLowStock(c.Request.Context(), changed...)
+
+	view, err := h.cartView(cart.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, view)
+}
+
+type updateCartItemRequest struct {
+	Quantity *uint `json:"quantity" validate:"required"`
+}
+
+// UpdateItem sets a cart line to a new quantity, holding or releasing stock
+// for the difference. A quantity of 0 removes the line.
+func (h *CartHandler) UpdateItem(c *gin.Context) {
+	var req updateCartItemRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.validate.Struct(req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if *req.Quantity == 0 {
+		h.RemoveItem(c)
+		return
+	}
+	cart, ok := h.activeCart(c)
+	if !ok {
+		return
+	}
+
+	var line models.CartItem
+	if err := h.db.Preload("BundleSelections").Where("cart_id = ? AND id = ?", cart.ID, c.Param("item_id")).First(&line).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Cart item not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if line.SavedAt != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Cart item is saved for later"})
+		return
+	}
+	perUnit := carts.LineVariants(line)
+
+	// Archived variants can be reduced or removed but not added to
+	if *req.Quantity > line.Quantity {
+		var archived int64
+		if err := h.db.Model(&models.ProductVariant{}).Where("id IN ? AND archived_at IS NOT NULL", sortedKeys(perUnit)).Count(&archived).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if archived > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Product variant is archived"})
+			return
+		}
+	}
+
+	err := db.Transaction(h.db, func(tx *gorm.DB) error {
+		if err := h.carts.Touch(tx, cart.ID); err != nil {
+			return err
+		}
+		// Lines over a limit set since they were added can still shrink
+		if *req.Quantity > line.Quantity {
+			if err := h.carts.CheckLimits(tx, line, *req.Quantity); err != nil {
+				return err
+			}
+		}
+		line.Quantity = *req.Quantity
+		if err := tx.Model(&line).Update("quantity", line.Quantity).Error; err != nil {
+			return err
+		}
+		return h.carts.ReserveLine(tx, &line, perUnit)
+	})
+	if err != nil {
+		respondItemError(c, err)
+		return
+	}
+	h.inventory.CheckLowStock(c.Request.Context(), sortedKeys(perUnit)...)
+
+	c.JSON(http.StatusOK, line)
+}
+
+// validatePersonalization checks the requested personalization values against
+// the product's field definitions and returns the total surcharge per unit.
+func validatePersonalization(fields []models.PersonalizationField, values models.Personalization) (float64, error) {
+	byName := make(map[string]models.PersonalizationField, len(fields))
+	for _, f := range fields {
+		byName[f.Name] = f
+	}
+
+	var surcharge float64
+	seen := make(map[string]bool, len(values))
+	for _, v := range values {
+		field, ok := byName[v.Field]
+		if !ok {
+			return 0, &apperrors.ValidationError{Message: fmt.Sprintf("Unknown personalization field %q", v.Field)}
+		}
+		if seen[v.Field] {
+			return 0, &apperrors.ValidationError{Message: fmt.Sprintf("Duplicate personalization field %q", v.Field)}
+		}
+		seen[v.Field] = true
+
+		if v.Text == "" {
+			return 0, &apperrors.ValidationError{Message: fmt.Sprintf("Personalization field %q requires text", v.Field)}
+		}
+		if utf8.RuneCountInString(v.Text) > field.MaxLength {
+			return 0, &apperrors.ValidationError{Message: fmt.Sprintf("Personalization field %q exceeds %d characters", v.Field, field.MaxLength)}
+		}
+		if v.Font != "" && !slices.Contains(field.AllowedFonts, v.Font) {
+			return 0, &apperrors.ValidationError{Message: fmt.Sprintf("Font %q is not allowed for %q", v.Font, v.Field)}
+		}
+		if v.Color != "" && !slices.Contains(field.AllowedColors, v.Color) {
+			return 0, &apperrors.ValidationError{Message: fmt.Sprintf("Color %q is not allowed for %q", v.Color, v.Field)}
+		}
+		surcharge += field.Surcharge
+	}
+
+	for _, f := range fields {
+		if f.Required && !seen[f.Name] {
+			return 0, &apperrors.ValidationError{Message: fmt.Sprintf("Personalization field %q is required", f.Name)}
+		}
+	}
+	return surcharge, nil
+}
+
+// validateBundleSelections checks that the chosen variants fill every component
+// of a bundle exactly and returns the quantity needed per variant for one bundle.
+func validateBundleSelections(db *gorm.DB, components []models.BundleComponent, selections []models.BundleSelection) (map[uint]uint, error) {
+	if len(selections) == 0 {
+		return nil, &apperrors.ValidationError{Message: "Bundle selections are required"}
+	}
+
+	needed := make(map[uint]uint, len(selections))
+	for _, s := range selections {
+		quantity := s.Quantity
+		if quantity == 0 {
+			quantity = 1
+		}
+		needed[s.ProductVariantID] += quantity
+	}
+
+	var variants []models.ProductVariant
+	if err := db.Where("id IN ? AND archived_at IS NULL", sortedKeys(needed)).Find(&variants).Error; err != nil {
+		return nil, err
+	}
+	if len(variants) != len(needed) {
+		return nil, &apperrors.ValidationError{Message: "Bundle selection references an unknown or archived product variant"}
+	}
+
+	perProduct := make(map[uint]uint)
+	for _, v := range variants {
+		perProduct[v.ProductID] += needed[v.ID]
+	}
+	for _, comp := range components {
+		if perProduct[comp.ComponentProductID] != comp.Quantity {
+			return nil, &apperrors.ValidationError{Message: fmt.Sprintf("Bundle requires %d item(s) of product %d", comp.Quantity, comp.ComponentProductID)}
+		}
+		delete(perProduct, comp.ComponentProductID)
+	}
+	if len(perProduct) > 0 {
+		return nil, &apperrors.ValidationError{Message: "Bundle selection includes a product that is not part of this bundle"}
+	}
+	return needed, nil
+}
+
+// sortedKeys returns the keys of m in ascending order so rows are always
+// locked in the same order.
+func sortedKeys(m map[uint]uint) []uint {
+	keys := make([]uint, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -2,18 +2,33 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/abdelmounim-dev/go-tshirt/internal/db"
 	"github.com/abdelmounim-dev/go-tshirt/internal/models"
+	"github.com/abdelmounim-dev/go-tshirt/internal/service/carts"
+	"github.com/abdelmounim-dev/go-tshirt/internal/service/inventory"
+	"github.com/abdelmounim-dev/go-tshirt/internal/service/pricing"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 	"gorm.io/gorm"
 )
 
+// newCartHandler returns a cart handler with the default pricing and cart expiry.
+func newCartHandler(db *gorm.DB, inv *inventory.Service) *CartHandler {
+	return NewCartHandler(db, inv, pricing.New(pricing.Options{}), carts.NewService(db, inv, carts.Options{}))
+}
+
 func TestCartHandler_CreateCart(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
@@ -22,7 +37,7 @@ func TestCartHandler_CreateCart(t *testing.T) {
 		err := db.AutoMigrate(&models.Cart{}, &models.CartItem{})
 		assert.NoError(t, err)
 
-		handler := NewCartHandler(db)
+		handler := newCartHandler(db, inventory.NewService(db, inventory.Options{}))
 		router := gin.Default()
 		api := router.Group("/api")
 		handler.Register(api)
@@ -40,15 +55,15 @@ func TestCartHandler_AddItem(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
 	testCases := []struct {
-		name             string
-		setup            func(db *gorm.DB) (map[string]interface{}, uint, uint)
-		expectedCode     int
-		expectedStock    uint
-		expectedQuantity uint
+		name              string
+		setup             func(db *gorm.DB) (map[string]interface{}, uint, string)
+		expectedCode      int
+		expectedAvailable int
+		expectedQuantity  uint
 	}{
 		{
 			name: "should add an item to the cart successfully",
-			setup: func(db *gorm.DB) (map[string]interface{}, uint, uint) {
+			setup: func(db *gorm.DB) (map[string]interface{}, uint, string) {
 				product := models.Product{Name: "T-shirt", Price: 20}
 				db.Create(&product)
 				variant := models.ProductVariant{ProductID: product.ID, Color: "Black", Size: "M", Stock: 10}
@@ -58,15 +73,15 @@ func TestCartHandler_AddItem(t *testing.T) {
 				return map[string]interface{}{
 					"product_variant_id": variant.ID,
 					"quantity":           1,
-				}, variant.ID, cart.ID
+				}, variant.ID, cart.Token
 			},
-			expectedCode:     http.StatusCreated,
-			expectedStock:    9,
-			expectedQuantity: 1,
+			expectedCode:      http.StatusCreated,
+			expectedAvailable: 9,
+			expectedQuantity:  1,
 		},
 		{
 			name: "should update the quantity of an existing item",
-			setup: func(db *gorm.DB) (map[string]interface{}, uint, uint) {
+			setup: func(db *gorm.DB) (map[string]interface{}, uint, string) {
 				product := models.Product{Name: "T-shirt", Price: 20}
 				db.Create(&product)
 				variant := models.ProductVariant{ProductID: product.ID, Color: "Black", Size: "M", Stock: 10}
@@ -77,15 +92,15 @@ func TestCartHandler_AddItem(t *testing.T) {
 				return map[string]interface{}{
 					"product_variant_id": variant.ID,
 					"quantity":           2,
-				}, variant.ID, cart.ID
+				}, variant.ID, cart.Token
 			},
-			expectedCode:     http.StatusCreated,
-			expectedStock:    7,
-			expectedQuantity: 3,
+			expectedCode:      http.StatusCreated,
+			expectedAvailable: 7,
+			expectedQuantity:  3,
 		},
 		{
 			name: "should return an error for insufficient stock",
-			setup: func(db *gorm.DB) (map[string]interface{}, uint, uint) {
+			setup: func(db *gorm.DB) (map[string]interface{}, uint, string) {
 				product := models.Product{Name: "T-shirt", Price: 20}
 				db.Create(&product)
 				variant := models.ProductVariant{ProductID: product.ID, Color: "Black", Size: "M", Stock: 5}
@@ -95,19 +110,139 @@ func TestCartHandler_AddItem(t *testing.T) {
 				return map[string]interface{}{
 					"product_variant_id": variant.ID,
 					"quantity":           10,
-				}, variant.ID, cart.ID
+				}, variant.ID, cart.Token
+			},
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name: "should add a personalized item as a separate line",
+			setup: func(db *gorm.DB) (map[string]interface{}, uint, string) {
+				product := models.Product{Name: "T-shirt", Price: 20, PersonalizationFields: []models.PersonalizationField{
+					{Name: "name", MaxLength: 10, AllowedFonts: []string{"Block"}, Surcharge: 5},
+				}}
+				db.Create(&product)
+				variant := models.ProductVariant{ProductID: product.ID, Color: "Black", Size: "M", Stock: 10}
+				db.Create(&variant)
+				cart := models.Cart{}
+				db.Create(&cart)
+				db.Create(&models.CartItem{CartID: cart.ID, ProductVariantID: variant.ID, Quantity: 1})
+				return map[string]interface{}{
+					"product_variant_id": variant.ID,
+					"quantity":           1,
+					"personalization":    []map[string]string{{"field": "name", "text": "SMITH", "font": "Block"}},
+				}, variant.ID, cart.Token
+			},
+			expectedCode:      http.StatusCreated,
+			expectedAvailable: 9,
+			expectedQuantity:  1,
+		},
+		{
+			name: "should reject personalization text that is too long",
+			setup: func(db *gorm.DB) (map[string]interface{}, uint, string) {
+				product := models.Product{Name: "T-shirt", Price: 20, PersonalizationFields: []models.PersonalizationField{
+					{Name: "name", MaxLength: 3},
+				}}
+				db.Create(&product)
+				variant := models.ProductVariant{ProductID: product.ID, Color: "Black", Size: "M", Stock: 10}
+				db.Create(&variant)
+				cart := models.Cart{}
+				db.Create(&cart)
+				return map[string]interface{}{
+					"product_variant_id": variant.ID,
+					"quantity":           1,
+					"personalization":    []map[string]string{{"field": "name", "text": "SMITH"}},
+				}, variant.ID, cart.Token
+			},
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name: "should reject a missing required personalization field",
+			setup: func(db *gorm.DB) (map[string]interface{}, uint, string) {
+				product := models.Product{Name: "T-shirt", Price: 20, PersonalizationFields: []models.PersonalizationField{
+					{Name: "number", MaxLength: 2, Required: true},
+				}}
+				db.Create(&product)
+				variant := models.ProductVariant{ProductID: product.ID, Color: "Black", Size: "M", Stock: 10}
+				db.Create(&variant)
+				cart := models.Cart{}
+				db.Create(&cart)
+				return map[string]interface{}{
+					"product_variant_id": variant.ID,
+					"quantity":           1,
+				}, variant.ID, cart.Token
+			},
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name: "should attach a customer mockup by its token",
+			setup: func(db *gorm.DB) (map[string]interface{}, uint, string) {
+				product := models.Product{Name: "T-shirt", Price: 20}
+				db.Create(&product)
+				variant := models.ProductVariant{ProductID: product.ID, Color: "Black", Size: "M", Stock: 10}
+				db.Create(&variant)
+				mockup := models.Mockup{ProductID: product.ID, Color: "Black"}
+				db.Create(&mockup)
+				cart := models.Cart{}
+				db.Create(&cart)
+				return map[string]interface{}{
+					"product_variant_id": variant.ID,
+					"quantity":           1,
+					"mockup_token":       mockup.Token,
+				}, variant.ID, cart.Token
+			},
+			expectedCode:      http.StatusCreated,
+			expectedAvailable: 9,
+			expectedQuantity:  1,
+		},
+		{
+			name: "should attach a gallery mockup by ID",
+			setup: func(db *gorm.DB) (map[string]interface{}, uint, string) {
+				product := models.Product{Name: "T-shirt", Price: 20}
+				db.Create(&product)
+				variant := models.ProductVariant{ProductID: product.ID, Color: "Black", Size: "M", Stock: 10}
+				db.Create(&variant)
+				mockup := models.Mockup{ProductID: product.ID, Color: "Black", Gallery: true}
+				db.Create(&mockup)
+				cart := models.Cart{}
+				db.Create(&cart)
+				return map[string]interface{}{
+					"product_variant_id": variant.ID,
+					"quantity":           1,
+					"mockup_id":          mockup.ID,
+				}, variant.ID, cart.Token
+			},
+			expectedCode:      http.StatusCreated,
+			expectedAvailable: 9,
+			expectedQuantity:  1,
+		},
+		{
+			name: "should reject a customer mockup attached by ID",
+			setup: func(db *gorm.DB) (map[string]interface{}, uint, string) {
+				product := models.Product{Name: "T-shirt", Price: 20}
+				db.Create(&product)
+				variant := models.ProductVariant{ProductID: product.ID, Color: "Black", Size: "M", Stock: 10}
+				db.Create(&variant)
+				mockup := models.Mockup{ProductID: product.ID, Color: "Black"}
+				db.Create(&mockup)
+				cart := models.Cart{}
+				db.Create(&cart)
+				return map[string]interface{}{
+					"product_variant_id": variant.ID,
+					"quantity":           1,
+					"mockup_id":          mockup.ID,
+				}, variant.ID, cart.Token
 			},
 			expectedCode: http.StatusBadRequest,
 		},
 		{
 			name: "should return an error for non-existent variant",
-			setup: func(db *gorm.DB) (map[string]interface{}, uint, uint) {
+			setup: func(db *gorm.DB) (map[string]interface{}, uint, string) {
 				cart := models.Cart{}
 				db.Create(&cart)
 				return map[string]interface{}{
 					"product_variant_id": 999,
 					"quantity":           1,
-				}, 0, cart.ID
+				}, 0, cart.Token
 			},
 			expectedCode: http.StatusNotFound,
 		},
@@ -116,18 +251,19 @@ func TestCartHandler_AddItem(t *testing.T) {
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			db := setupTestDB(t)
-			err := db.AutoMigrate(&models.Cart{}, &models.CartItem{}, &models.Product{}, &models.ProductVariant{})
+			err := db.AutoMigrate(&models.Cart{}, &models.CartItem{}, &models.BundleSelection{}, &models.StockReservation{}, &models.Product{}, &models.ProductVariant{}, &models.Mockup{})
 			assert.NoError(t, err)
 
 			item, variantID, cartID := tc.setup(db)
 
-			handler := NewCartHandler(db)
+			inv := inventory.NewService(db, inventory.Options{})
+			handler := newCartHandler(db, inv)
 			router := gin.Default()
 			api := router.Group("/api")
 			handler.Register(api)
 
 			body, _ := json.Marshal(item)
-			req, _ := http.NewRequest(http.MethodPost, "/api/cart/"+strconv.Itoa(int(cartID))+"/items", bytes.NewBuffer(body))
+			req, _ := http.NewRequest(http.MethodPost, "/api/cart/"+cartID+"/items", bytes.NewBuffer(body))
 			rec := httptest.NewRecorder()
 
 			router.ServeHTTP(rec, req)
@@ -140,12 +276,247 @@ func TestCartHandler_AddItem(t *testing.T) {
 				assert.Equal(t, item["product_variant_id"].(uint), createdItem.ProductVariantID)
 				assert.Equal(t, tc.expectedQuantity, createdItem.Quantity)
 
+				// Stock is reserved rather than decremented
 				var updatedVariant models.ProductVariant
 				db.First(&updatedVariant, variantID)
-				assert.Equal(t, tc.expectedStock, updatedVariant.Stock)
+				assert.Equal(t, uint(10), updatedVariant.Stock)
+				available, err := inv.Available(db, variantID)
+				assert.NoError(t, err)
+				assert.Equal(t, tc.expectedAvailable, available)
+			}
+		})
+	}
+}
+
+func TestCartHandler_AddItemIgnoresServerFields(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	db := setupTestDB(t)
+	assert.NoError(t, db.AutoMigrate(&models.Cart{}, &models.CartItem{}, &models.BundleSelection{}))
+	product := models.Product{Name: "T-shirt", Price: 20}
+	db.Create(&product)
+	variant := models.ProductVariant{ProductID: product.ID, Color: "Black", Size: "M", Stock: 10}
+	db.Create(&variant)
+	cart := models.Cart{}
+	db.Create(&cart)
+
+	inv := inventory.NewService(db, inventory.Options{})
+	router := gin.Default()
+	newCartHandler(db, inv).Register(router.Group("/api"))
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"product_variant_id": variant.ID,
+		"quantity":           1,
+		"saved_at":           time.Now(),
+		"unit_price":         0.01,
+		"product_variant":    map[string]interface{}{"id": variant.ID, "product_id": product.ID, "color": "Gold", "stock": 1000},
+	})
+	req, _ := http.NewRequest(http.MethodPost, "/api/cart/"+cart.Token+"/items", bytes.NewBuffer(body))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	// The line is active and priced from the catalog, and the variant is
+	// untouched
+	var line models.CartItem
+	assert.NoError(t, db.Where("cart_id = ?", cart.ID).First(&line).Error)
+	assert.Nil(t, line.SavedAt)
+	assert.Equal(t, 20.0, line.UnitPrice)
+	var stored models.ProductVariant
+	db.First(&stored, variant.ID)
+	assert.Equal(t, uint(10), stored.Stock)
+	assert.Equal(t, "Black", stored.Color)
+	available, err := inv.Available(db, variant.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 9, available)
+}
+
+func TestCartHandler_AddItems(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	type result struct {
+		Index  int              `json:"index"`
+		Status string           `json:"status"`
+		Item   *models.CartItem `json:"item"`
+		Code   string           `json:"code"`
+	}
+	type response struct {
+		models.Cart
+		Results []result `json:"results"`
+	}
+
+	setup := func(t *testing.T) (*gorm.DB, *inventory.Service, *gin.Engine, models.Product, string) {
+		db := setupTestDB(t)
+		err := db.AutoMigrate(&models.Cart{}, &models.CartItem{}, &models.BundleSelection{})
+		assert.NoError(t, err)
+
+		inv := inventory.NewService(db, inventory.Options{})
+		router := gin.Default()
+		api := router.Group("/api")
+		newCartHandler(db, inv).Register(api)
+
+		product := models.Product{Name: "T-shirt", Price: 20, Variants: []models.ProductVariant{
+			{Color: "Black", Size: "M", Stock: 10},
+			{Color: "White", Size: "M", Stock: 2},
+		}}
+		db.Create(&product)
+		cart := models.Cart{}
+		db.Create(&cart)
+		return db, inv, router, product, cart.Token
+	}
+
+	addItems := func(router *gin.Engine, token string, body map[string]interface{}) (int, response) {
+		b, _ := json.Marshal(body)
+		req, _ := http.NewRequest(http.MethodPost, "/api/cart/"+token+"/items/batch", bytes.NewBuffer(b))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		var resp response
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp
+	}
+
+	statuses := func(results []result) []string {
+		var s []string
+		for _, r := range results {
+			s = append(s, r.Status+":"+r.Code)
+		}
+		return s
+	}
+
+	t.Run("should add what it can in best-effort mode", func(t *testing.T) {
+		db, inv, router, product, token := setup(t)
+		black, white := product.Variants[0], product.Variants[1]
+
+		code, resp := addItems(router, token, map[string]interface{}{"items": []map[string]interface{}{
+			{"product_variant_id": black.ID, "quantity": 2},
+			{"product_variant_id": white.ID, "quantity": 3},
+			{"product_variant_id": 999, "quantity": 1},
+			{"product_variant_id": black.ID, "quantity": 0},
+		}})
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, []string{"added:", "failed:insufficient_stock", "failed:not_found", "failed:invalid"}, statuses(resp.Results))
+		assert.Equal(t, uint(2), resp.Results[0].Item.Quantity)
+		assert.Len(t, resp.Items, 1)
+
+		available, _ := inv.Available(db, black.ID)
+		assert.Equal(t, 8, available)
+		available, _ = inv.Available(db, white.ID)
+		assert.Equal(t, 2, available)
+	})
+
+	// failCreate makes adding a line for the variant fail with err, or, when
+	// err is nil, deletes the variant just before the line is added.
+	failCreate := func(db *gorm.DB, variantID uint, err error) {
+		db.Callback().Create().Before("gorm:create").Register("test:fail_line", func(tx *gorm.DB) {
+			item, ok := tx.Statement.Dest.(*models.CartItem)
+			if !ok || item.ProductVariantID != variantID {
+				return
 			}
+			if err != nil {
+				tx.AddError(err)
+				return
+			}
+			tx.Session(&gorm.Session{NewDB: true}).Delete(&models.ProductVariant{}, variantID)
 		})
 	}
+
+	t.Run("should carry on past an item that fails on the server in best-effort mode", func(t *testing.T) {
+		db, inv, router, product, token := setup(t)
+		black, white := product.Variants[0], product.Variants[1]
+		failCreate(db, white.ID, errors.New("disk I/O error"))
+
+		code, resp := addItems(router, token, map[string]interface{}{"items": []map[string]interface{}{
+			{"product_variant_id": black.ID, "quantity": 2},
+			{"product_variant_id": white.ID, "quantity": 1},
+			{"product_variant_id": black.ID, "quantity": 1},
+		}})
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, []string{"added:", "failed:error", "added:"}, statuses(resp.Results))
+		assert.Len(t, resp.Items, 1)
+
+		available, _ := inv.Available(db, black.ID)
+		assert.Equal(t, 7, available)
+		available, _ = inv.Available(db, white.ID)
+		assert.Equal(t, 2, available)
+	})
+
+	t.Run("should report a variant deleted while it is being added", func(t *testing.T) {
+		db, _, router, product, token := setup(t)
+		black, white := product.Variants[0], product.Variants[1]
+		failCreate(db, white.ID, nil)
+
+		code, resp := addItems(router, token, map[string]interface{}{"items": []map[string]interface{}{
+			{"product_variant_id": white.ID, "quantity": 1},
+			{"product_variant_id": black.ID, "quantity": 1},
+		}})
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, []string{"failed:not_found", "added:"}, statuses(resp.Results))
+
+		body, _ := json.Marshal(map[string]interface{}{"product_variant_id": white.ID, "quantity": 1})
+		req, _ := http.NewRequest(http.MethodPost, "/api/cart/"+token+"/items", bytes.NewBuffer(body))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		assert.JSONEq(t, `{"error":"Product variant not found"}`, rec.Body.String())
+	})
+
+	t.Run("should add nothing in atomic mode when an item fails", func(t *testing.T) {
+		db, inv, router, product, token := setup(t)
+		black, white := product.Variants[0], product.Variants[1]
+
+		code, resp := addItems(router, token, map[string]interface{}{"atomic": true, "items": []map[string]interface{}{
+			{"product_variant_id": black.ID, "quantity": 2},
+			{"product_variant_id": white.ID, "quantity": 3},
+			{"product_variant_id": black.ID, "quantity": 1},
+		}})
+		assert.Equal(t, http.StatusBadRequest, code)
+		assert.Equal(t, []string{"skipped:", "failed:insufficient_stock", "skipped:"}, statuses(resp.Results))
+
+		var lines int64
+		db.Model(&models.CartItem{}).Count(&lines)
+		assert.Equal(t, int64(0), lines)
+		available, _ := inv.Available(db, black.ID)
+		assert.Equal(t, 10, available)
+	})
+
+	t.Run("should not start an atomic batch with an invalid item", func(t *testing.T) {
+		db, _, router, product, token := setup(t)
+
+		code, resp := addItems(router, token, map[string]interface{}{"atomic": true, "items": []map[string]interface{}{
+			{"product_variant_id": product.Variants[0].ID, "quantity": 1},
+			{"product_variant_id": 999, "quantity": 1},
+		}})
+		assert.Equal(t, http.StatusBadRequest, code)
+		assert.Equal(t, []string{"skipped:", "failed:not_found"}, statuses(resp.Results))
+
+		var lines int64
+		db.Model(&models.CartItem{}).Count(&lines)
+		assert.Equal(t, int64(0), lines)
+	})
+
+	t.Run("should merge repeated variants in atomic mode", func(t *testing.T) {
+		db, inv, router, product, token := setup(t)
+		black := product.Variants[0]
+
+		code, resp := addItems(router, token, map[string]interface{}{"atomic": true, "items": []map[string]interface{}{
+			{"product_variant_id": black.ID, "quantity": 2},
+			{"product_variant_id": black.ID, "quantity": 3},
+		}})
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, []string{"added:", "added:"}, statuses(resp.Results))
+		assert.Len(t, resp.Items, 1)
+		assert.Equal(t, uint(5), resp.Items[0].Quantity)
+
+		available, _ := inv.Available(db, black.ID)
+		assert.Equal(t, 5, available)
+	})
+
+	t.Run("should reject an empty batch", func(t *testing.T) {
+		_, _, router, _, token := setup(t)
+
+		code, _ := addItems(router, token, map[string]interface{}{"items": []map[string]interface{}{}})
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
 }
 
 func TestCartHandler_GetCart(t *testing.T) {
@@ -153,7 +524,7 @@ func TestCartHandler_GetCart(t *testing.T) {
 
 	t.Run("should get the cart with items successfully", func(t *testing.T) {
 		db := setupTestDB(t)
-		err := db.AutoMigrate(&models.Cart{}, &models.CartItem{}, &models.Product{}, &models.ProductVariant{})
+		err := db.AutoMigrate(&models.Cart{}, &models.CartItem{}, &models.BundleSelection{}, &models.StockReservation{}, &models.Product{}, &models.ProductVariant{})
 		assert.NoError(t, err)
 
 		// Create a product and variant and add it to the cart
@@ -166,12 +537,12 @@ func TestCartHandler_GetCart(t *testing.T) {
 		cartItem := models.CartItem{CartID: cart.ID, ProductVariantID: variant.ID, Quantity: 2}
 		db.Create(&cartItem)
 
-		handler := NewCartHandler(db)
+		handler := newCartHandler(db, inventory.NewService(db, inventory.Options{}))
 		router := gin.Default()
 		api := router.Group("/api")
 		handler.Register(api)
 
-		req, _ := http.NewRequest(http.MethodGet, "/api/cart/"+strconv.Itoa(int(cart.ID)), nil)
+		req, _ := http.NewRequest(http.MethodGet, "/api/cart/"+cart.Token, nil)
 		rec := httptest.NewRecorder()
 
 		router.ServeHTTP(rec, req)
@@ -180,84 +551,1812 @@ func TestCartHandler_GetCart(t *testing.T) {
 
 		var fetchedCart models.Cart
 		json.Unmarshal(rec.Body.Bytes(), &fetchedCart)
-		assert.Equal(t, cart.ID, fetchedCart.ID)
+		assert.Equal(t, cart.Token, fetchedCart.Token)
 		assert.Len(t, fetchedCart.Items, 1)
 		assert.Equal(t, cartItem.ID, fetchedCart.Items[0].ID)
 		assert.Equal(t, variant.Color, fetchedCart.Items[0].ProductVariant.Color)
 	})
 }
 
-func TestCartHandler_RemoveItem(t *testing.T) {
+func TestCartHandler_GetCart_Totals(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
-	t.Run("should remove an item from the cart successfully", func(t *testing.T) {
+	setup := func(t *testing.T, opts pricing.Options) (*gorm.DB, *gin.Engine) {
 		db := setupTestDB(t)
-		err := db.AutoMigrate(&models.Cart{}, &models.CartItem{}, &models.Product{}, &models.ProductVariant{})
+		err := db.AutoMigrate(&models.Cart{}, &models.CartItem{}, &models.BundleSelection{})
 		assert.NoError(t, err)
 
-		// Create a product and variant and add it to the cart
-		product := models.Product{Name: "T-shirt", Price: 20}
-		db.Create(&product)
-		variant := models.ProductVariant{ProductID: product.ID, Color: "Black", Size: "M", Stock: 10}
-		db.Create(&variant)
+		inv := inventory.NewService(db, inventory.Options{})
+		handler := NewCartHandler(db, inv, pricing.New(opts), carts.NewService(db, inv, carts.Options{}))
+		router := gin.Default()
+		api := router.Group("/api")
+		handler.Register(api)
+		return db, router
+	}
+
+	getTotals := func(t *testing.T, router *gin.Engine, cartID string) pricing.Quote {
+		req, _ := http.NewRequest(http.MethodGet, "/api/cart/"+cartID, nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		var body struct {
+			Totals pricing.Quote `json:"totals"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		return body.Totals
+	}
+
+	t.Run("should price lines, bundle discounts, shipping and tax", func(t *testing.T) {
+		db, router := setup(t, pricing.Options{ShippingRate: 5, FreeShippingThreshold: 100, TaxRate: 0.1})
+
+		tee := models.Product{Name: "T-shirt", Price: 20, Variants: []models.ProductVariant{{Color: "Black", Size: "M", Stock: 10}}}
+		db.Create(&tee)
+		hat := models.Product{Name: "Cap", Price: 15, Variants: []models.ProductVariant{{Color: "Black", Size: "One size", Stock: 10}}}
+		db.Create(&hat)
+		bundle := models.Product{Name: "Tee and cap", Price: 30, Type: models.ProductTypeBundle, BundleDiscountPercent: 10}
+		db.Create(&bundle)
+
 		cart := models.Cart{}
 		db.Create(&cart)
-		cartItem := models.CartItem{CartID: cart.ID, ProductVariantID: variant.ID, Quantity: 1}
-		db.Create(&cartItem)
+		db.Create(&models.CartItem{CartID: cart.ID, ProductVariantID: tee.Variants[0].ID, Quantity: 2, PersonalizationSurcharge: 3})
+		db.Create(&models.CartItem{CartID: cart.ID, BundleProductID: &bundle.ID, Quantity: 1, BundleSelections: []models.BundleSelection{
+			{ProductVariantID: tee.Variants[0].ID, Quantity: 1},
+			{ProductVariantID: hat.Variants[0].ID, Quantity: 1},
+		}})
+
+		totals := getTotals(t, router, cart.Token)
+		assert.Len(t, totals.Lines, 2)
+		assert.Equal(t, 23.0, totals.Lines[0].UnitPrice)
+		assert.Equal(t, 46.0, totals.Lines[0].Total)
+		assert.Equal(t, 35.0, totals.Lines[1].UnitPrice)
+		assert.Equal(t, 3.5, totals.Lines[1].Discount)
+		assert.Equal(t, 31.5, totals.Lines[1].Total)
+		assert.Equal(t, 81.0, totals.Subtotal)
+		assert.Equal(t, 3.5, totals.Discount)
+		assert.Equal(t, 5.0, totals.Shipping)
+		assert.Equal(t, 7.75, totals.Tax)
+		assert.Equal(t, 90.25, totals.Total)
+	})
+
+	t.Run("should waive shipping over the threshold", func(t *testing.T) {
+		db, router := setup(t, pricing.Options{ShippingRate: 5, FreeShippingThreshold: 50})
+
+		tee := models.Product{Name: "T-shirt", Price: 25, Variants: []models.ProductVariant{{Color: "Black", Size: "M", Stock: 10}}}
+		db.Create(&tee)
+		cart := models.Cart{}
+		db.Create(&cart)
+		db.Create(&models.CartItem{CartID: cart.ID, ProductVariantID: tee.Variants[0].ID, Quantity: 2})
+
+		totals := getTotals(t, router, cart.Token)
+		assert.Equal(t, 0.0, totals.Shipping)
+		assert.Equal(t, 50.0, totals.Total)
+	})
+
+	t.Run("should not charge shipping on an empty cart", func(t *testing.T) {
+		db, router := setup(t, pricing.Options{ShippingRate: 5})
+
+		cart := models.Cart{}
+		db.Create(&cart)
+
+		totals := getTotals(t, router, cart.Token)
+		assert.Empty(t, totals.Lines)
+		assert.Equal(t, 0.0, totals.Total)
+	})
+}
+
+func TestCartHandler_GetCart_Warnings(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	setup := func(t *testing.T) (*gorm.DB, *gin.Engine, models.Product, models.ProductVariant, string) {
+		db := setupTestDB(t)
+		err := db.AutoMigrate(&models.Cart{}, &models.CartItem{}, &models.BundleSelection{})
+		assert.NoError(t, err)
 
-		handler := NewCartHandler(db)
+		handler := newCartHandler(db, inventory.NewService(db, inventory.Options{}))
 		router := gin.Default()
 		api := router.Group("/api")
 		handler.Register(api)
 
-		req, _ := http.NewRequest(http.MethodDelete, "/api/cart/"+strconv.Itoa(int(cart.ID))+"/items/"+strconv.Itoa(int(cartItem.ID)), nil)
+		product := models.Product{Name: "T-shirt", Price: 20, Variants: []models.ProductVariant{{Color: "Black", Size: "M", Stock: 10}}}
+		db.Create(&product)
+		cart := models.Cart{}
+		db.Create(&cart)
+
+		body, _ := json.Marshal(map[string]interface{}{"product_variant_id": product.Variants[0].ID, "quantity": 2})
+		req, _ := http.NewRequest(http.MethodPost, "/api/cart/"+cart.Token+"/items", bytes.NewBuffer(body))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+
+		var line models.CartItem
+		json.Unmarshal(rec.Body.Bytes(), &line)
+		assert.Equal(t, 20.0, line.UnitPrice)
+		return db, router, product, product.Variants[0], cart.Token
+	}
+
+	getWarnings := func(t *testing.T, router *gin.Engine, token string) []carts.Warning {
+		req, _ := http.NewRequest(http.MethodGet, "/api/cart/"+token, nil)
 		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		var body struct {
+			Warnings []carts.Warning `json:"warnings"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		return body.Warnings
+	}
+
+	testCases := []struct {
+		name     string
+		change   func(db *gorm.DB, product models.Product, variant models.ProductVariant)
+		expected []carts.Warning
+	}{
+		{
+			name:     "should report nothing when the line is unchanged",
+			change:   func(db *gorm.DB, product models.Product, variant models.ProductVariant) {},
+			expected: []carts.Warning{},
+		},
+		{
+			name: "should report a price increase",
+			change: func(db *gorm.DB, product models.Product, variant models.ProductVariant) {
+				db.Model(&product).Update("price", 25)
+			},
+			expected: []carts.Warning{{Code: carts.WarningPriceIncreased, PreviousPrice: 20, CurrentPrice: 25}},
+		},
+		{
+			name: "should report a price decrease",
+			change: func(db *gorm.DB, product models.Product, variant models.ProductVariant) {
+				db.Model(&product).Update("price", 15)
+			},
+			expected: []carts.Warning{{Code: carts.WarningPriceDecreased, PreviousPrice: 20, CurrentPrice: 15}},
+		},
+		{
+			name: "should report an archived variant",
+			change: func(db *gorm.DB, product models.Product, variant models.ProductVariant) {
+				db.Model(&variant).Update("archived_at", time.Now())
+			},
+			expected: []carts.Warning{{Code: carts.WarningVariantArchived}},
+		},
+		{
+			name: "should report stock that no longer covers the line",
+			change: func(db *gorm.DB, product models.Product, variant models.ProductVariant) {
+				db.Model(&variant).Update("stock", 1)
+			},
+			expected: []carts.Warning{{Code: carts.WarningInsufficientStock}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, router, product, variant, token := setup(t)
+			tc.change(db, product, variant)
+
+			warnings := getWarnings(t, router, token)
+			assert.Len(t, warnings, len(tc.expected))
+			for i, expected := range tc.expected {
+				if i >= len(warnings) {
+					break
+				}
+				assert.Equal(t, expected.Code, warnings[i].Code)
+				assert.Equal(t, expected.PreviousPrice, warnings[i].PreviousPrice)
+				assert.Equal(t, expected.CurrentPrice, warnings[i].CurrentPrice)
+				assert.NotEmpty(t, warnings[i].Message)
+			}
+			if len(warnings) == 1 && warnings[0].Code == carts.WarningInsufficientStock {
+				assert.Equal(t, uint(1), *warnings[0].Available)
+			}
+		})
+	}
 
+	t.Run("should keep the recorded price when the item is added again", func(t *testing.T) {
+		db, router, product, variant, token := setup(t)
+		db.Model(&product).Update("price", 25)
+
+		body, _ := json.Marshal(map[string]interface{}{"product_variant_id": variant.ID, "quantity": 1})
+		req, _ := http.NewRequest(http.MethodPost, "/api/cart/"+token+"/items", bytes.NewBuffer(body))
+		rec := httptest.NewRecorder()
 		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusCreated, rec.Code)
 
-		assert.Equal(t, http.StatusNoContent, rec.Code)
+		// The increase still has to be accepted for the whole line
+		var line models.CartItem
+		json.Unmarshal(rec.Body.Bytes(), &line)
+		assert.Equal(t, uint(3), line.Quantity)
+		assert.Equal(t, 20.0, line.UnitPrice)
+		warnings := getWarnings(t, router, token)
+		if assert.Len(t, warnings, 1) {
+			assert.Equal(t, carts.WarningPriceIncreased, warnings[0].Code)
+		}
+	})
 
-		// Verify the item was deleted
-		var deletedItem models.CartItem
-		err = db.First(&deletedItem, cartItem.ID).Error
-		assert.Error(t, err) // Should not find the item
+	t.Run("should not compare prices of lines added before prices were recorded", func(t *testing.T) {
+		db, router, product, _, token := setup(t)
+		db.Model(&models.CartItem{}).Where("1 = 1").Update("unit_price", 0)
+		db.Model(&product).Update("price", 25)
+
+		assert.Empty(t, getWarnings(t, router, token))
 	})
 }
 
-func TestCartHandler_DeleteCart(t *testing.T) {
+func TestCartHandler_Expiry(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
-	t.Run("should delete a cart and its items successfully", func(t *testing.T) {
+	setup := func(t *testing.T) (*gorm.DB, *inventory.Service, *carts.Service, *gin.Engine, models.ProductVariant) {
 		db := setupTestDB(t)
-		err := db.AutoMigrate(&models.Cart{}, &models.CartItem{}, &models.Product{}, &models.ProductVariant{})
+		err := db.AutoMigrate(&models.Cart{}, &models.CartItem{}, &models.BundleSelection{})
 		assert.NoError(t, err)
 
-		// Create a cart with an item
-		cart := models.Cart{}
-		db.Create(&cart)
-		cartItem := models.CartItem{CartID: cart.ID, ProductVariantID: 1, Quantity: 1}
-		db.Create(&cartItem)
+		product := models.Product{Name: "T-shirt", Price: 20, Variants: []models.ProductVariant{{Color: "Black", Size: "M", Stock: 10}}}
+		db.Create(&product)
 
-		handler := NewCartHandler(db)
+		inv := inventory.NewService(db, inventory.Options{ReservationTTL: 2 * time.Hour})
+		cartService := carts.NewService(db, inv, carts.Options{IdleTTL: time.Hour})
 		router := gin.Default()
 		api := router.Group("/api")
-		handler.Register(api)
+		NewCartHandler(db, inv, pricing.New(pricing.Options{}), cartService).Register(api)
+		return db, inv, cartService, router, product.Variants[0]
+	}
 
-		req, _ := http.NewRequest(http.MethodDelete, "/api/cart/"+strconv.Itoa(int(cart.ID)), nil)
+	createCart := func(t *testing.T, router *gin.Engine, variant models.ProductVariant) models.Cart {
+		req, _ := http.NewRequest(http.MethodPost, "/api/cart", nil)
 		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		var cart models.Cart
+		json.Unmarshal(rec.Body.Bytes(), &cart)
 
+		body, _ := json.Marshal(map[string]interface{}{"product_variant_id": variant.ID, "quantity": 3})
+		req, _ = http.NewRequest(http.MethodPost, "/api/cart/"+cart.Token+"/items", bytes.NewBuffer(body))
+		rec = httptest.NewRecorder()
 		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		return cart
+	}
 
-		assert.Equal(t, http.StatusNoContent, rec.Code)
+	t.Run("should report when the cart expires", func(t *testing.T) {
+		_, _, _, router, variant := setup(t)
+		cart := createCart(t, router, variant)
 
-		// Verify the cart was deleted
-		var deletedCart models.Cart
-		err = db.First(&deletedCart, cart.ID).Error
-		assert.Error(t, err) // Should not find the cart
+		if assert.NotNil(t, cart.ExpiresAt) {
+			assert.WithinDuration(t, cart.UpdatedAt.Add(time.Hour), *cart.ExpiresAt, time.Second)
+		}
+	})
 
-		// Verify the cart item was deleted
-		var deletedItem models.CartItem
-		err = db.First(&deletedItem, cartItem.ID).Error
+	t.Run("should renew the expiry when the cart is read", func(t *testing.T) {
+		db, _, cartService, router, variant := setup(t)
+		cart := createCart(t, router, variant)
+		db.Model(&models.Cart{}).Where("token = ?", cart.Token).Update("updated_at", time.Now().Add(-50*time.Minute))
+
+		req, _ := http.NewRequest(http.MethodGet, "/api/cart/"+cart.Token, nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		var fetched models.Cart
+		json.Unmarshal(rec.Body.Bytes(), &fetched)
+		if assert.NotNil(t, fetched.ExpiresAt) {
+			assert.WithinDuration(t, time.Now().Add(time.Hour), *fetched.ExpiresAt, 5*time.Second)
+		}
+
+		deleted, err := cartService.DeleteExpired(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 0, deleted)
+	})
+
+	t.Run("should reject expired carts and delete them with their stock", func(t *testing.T) {
+		db, inv, cartService, router, variant := setup(t)
+		cart := createCart(t, router, variant)
+		kept := createCart(t, router, variant)
+		db.Model(&models.Cart{}).Where("token = ?", cart.Token).Update("updated_at", time.Now().Add(-2*time.Hour))
+
+		req, _ := http.NewRequest(http.MethodGet, "/api/cart/"+cart.Token, nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		assert.Contains(t, rec.Body.String(), "Cart has expired")
+
+		body, _ := json.Marshal(map[string]interface{}{"product_variant_id": variant.ID, "quantity": 1})
+		req, _ = http.NewRequest(http.MethodPost, "/api/cart/"+cart.Token+"/items", bytes.NewBuffer(body))
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+
+		available, _ := inv.Available(db, variant.ID)
+		assert.Equal(t, 4, available)
+
+		deleted, err := cartService.DeleteExpired(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 1, deleted)
+
+		available, _ = inv.Available(db, variant.ID)
+		assert.Equal(t, 7, available)
+		var items int64
+		db.Model(&models.CartItem{}).Count(&items)
+		assert.Equal(t, int64(1), items)
+		assert.Error(t, db.Where("token = ?", cart.Token).First(&models.Cart{}).Error)
+		assert.NoError(t, db.Where("token = ?", kept.Token).First(&models.Cart{}).Error)
+	})
+}
+
+func TestCartHandler_Tokens(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	setup := func(t *testing.T, opts carts.Options) (*gorm.DB, *carts.Service, *gin.Engine) {
+		db := setupTestDB(t)
+		err := db.AutoMigrate(&models.Cart{}, &models.CartItem{}, &models.BundleSelection{})
+		assert.NoError(t, err)
+
+		inv := inventory.NewService(db, inventory.Options{})
+		cartService := carts.NewService(db, inv, opts)
+		router := gin.Default()
+		api := router.Group("/api")
+		NewCartHandler(db, inv, pricing.New(pricing.Options{}), cartService).Register(api)
+		return db, cartService, router
+	}
+
+	t.Run("should address carts by token only", func(t *testing.T) {
+		_, _, router := setup(t, carts.Options{})
+
+		req, _ := http.NewRequest(http.MethodPost, "/api/cart", nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		assert.Empty(t, rec.Result().Cookies())
+
+		var created map[string]interface{}
+		json.Unmarshal(rec.Body.Bytes(), &created)
+		assert.NotContains(t, created, "id")
+		token, _ := created["token"].(string)
+		assert.Len(t, token, 32)
+
+		req, _ = http.NewRequest(http.MethodGet, "/api/cart/"+token, nil)
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		req, _ = http.NewRequest(http.MethodGet, "/api/cart/1", nil)
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+
+	t.Run("should find the cart from a signed cookie", func(t *testing.T) {
+		_, _, router := setup(t, carts.Options{CookieSecret: "secret"})
+
+		req, _ := http.NewRequest(http.MethodPost, "/api/cart", nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		var created models.Cart
+		json.Unmarshal(rec.Body.Bytes(), &created)
+
+		cookies := rec.Result().Cookies()
+		if !assert.Len(t, cookies, 1) {
+			return
+		}
+		assert.Equal(t, carts.CookieName, cookies[0].Name)
+		assert.True(t, cookies[0].HttpOnly)
+
+		req, _ = http.NewRequest(http.MethodGet, "/api/cart", nil)
+		req.AddCookie(cookies[0])
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var fetched models.Cart
+		json.Unmarshal(rec.Body.Bytes(), &fetched)
+		assert.Equal(t, created.Token, fetched.Token)
+
+		// A cookie naming another cart fails the signature check
+		req, _ = http.NewRequest(http.MethodGet, "/api/cart", nil)
+		req.AddCookie(&http.Cookie{Name: carts.CookieName, Value: "another-cart." + strings.SplitN(cookies[0].Value, ".", 2)[1]})
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+
+	t.Run("should backfill tokens of existing carts", func(t *testing.T) {
+		db, cartService, _ := setup(t, carts.Options{})
+		updatedAt := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+		db.Exec("INSERT INTO carts (created_at, updated_at) VALUES (?, ?), (?, ?)", updatedAt, updatedAt, updatedAt, updatedAt)
+
+		assert.NoError(t, cartService.BackfillTokens())
+
+		var backfilled []models.Cart
+		db.Find(&backfilled)
+		assert.Len(t, backfilled, 2)
+		for _, cart := range backfilled {
+			assert.Len(t, cart.Token, 32)
+			assert.True(t, updatedAt.Equal(cart.UpdatedAt))
+		}
+		assert.NotEqual(t, backfilled[0].Token, backfilled[1].Token)
+	})
+}
+
+func TestCartHandler_MergeCart(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	db := setupTestDB(t)
+	err := db.AutoMigrate(&models.Cart{}, &models.CartItem{}, &models.BundleSelection{})
+	assert.NoError(t, err)
+
+	product := models.Product{Name: "T-shirt", Price: 20, Variants: []models.ProductVariant{
+		{Color: "Black", Size: "M", Stock: 5},
+		{Color: "White", Size: "M", Stock: 3},
+	}}
+	db.Create(&product)
+	black, white := product.Variants[0], product.Variants[1]
+
+	inv := inventory.NewService(db, inventory.Options{})
+	router := gin.Default()
+	api := router.Group("/api")
+	newCartHandler(db, inv).Register(api)
+
+	createCart := func() string {
+		req, _ := http.NewRequest(http.MethodPost, "/api/cart", nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		var cart models.Cart
+		json.Unmarshal(rec.Body.Bytes(), &cart)
+		return cart.Token
+	}
+	addItem := func(token string, variantID uint, quantity int) {
+		body, _ := json.Marshal(map[string]interface{}{"product_variant_id": variantID, "quantity": quantity})
+		req, _ := http.NewRequest(http.MethodPost, "/api/cart/"+token+"/items", bytes.NewBuffer(body))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+	}
+	type mergeResult struct {
+		models.Cart
+		Adjustments []carts.Adjustment `json:"adjustments"`
+	}
+	merge := func(token string, body map[string]interface{}) (int, mergeResult) {
+		b, _ := json.Marshal(body)
+		req, _ := http.NewRequest(http.MethodPost, "/api/cart/"+token+"/merge", bytes.NewBuffer(b))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		var result mergeResult
+		json.Unmarshal(rec.Body.Bytes(), &result)
+		return rec.Code, result
+	}
+
+	// Without a cart of their own, the signed-in cart becomes the customer's
+	customerToken := createCart()
+	addItem(customerToken, black.ID, 2)
+	code, result := merge(customerToken, map[string]interface{}{"customer_id": "cust-1"})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, customerToken, result.Token)
+	assert.Equal(t, "cust-1", result.CustomerID)
+	assert.Empty(t, result.Adjustments)
+
+	code, _ = merge(customerToken, map[string]interface{}{})
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// Another customer cannot take the cart
+	code, _ = merge(customerToken, map[string]interface{}{"customer_id": "cust-2"})
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// A customer ID alone never reveals the customer's other carts
+	otherToken := createCart()
+	code, result = merge(otherToken, map[string]interface{}{"customer_id": "cust-1"})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, otherToken, result.Token)
+	assert.Empty(t, result.Items)
+
+	code, _ = merge(createCart(), map[string]interface{}{"customer_id": "cust-1", "cart_token": "unknown"})
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = merge(createCart(), map[string]interface{}{"customer_id": "cust-2", "cart_token": customerToken})
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	anonymousToken := createCart()
+	addItem(anonymousToken, black.ID, 3)
+	addItem(anonymousToken, white.ID, 1)
+
+	// Stock drops after the items were added, so the summed line no longer fits
+	db.Model(&black).Update("stock", 4)
+	db.Model(&white).Update("archived_at", time.Now())
+
+	code, result = merge(anonymousToken, map[string]interface{}{"customer_id": "cust-1", "cart_token": customerToken})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, customerToken, result.Token)
+	if assert.Len(t, result.Items, 2) {
+		assert.Equal(t, black.ID, result.Items[0].ProductVariantID)
+		assert.Equal(t, uint(4), result.Items[0].Quantity)
+		assert.Equal(t, white.ID, result.Items[1].ProductVariantID)
+		assert.Equal(t, uint(1), result.Items[1].Quantity)
+	}
+	if assert.Len(t, result.Adjustments, 1) {
+		assert.Equal(t, black.ID, result.Adjustments[0].ProductVariantID)
+		assert.Equal(t, uint(5), result.Adjustments[0].Requested)
+		assert.Equal(t, uint(4), result.Adjustments[0].Quantity)
+		assert.Equal(t, carts.AdjustmentInsufficientStock, result.Adjustments[0].Reason)
+	}
+
+	available, _ := inv.Available(db, black.ID)
+	assert.Equal(t, 0, available)
+	available, _ = inv.Available(db, white.ID)
+	assert.Equal(t, 2, available)
+
+	// The anonymous cart is gone
+	req, _ := http.NewRequest(http.MethodGet, "/api/cart/"+anonymousToken, nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestCartHandler_ValidateCart(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	type validateResult struct {
+		models.Cart
+		Valid    bool            `json:"valid"`
+		Problems []carts.Warning `json:"problems"`
+	}
+
+	setup := func(t *testing.T) (*gorm.DB, *gin.Engine) {
+		db := setupTestDB(t)
+		err := db.AutoMigrate(&models.Cart{}, &models.CartItem{}, &models.BundleSelection{})
+		assert.NoError(t, err)
+
+		inv := inventory.NewService(db, inventory.Options{})
+		handler := NewCartHandler(db, inv, pricing.New(pricing.Options{}), carts.NewService(db, inv, carts.Options{MaxLineQuantity: 5}))
+		router := gin.Default()
+		api := router.Group("/api")
+		handler.Register(api)
+		return db, router
+	}
+
+	validate := func(t *testing.T, router *gin.Engine, token, body string) validateResult {
+		req, _ := http.NewRequest(http.MethodPost, "/api/cart/"+token+"/validate", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		var result validateResult
+		json.Unmarshal(rec.Body.Bytes(), &result)
+		return result
+	}
+
+	// seed fills a cart with one healthy line and one line for each problem,
+	// returning the cart token and the lines by name.
+	seed := func(db *gorm.DB) (string, map[string]models.CartItem) {
+		tee := models.Product{Name: "T-shirt", Price: 20, Variants: []models.ProductVariant{
+			{Color: "Black", Size: "M", Stock: 10},
+			{Color: "White", Size: "M", Stock: 10},
+			{Color: "Red", Size: "M", Stock: 2},
+			{Color: "Blue", Size: "M", Stock: 10},
+		}}
+		db.Create(&tee)
+		gone := models.Product{Name: "Hoodie", Price: 40, Variants: []models.ProductVariant{{Color: "Grey", Size: "M", Stock: 10}}}
+		db.Create(&gone)
+		cart := models.Cart{}
+		db.Create(&cart)
+
+		lines := map[string]models.CartItem{
+			"ok":       {CartID: cart.ID, ProductVariantID: tee.Variants[0].ID, Quantity: 1, UnitPrice: 20},
+			"missing":  {CartID: cart.ID, ProductVariantID: tee.Variants[1].ID, Quantity: 1, UnitPrice: 20},
+			"stock":    {CartID: cart.ID, ProductVariantID: tee.Variants[2].ID, Quantity: 3, UnitPrice: 20},
+			"limit":    {CartID: cart.ID, ProductVariantID: tee.Variants[3].ID, Quantity: 7, UnitPrice: 20},
+			"product":  {CartID: cart.ID, ProductVariantID: gone.Variants[0].ID, Quantity: 1, UnitPrice: 40},
+			"repriced": {CartID: cart.ID, ProductVariantID: tee.Variants[0].ID, Quantity: 1, UnitPrice: 18, PersonalizationKey: "other"},
+		}
+		for name, line := range lines {
+			db.Create(&line)
+			lines[name] = line
+		}
+		db.Delete(&models.ProductVariant{}, tee.Variants[1].ID)
+		db.Delete(&models.Product{}, gone.ID)
+		return cart.Token, lines
+	}
+
+	problemCodes := func(result validateResult) map[uint][]string {
+		codes := map[uint][]string{}
+		for _, p := range result.Problems {
+			codes[p.CartItemID] = append(codes[p.CartItemID], p.Code)
+		}
+		return codes
+	}
+
+	t.Run("should report problems without changing the cart", func(t *testing.T) {
+		db, router := setup(t)
+		token, lines := seed(db)
+
+		result := validate(t, router, token, "")
+		assert.False(t, result.Valid)
+		assert.Equal(t, map[uint][]string{
+			lines["missing"].ID:  {carts.WarningVariantMissing},
+			lines["stock"].ID:    {carts.WarningInsufficientStock},
+			lines["limit"].ID:    {carts.WarningQuantityLimit},
+			lines["product"].ID:  {carts.WarningProductMissing},
+			lines["repriced"].ID: {carts.WarningPriceIncreased},
+		}, problemCodes(result))
+		for _, p := range result.Problems {
+			assert.Empty(t, p.Fix)
+			assert.True(t, p.Blocking)
+		}
+		assert.Len(t, result.Items, 6)
+	})
+
+	t.Run("should fix problems when asked", func(t *testing.T) {
+		db, router := setup(t)
+		token, lines := seed(db)
+
+		result := validate(t, router, token, `{"fix": true}`)
+		assert.True(t, result.Valid)
+		fixes := map[uint]string{}
+		for _, p := range result.Problems {
+			fixes[p.CartItemID] = p.Fix
+		}
+		assert.Equal(t, map[uint]string{
+			lines["missing"].ID:  carts.FixRemoved,
+			lines["stock"].ID:    carts.FixClamped,
+			lines["limit"].ID:    carts.FixClamped,
+			lines["product"].ID:  carts.FixRemoved,
+			lines["repriced"].ID: carts.FixRepriced,
+		}, fixes)
+
+		quantities := map[uint]uint{}
+		for _, item := range result.Items {
+			quantities[item.ID] = item.Quantity
+		}
+		assert.Equal(t, map[uint]uint{
+			lines["ok"].ID:       1,
+			lines["stock"].ID:    2,
+			lines["limit"].ID:    5,
+			lines["repriced"].ID: 1,
+		}, quantities)
+
+		var reserved uint
+		db.Model(&models.StockReservation{}).Where("cart_item_id = ?", lines["stock"].ID).Select("quantity").Scan(&reserved)
+		assert.Equal(t, uint(2), reserved)
+
+		// Everything left can be checked out as it is
+		again := validate(t, router, token, "")
+		assert.True(t, again.Valid)
+		assert.Empty(t, again.Problems)
+	})
+
+	t.Run("should remove a line when no stock is left", func(t *testing.T) {
+		db, router := setup(t)
+		product := models.Product{Name: "T-shirt", Price: 20, Variants: []models.ProductVariant{{Color: "Black", Size: "M", Stock: 0}}}
+		db.Create(&product)
+		cart := models.Cart{}
+		db.Create(&cart)
+		line := models.CartItem{CartID: cart.ID, ProductVariantID: product.Variants[0].ID, Quantity: 1, UnitPrice: 20}
+		db.Create(&line)
+
+		result := validate(t, router, cart.Token, `{"fix": true}`)
+		assert.True(t, result.Valid)
+		assert.Len(t, result.Problems, 1)
+		assert.Equal(t, carts.FixRemoved, result.Problems[0].Fix)
+		assert.Empty(t, result.Items)
+	})
+
+	t.Run("should both reprice and clamp a line", func(t *testing.T) {
+		db, router := setup(t)
+		product := models.Product{Name: "T-shirt", Price: 20, Variants: []models.ProductVariant{{Color: "Black", Size: "M", Stock: 2}}}
+		db.Create(&product)
+		cart := models.Cart{}
+		db.Create(&cart)
+		line := models.CartItem{CartID: cart.ID, ProductVariantID: product.Variants[0].ID, Quantity: 3, UnitPrice: 18}
+		db.Create(&line)
+
+		result := validate(t, router, cart.Token, `{"fix": true}`)
+		assert.True(t, result.Valid)
+		fixes := map[string]string{}
+		for _, p := range result.Problems {
+			fixes[p.Code] = p.Fix
+		}
+		assert.Equal(t, map[string]string{
+			carts.WarningPriceIncreased:    carts.FixRepriced,
+			carts.WarningInsufficientStock: carts.FixClamped,
+		}, fixes)
+
+		db.First(&line, line.ID)
+		assert.Equal(t, uint(2), line.Quantity)
+		assert.Equal(t, 20.0, line.UnitPrice)
+	})
+
+	t.Run("should reject quantities over the limit when adding", func(t *testing.T) {
+		db, router := setup(t)
+		product := models.Product{Name: "T-shirt", Price: 20, Variants: []models.ProductVariant{{Color: "Black", Size: "M", Stock: 10}}}
+		db.Create(&product)
+		cart := models.Cart{}
+		db.Create(&cart)
+
+		body, _ := json.Marshal(map[string]interface{}{"product_variant_id": product.Variants[0].ID, "quantity": 6})
+		req, _ := http.NewRequest(http.MethodPost, "/api/cart/"+cart.Token+"/items", bytes.NewBuffer(body))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), "At most 5 per item")
+	})
+}
+
+func TestCartHandler_PurchaseLimits(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	limit := func(n uint) *uint { return &n }
+
+	// setup seeds a product limited to 4 per cart whose first variant is
+	// limited to 3, in a service allowing 8 units over 3 lines per cart.
+	setup := func(t *testing.T) (*gorm.DB, *gin.Engine, models.Product, string) {
+		db := setupTestDB(t)
+		err := db.AutoMigrate(&models.Cart{}, &models.CartItem{}, &models.BundleSelection{})
+		assert.NoError(t, err)
+
+		inv := inventory.NewService(db, inventory.Options{})
+		service := carts.NewService(db, inv, carts.Options{MaxCartQuantity: 8, MaxCartLines: 3})
+		handler := NewCartHandler(db, inv, pricing.New(pricing.Options{}), service)
+		router := gin.Default()
+		api := router.Group("/api")
+		handler.Register(api)
+
+		product := models.Product{Name: "T-shirt", Price: 20, MaxPerCart: limit(4), Variants: []models.ProductVariant{
+			{Color: "Black", Size: "M", Stock: 10, MaxPerCart: limit(3)},
+			{Color: "White", Size: "M", Stock: 10},
+		}}
+		db.Create(&product)
+		cart := models.Cart{}
+		db.Create(&cart)
+		return db, router, product, cart.Token
+	}
+
+	send := func(router *gin.Engine, method, path string, body interface{}) *httptest.ResponseRecorder {
+		payload, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer(payload))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	addItem := func(router *gin.Engine, token string, variantID, quantity uint) *httptest.ResponseRecorder {
+		return send(router, http.MethodPost, "/api/cart/"+token+"/items", map[string]interface{}{"product_variant_id": variantID, "quantity": quantity})
+	}
+
+	errorCode := func(rec *httptest.ResponseRecorder) string {
+		var body struct {
+			Code string `json:"code"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		return body.Code
+	}
+
+	t.Run("should enforce variant and product limits when adding", func(t *testing.T) {
+		_, router, product, token := setup(t)
+		black, white := product.Variants[0].ID, product.Variants[1].ID
+
+		assert.Equal(t, http.StatusCreated, addItem(router, token, black, 2).Code)
+
+		tests := []struct {
+			name      string
+			variantID uint
+			quantity  uint
+			code      string
+			message   string
+		}{
+			{"variant limit", black, 2, carts.LimitVariantQuantity, "At most 3 of this variant per cart"},
+			{"product limit", white, 3, carts.LimitProductQuantity, "At most 4 of this product per cart"},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				rec := addItem(router, token, tt.variantID, tt.quantity)
+				assert.Equal(t, http.StatusBadRequest, rec.Code)
+				assert.Equal(t, tt.code, errorCode(rec))
+				assert.Contains(t, rec.Body.String(), tt.message)
+			})
+		}
+
+		assert.Equal(t, http.StatusCreated, addItem(router, token, white, 2).Code)
+	})
+
+	t.Run("should enforce limits when increasing a line but not when reducing it", func(t *testing.T) {
+		db, router, product, token := setup(t)
+		rec := addItem(router, token, product.Variants[0].ID, 3)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		var line models.CartItem
+		json.Unmarshal(rec.Body.Bytes(), &line)
+		path := "/api/cart/" + token + "/items/" + strconv.Itoa(int(line.ID))
+
+		rec = send(router, http.MethodPatch, path, map[string]uint{"quantity": 4})
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Equal(t, carts.LimitVariantQuantity, errorCode(rec))
+
+		// The limit was lowered after the line was added
+		db.Model(&models.ProductVariant{}).Where("id = ?", product.Variants[0].ID).Update("max_per_cart", 1)
+		rec = send(router, http.MethodPatch, path, map[string]uint{"quantity": 2})
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+
+	t.Run("should enforce the cart's quantity and lines limits", func(t *testing.T) {
+		db, router, product, token := setup(t)
+		others := models.Product{Name: "Sticker", Price: 2, Variants: []models.ProductVariant{
+			{Color: "Red", Size: "S", Stock: 10},
+			{Color: "Blue", Size: "S", Stock: 10},
+			{Color: "Green", Size: "S", Stock: 10},
+		}}
+		db.Create(&others)
+
+		assert.Equal(t, http.StatusCreated, addItem(router, token, others.Variants[0].ID, 5).Code)
+		rec := addItem(router, token, others.Variants[1].ID, 4)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Equal(t, carts.LimitCartQuantity, errorCode(rec))
+		assert.Contains(t, rec.Body.String(), "At most 8 items per cart")
+
+		assert.Equal(t, http.StatusCreated, addItem(router, token, others.Variants[1].ID, 1).Code)
+		assert.Equal(t, http.StatusCreated, addItem(router, token, others.Variants[2].ID, 1).Code)
+		rec = addItem(router, token, others.Variants[2].ID, 1)
+		assert.Equal(t, http.StatusCreated, rec.Code, "adding to an existing line needs no new line")
+
+		rec = addItem(router, token, product.Variants[1].ID, 1)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Equal(t, carts.LimitCartLines, errorCode(rec))
+		assert.Contains(t, rec.Body.String(), "At most 3 different items per cart")
+	})
+
+	t.Run("should clamp lines sharing a limit only as far as needed", func(t *testing.T) {
+		db, router, product, token := setup(t)
+		var cart models.Cart
+		db.Where("token = ?", token).First(&cart)
+		black := models.CartItem{CartID: cart.ID, ProductVariantID: product.Variants[0].ID, Quantity: 3, UnitPrice: 20}
+		white := models.CartItem{CartID: cart.ID, ProductVariantID: product.Variants[1].ID, Quantity: 3, UnitPrice: 20}
+		db.Create(&black)
+		db.Create(&white)
+
+		rec := send(router, http.MethodPost, "/api/cart/"+token+"/validate", map[string]bool{"fix": true})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var result struct {
+			models.Cart
+			Valid    bool            `json:"valid"`
+			Problems []carts.Warning `json:"problems"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &result)
+		assert.True(t, result.Valid)
+		assert.Len(t, result.Problems, 2)
+		for _, p := range result.Problems {
+			assert.Equal(t, carts.LimitProductQuantity, p.Code)
+		}
+
+		quantities := map[uint]uint{}
+		for _, item := range result.Items {
+			quantities[item.ID] = item.Quantity
+		}
+		assert.Equal(t, map[uint]uint{black.ID: 1, white.ID: 3}, quantities)
+	})
+}
+
+func TestCartHandler_SaveForLater(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	type cartResult struct {
+		models.Cart
+		Totals pricing.Quote `json:"totals"`
+	}
+
+	setup := func(t *testing.T) (*gorm.DB, *inventory.Service, *gin.Engine, models.ProductVariant) {
+		db := setupTestDB(t)
+		err := db.AutoMigrate(&models.Cart{}, &models.CartItem{}, &models.BundleSelection{})
+		assert.NoError(t, err)
+
+		inv := inventory.NewService(db, inventory.Options{})
+		router := gin.Default()
+		api := router.Group("/api")
+		newCartHandler(db, inv).Register(api)
+
+		product := models.Product{Name: "T-shirt", Price: 20, Variants: []models.ProductVariant{{Color: "Black", Size: "M", Stock: 5}}}
+		db.Create(&product)
+		return db, inv, router, product.Variants[0]
+	}
+
+	createCart := func(router *gin.Engine) string {
+		req, _ := http.NewRequest(http.MethodPost, "/api/cart", nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		var cart models.Cart
+		json.Unmarshal(rec.Body.Bytes(), &cart)
+		return cart.Token
+	}
+	addItem := func(t *testing.T, router *gin.Engine, token string, variantID uint, quantity int) models.CartItem {
+		body, _ := json.Marshal(map[string]interface{}{"product_variant_id": variantID, "quantity": quantity})
+		req, _ := http.NewRequest(http.MethodPost, "/api/cart/"+token+"/items", bytes.NewBuffer(body))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		var line models.CartItem
+		json.Unmarshal(rec.Body.Bytes(), &line)
+		return line
+	}
+	move := func(router *gin.Engine, token string, itemID uint, action string) (int, cartResult) {
+		req, _ := http.NewRequest(http.MethodPost, "/api/cart/"+token+"/items/"+strconv.Itoa(int(itemID))+"/"+action, nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		var cart cartResult
+		json.Unmarshal(rec.Body.Bytes(), &cart)
+		return rec.Code, cart
+	}
+
+	t.Run("should release stock when saving and hold it again when moving back", func(t *testing.T) {
+		db, inv, router, variant := setup(t)
+		token := createCart(router)
+		line := addItem(t, router, token, variant.ID, 2)
+
+		code, cart := move(router, token, line.ID, "save-for-later")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Empty(t, cart.Items)
+		assert.Len(t, cart.SavedItems, 1)
+		assert.NotNil(t, cart.SavedItems[0].SavedAt)
+		assert.Empty(t, cart.Totals.Lines)
+		available, _ := inv.Available(db, variant.ID)
+		assert.Equal(t, 5, available)
+
+		code, cart = move(router, token, line.ID, "move-to-cart")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Len(t, cart.Items, 1)
+		assert.Empty(t, cart.SavedItems)
+		assert.Equal(t, uint(2), cart.Items[0].Quantity)
+		assert.Len(t, cart.Totals.Lines, 1)
+		available, _ = inv.Available(db, variant.ID)
+		assert.Equal(t, 3, available)
+	})
+
+	t.Run("should keep the line saved when stock is gone", func(t *testing.T) {
+		db, _, router, variant := setup(t)
+		token := createCart(router)
+		line := addItem(t, router, token, variant.ID, 2)
+		move(router, token, line.ID, "save-for-later")
+		addItem(t, router, createCart(router), variant.ID, 4)
+
+		code, _ := move(router, token, line.ID, "move-to-cart")
+		assert.Equal(t, http.StatusBadRequest, code)
+
+		var saved models.CartItem
+		db.First(&saved, line.ID)
+		assert.NotNil(t, saved.SavedAt)
+	})
+
+	t.Run("should not move an archived variant back to the cart", func(t *testing.T) {
+		db, _, router, variant := setup(t)
+		token := createCart(router)
+		line := addItem(t, router, token, variant.ID, 1)
+		move(router, token, line.ID, "save-for-later")
+		db.Model(&variant).Update("archived_at", time.Now())
+
+		code, _ := move(router, token, line.ID, "move-to-cart")
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+
+	t.Run("should merge lines for the same item", func(t *testing.T) {
+		db, inv, router, variant := setup(t)
+		token := createCart(router)
+		line := addItem(t, router, token, variant.ID, 1)
+		move(router, token, line.ID, "save-for-later")
+
+		// Adding the item again starts a new cart line rather than reviving the saved one
+		second := addItem(t, router, token, variant.ID, 2)
+		assert.NotEqual(t, line.ID, second.ID)
+		_, cart := move(router, token, second.ID, "save-for-later")
+		assert.Empty(t, cart.Items)
+		assert.Len(t, cart.SavedItems, 1)
+		assert.Equal(t, uint(3), cart.SavedItems[0].Quantity)
+
+		addItem(t, router, token, variant.ID, 1)
+		_, cart = move(router, token, cart.SavedItems[0].ID, "move-to-cart")
+		assert.Empty(t, cart.SavedItems)
+		assert.Len(t, cart.Items, 1)
+		assert.Equal(t, uint(4), cart.Items[0].Quantity)
+		available, _ := inv.Available(db, variant.ID)
+		assert.Equal(t, 1, available)
+	})
+
+	t.Run("should not update the quantity of a saved line", func(t *testing.T) {
+		_, _, router, variant := setup(t)
+		token := createCart(router)
+		line := addItem(t, router, token, variant.ID, 1)
+		move(router, token, line.ID, "save-for-later")
+
+		req, _ := http.NewRequest(http.MethodPatch, "/api/cart/"+token+"/items/"+strconv.Itoa(int(line.ID)), strings.NewReader(`{"quantity": 2}`))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("should carry saved lines over when merging carts", func(t *testing.T) {
+		_, _, router, variant := setup(t)
+		customer := createCart(router)
+		body, _ := json.Marshal(map[string]string{"customer_id": "cust-1"})
+		req, _ := http.NewRequest(http.MethodPost, "/api/cart/"+customer+"/merge", bytes.NewBuffer(body))
+		router.ServeHTTP(httptest.NewRecorder(), req)
+
+		anonymous := createCart(router)
+		line := addItem(t, router, anonymous, variant.ID, 1)
+		move(router, anonymous, line.ID, "save-for-later")
+
+		body, _ = json.Marshal(map[string]string{"customer_id": "cust-1", "cart_token": customer})
+		req, _ = http.NewRequest(http.MethodPost, "/api/cart/"+anonymous+"/merge", bytes.NewBuffer(body))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var cart cartResult
+		json.Unmarshal(rec.Body.Bytes(), &cart)
+		assert.Equal(t, customer, cart.Token)
+		assert.Empty(t, cart.Items)
+		assert.Len(t, cart.SavedItems, 1)
+	})
+}
+
+func TestCartHandler_ShareCart(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	type shareResult struct {
+		models.CartShare
+		Totals pricing.Quote `json:"totals"`
+	}
+	type cloneResult struct {
+		models.Cart
+		Adjustments []carts.Adjustment `json:"adjustments"`
+	}
+
+	setup := func(t *testing.T) (*gorm.DB, *inventory.Service, *gin.Engine, models.ProductVariant, models.ProductVariant) {
+		db := setupTestDB(t)
+		err := db.AutoMigrate(&models.Cart{}, &models.CartItem{}, &models.BundleSelection{}, &models.CartShare{})
+		assert.NoError(t, err)
+
+		inv := inventory.NewService(db, inventory.Options{})
+		router := gin.Default()
+		api := router.Group("/api")
+		newCartHandler(db, inv).Register(api)
+
+		product := models.Product{Name: "T-shirt", Price: 20, Variants: []models.ProductVariant{
+			{Color: "Black", Size: "M", Stock: 10},
+			{Color: "White", Size: "M", Stock: 3},
+		}}
+		db.Create(&product)
+		return db, inv, router, product.Variants[0], product.Variants[1]
+	}
+
+	createCart := func(router *gin.Engine) string {
+		req, _ := http.NewRequest(http.MethodPost, "/api/cart", nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		var cart models.Cart
+		json.Unmarshal(rec.Body.Bytes(), &cart)
+		return cart.Token
+	}
+	addItem := func(t *testing.T, router *gin.Engine, token string, variantID uint, quantity int) models.CartItem {
+		body, _ := json.Marshal(map[string]interface{}{"product_variant_id": variantID, "quantity": quantity})
+		req, _ := http.NewRequest(http.MethodPost, "/api/cart/"+token+"/items", bytes.NewBuffer(body))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		var line models.CartItem
+		json.Unmarshal(rec.Body.Bytes(), &line)
+		return line
+	}
+	share := func(router *gin.Engine, token, body string) (int, shareResult) {
+		req, _ := http.NewRequest(http.MethodPost, "/api/cart/"+token+"/share", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		var result shareResult
+		json.Unmarshal(rec.Body.Bytes(), &result)
+		return rec.Code, result
+	}
+	getShared := func(router *gin.Engine, shareToken string) (int, shareResult) {
+		req, _ := http.NewRequest(http.MethodGet, "/api/shared-carts/"+shareToken, nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		var result shareResult
+		json.Unmarshal(rec.Body.Bytes(), &result)
+		return rec.Code, result
+	}
+	clone := func(router *gin.Engine, token, shareToken string) (int, cloneResult) {
+		body, _ := json.Marshal(map[string]string{"share_token": shareToken})
+		req, _ := http.NewRequest(http.MethodPost, "/api/cart/"+token+"/clone", bytes.NewBuffer(body))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		var result cloneResult
+		json.Unmarshal(rec.Body.Bytes(), &result)
+		return rec.Code, result
+	}
+
+	t.Run("should share a snapshot that later changes do not affect", func(t *testing.T) {
+		_, _, router, black, white := setup(t)
+		stylist := createCart(router)
+		addItem(t, router, stylist, black.ID, 2)
+		line := addItem(t, router, stylist, white.ID, 1)
+
+		code, shared := share(router, stylist, "")
+		assert.Equal(t, http.StatusCreated, code)
+		assert.NotEmpty(t, shared.Token)
+		assert.NotEqual(t, stylist, shared.Token)
+		assert.WithinDuration(t, time.Now().Add(carts.DefaultShareTTL), shared.ExpiresAt, time.Minute)
+		assert.Len(t, shared.Items, 2)
+		assert.Equal(t, 60.0, shared.Totals.Subtotal)
+
+		req, _ := http.NewRequest(http.MethodDelete, "/api/cart/"+stylist+"/items/"+strconv.Itoa(int(line.ID)), nil)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+
+		code, viewed := getShared(router, shared.Token)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Len(t, viewed.Items, 2)
+		assert.Equal(t, "Black", viewed.Items[0].ProductVariant.Color)
+		assert.Equal(t, uint(2), viewed.Items[0].Quantity)
+	})
+
+	t.Run("should clone the lines into the recipient's cart", func(t *testing.T) {
+		db, inv, router, black, white := setup(t)
+		stylist := createCart(router)
+		addItem(t, router, stylist, black.ID, 2)
+		addItem(t, router, stylist, white.ID, 1)
+		_, shared := share(router, stylist, "")
+
+		recipient := createCart(router)
+		addItem(t, router, recipient, black.ID, 1)
+		code, cart := clone(router, recipient, shared.Token)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Empty(t, cart.Adjustments)
+		assert.Len(t, cart.Items, 2)
+
+		quantities := map[uint]uint{}
+		for _, item := range cart.Items {
+			quantities[item.ProductVariantID] = item.Quantity
+		}
+		assert.Equal(t, map[uint]uint{black.ID: 3, white.ID: 1}, quantities)
+		available, _ := inv.Available(db, black.ID)
+		assert.Equal(t, 5, available)
+	})
+
+	t.Run("should clamp clones to current stock", func(t *testing.T) {
+		db, _, router, black, white := setup(t)
+		stylist := createCart(router)
+		addItem(t, router, stylist, white.ID, 3)
+		addItem(t, router, stylist, black.ID, 1)
+		_, shared := share(router, stylist, "")
+		db.Model(&black).Update("archived_at", time.Now())
+
+		// The stylist's cart still holds all the white stock
+		code, cart := clone(router, createCart(router), shared.Token)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Empty(t, cart.Items)
+		reasons := map[uint]string{}
+		for _, a := range cart.Adjustments {
+			reasons[a.ProductVariantID] = a.Reason
+			assert.Equal(t, uint(0), a.Quantity)
+		}
+		assert.Equal(t, map[uint]string{
+			white.ID: carts.AdjustmentInsufficientStock,
+			black.ID: carts.AdjustmentUnavailable,
+		}, reasons)
+	})
+
+	t.Run("should stop working once expired", func(t *testing.T) {
+		db, _, router, black, _ := setup(t)
+		stylist := createCart(router)
+		addItem(t, router, stylist, black.ID, 1)
+		_, shared := share(router, stylist, `{"expires_in_hours": 1}`)
+		assert.WithinDuration(t, time.Now().Add(time.Hour), shared.ExpiresAt, time.Minute)
+		db.Model(&models.CartShare{}).Where("token = ?", shared.Token).Update("expires_at", time.Now().Add(-time.Minute))
+
+		code, _ := getShared(router, shared.Token)
+		assert.Equal(t, http.StatusNotFound, code)
+		code, _ = clone(router, createCart(router), shared.Token)
+		assert.Equal(t, http.StatusNotFound, code)
+
+		assert.NoError(t, carts.NewService(db, nil, carts.Options{}).DeleteExpiredShares())
+		var remaining int64
+		db.Model(&models.CartShare{}).Count(&remaining)
+		assert.Equal(t, int64(0), remaining)
+	})
+
+	t.Run("should reject sharing an empty cart or too long a lifetime", func(t *testing.T) {
+		_, _, router, black, _ := setup(t)
+		stylist := createCart(router)
+
+		code, _ := share(router, stylist, "")
+		assert.Equal(t, http.StatusBadRequest, code)
+
+		addItem(t, router, stylist, black.ID, 1)
+		code, _ = share(router, stylist, `{"expires_in_hours": 1000}`)
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+
+	t.Run("should return not found for an unknown share", func(t *testing.T) {
+		_, _, router, _, _ := setup(t)
+
+		code, _ := getShared(router, "unknown")
+		assert.Equal(t, http.StatusNotFound, code)
+	})
+}
+
+func TestCartHandler_RemoveItem(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	t.Run("should remove an item from the cart successfully", func(t *testing.T) {
+		db := setupTestDB(t)
+		err := db.AutoMigrate(&models.Cart{}, &models.CartItem{}, &models.BundleSelection{}, &models.StockReservation{}, &models.Product{}, &models.ProductVariant{})
+		assert.NoError(t, err)
+
+		// Create a product and variant and add it to the cart
+		product := models.Product{Name: "T-shirt", Price: 20}
+		db.Create(&product)
+		variant := models.ProductVariant{ProductID: product.ID, Color: "Black", Size: "M", Stock: 10}
+		db.Create(&variant)
+		cart := models.Cart{}
+		db.Create(&cart)
+		cartItem := models.CartItem{CartID: cart.ID, ProductVariantID: variant.ID, Quantity: 1}
+		db.Create(&cartItem)
+
+		handler := newCartHandler(db, inventory.NewService(db, inventory.Options{}))
+		router := gin.Default()
+		api := router.Group("/api")
+		handler.Register(api)
+
+		req, _ := http.NewRequest(http.MethodDelete, "/api/cart/"+cart.Token+"/items/"+strconv.Itoa(int(cartItem.ID)), nil)
+		rec := httptest.NewRecorder()
+
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+
+		// Verify the item was deleted
+		var deletedItem models.CartItem
+		err = db.First(&deletedItem, cartItem.ID).Error
+		assert.Error(t, err) // Should not find the item
+	})
+}
+
+func TestCartHandler_UpdateItem(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	testCases := []struct {
+		name              string
+		body              map[string]interface{}
+		before            func(db *gorm.DB, variant models.ProductVariant)
+		itemID            func(item models.CartItem) uint
+		expectedCode      int
+		expectedQuantity  uint
+		expectedAvailable int
+	}{
+		{
+			name:              "should increase the quantity and reserve the difference",
+			body:              map[string]interface{}{"quantity": 5},
+			expectedCode:      http.StatusOK,
+			expectedQuantity:  5,
+			expectedAvailable: 5,
+		},
+		{
+			name:              "should decrease the quantity and release the difference",
+			body:              map[string]interface{}{"quantity": 1},
+			expectedCode:      http.StatusOK,
+			expectedQuantity:  1,
+			expectedAvailable: 9,
+		},
+		{
+			name: "should decrease the quantity when stock has dropped below the hold",
+			body: map[string]interface{}{"quantity": 1},
+			before: func(db *gorm.DB, variant models.ProductVariant) {
+				db.Model(&variant).Update("stock", 1)
+			},
+			expectedCode:      http.StatusOK,
+			expectedQuantity:  1,
+			expectedAvailable: 0,
+		},
+		{
+			name:              "should remove the item when the quantity is 0",
+			body:              map[string]interface{}{"quantity": 0},
+			expectedCode:      http.StatusNoContent,
+			expectedAvailable: 10,
+		},
+		{
+			name:              "should not increase beyond available stock",
+			body:              map[string]interface{}{"quantity": 11},
+			expectedCode:      http.StatusBadRequest,
+			expectedQuantity:  2,
+			expectedAvailable: 8,
+		},
+		{
+			name: "should not increase an archived variant",
+			body: map[string]interface{}{"quantity": 3},
+			before: func(db *gorm.DB, variant models.ProductVariant) {
+				db.Model(&variant).Update("archived_at", time.Now())
+			},
+			expectedCode:      http.StatusBadRequest,
+			expectedQuantity:  2,
+			expectedAvailable: 8,
+		},
+		{
+			name:              "should reject a missing quantity",
+			body:              map[string]interface{}{},
+			expectedCode:      http.StatusBadRequest,
+			expectedQuantity:  2,
+			expectedAvailable: 8,
+		},
+		{
+			name:              "should return 404 for an unknown item",
+			body:              map[string]interface{}{"quantity": 3},
+			itemID:            func(item models.CartItem) uint { return item.ID + 1 },
+			expectedCode:      http.StatusNotFound,
+			expectedQuantity:  2,
+			expectedAvailable: 8,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db := setupTestDB(t)
+			err := db.AutoMigrate(&models.Cart{}, &models.CartItem{}, &models.BundleSelection{})
+			assert.NoError(t, err)
+
+			product := models.Product{Name: "T-shirt", Price: 20}
+			db.Create(&product)
+			variant := models.ProductVariant{ProductID: product.ID, Color: "Black", Size: "M", Stock: 10}
+			db.Create(&variant)
+			cart := models.Cart{}
+			db.Create(&cart)
+
+			inv := inventory.NewService(db, inventory.Options{})
+			handler := newCartHandler(db, inv)
+			router := gin.Default()
+			api := router.Group("/api")
+			handler.Register(api)
+
+			body, _ := json.Marshal(map[string]interface{}{"product_variant_id": variant.ID, "quantity": 2})
+			req, _ := http.NewRequest(http.MethodPost, "/api/cart/"+cart.Token+"/items", bytes.NewBuffer(body))
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			assert.Equal(t, http.StatusCreated, rec.Code)
+			var item models.CartItem
+			json.Unmarshal(rec.Body.Bytes(), &item)
+
+			if tc.before != nil {
+				tc.before(db, variant)
+			}
+			itemID := item.ID
+			if tc.itemID != nil {
+				itemID = tc.itemID(item)
+			}
+
+			body, _ = json.Marshal(tc.body)
+			req, _ = http.NewRequest(http.MethodPatch, "/api/cart/"+cart.Token+"/items/"+strconv.Itoa(int(itemID)), bytes.NewBuffer(body))
+			rec = httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.expectedCode, rec.Code)
+
+			if tc.expectedCode == http.StatusOK {
+				var updated models.CartItem
+				json.Unmarshal(rec.Body.Bytes(), &updated)
+				assert.Equal(t, tc.expectedQuantity, updated.Quantity)
+			}
+
+			var stored models.CartItem
+			err = db.First(&stored, item.ID).Error
+			if tc.expectedCode == http.StatusNoContent {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.expectedQuantity, stored.Quantity)
+			}
+
+			available, err := inv.Available(db, variant.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedAvailable, available)
+		})
+	}
+}
+
+func TestCartHandler_DeleteCart(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	t.Run("should delete a cart and its items successfully", func(t *testing.T) {
+		db := setupTestDB(t)
+		err := db.AutoMigrate(&models.Cart{}, &models.CartItem{}, &models.BundleSelection{}, &models.StockReservation{}, &models.Product{}, &models.ProductVariant{})
+		assert.NoError(t, err)
+
+		// Create a cart with an item
+		cart := models.Cart{}
+		db.Create(&cart)
+		cartItem := models.CartItem{CartID: cart.ID, ProductVariantID: 1, Quantity: 1}
+		db.Create(&cartItem)
+
+		handler := newCartHandler(db, inventory.NewService(db, inventory.Options{}))
+		router := gin.Default()
+		api := router.Group("/api")
+		handler.Register(api)
+
+		req, _ := http.NewRequest(http.MethodDelete, "/api/cart/"+cart.Token, nil)
+		rec := httptest.NewRecorder()
+
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+
+		// Verify the cart was deleted
+		var deletedCart models.Cart
+		err = db.First(&deletedCart, cart.ID).Error
+		assert.Error(t, err) // Should not find the cart
+
+		// Verify the cart item was deleted
+		var deletedItem models.CartItem
+		err = db.First(&deletedItem, cartItem.ID).Error
 		assert.Error(t, err) // Should not find the item
 	})
 }
+
+func TestCartHandler_AddBundleItem(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	testCases := []struct {
+		name           string
+		mediumStock    uint
+		selections     func(small, medium models.ProductVariant) []map[string]interface{}
+		expectedCode   int
+		expectedSmall  int
+		expectedMedium int
+	}{
+		{
+			name: "should add a bundle and decrement each component variant",
+			selections: func(small, medium models.ProductVariant) []map[string]interface{} {
+				return []map[string]interface{}{
+					{"product_variant_id": small.ID, "quantity": 2},
+					{"product_variant_id": medium.ID},
+				}
+			},
+			expectedCode:   http.StatusCreated,
+			expectedSmall:  6,
+			expectedMedium: 8,
+		},
+		{
+			name: "should reject selections that do not fill the bundle",
+			selections: func(small, medium models.ProductVariant) []map[string]interface{} {
+				return []map[string]interface{}{
+					{"product_variant_id": small.ID},
+				}
+			},
+			expectedCode:   http.StatusBadRequest,
+			expectedSmall:  10,
+			expectedMedium: 10,
+		},
+		{
+			name:        "should reject a bundle when a component is out of stock",
+			mediumStock: 5,
+			selections: func(small, medium models.ProductVariant) []map[string]interface{} {
+				return []map[string]interface{}{
+					{"product_variant_id": medium.ID, "quantity": 3},
+				}
+			},
+			expectedCode:   http.StatusBadRequest,
+			expectedSmall:  10,
+			expectedMedium: 5,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db := setupTestDB(t)
+			err := db.AutoMigrate(&models.Cart{}, &models.CartItem{}, &models.BundleSelection{}, &models.StockReservation{})
+			assert.NoError(t, err)
+
+			tee := models.Product{Name: "Basic Tee", Price: 15}
+			db.Create(&tee)
+			if tc.mediumStock == 0 {
+				tc.mediumStock = 10
+			}
+			small := models.ProductVariant{ProductID: tee.ID, Color: "Black", Size: "S", Stock: 10}
+			medium := models.ProductVariant{ProductID: tee.ID, Color: "White", Size: "M", Stock: tc.mediumStock}
+			db.Create(&small)
+			db.Create(&medium)
+			bundle := models.Product{Name: "3-pack", Price: 40, Type: models.ProductTypeBundle, BundleComponents: []models.BundleComponent{
+				{ComponentProductID: tee.ID, Quantity: 3},
+			}}
+			db.Create(&bundle)
+			cart := models.Cart{}
+			db.Create(&cart)
+
+			inv := inventory.NewService(db, inventory.Options{})
+			handler := newCartHandler(db, inv)
+			router := gin.Default()
+			api := router.Group("/api")
+			handler.Register(api)
+
+			body, _ := json.Marshal(map[string]interface{}{
+				"bundle_product_id": bundle.ID,
+				"quantity":          2,
+				"bundle_selections": tc.selections(small, medium),
+			})
+			req, _ := http.NewRequest(http.MethodPost, "/api/cart/"+cart.Token+"/items", bytes.NewBuffer(body))
+			rec := httptest.NewRecorder()
+
+			router.ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.expectedCode, rec.Code)
+
+			availableSmall, err := inv.Available(db, small.ID)
+			assert.NoError(t, err)
+			availableMedium, err := inv.Available(db, medium.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedSmall, availableSmall)
+			assert.Equal(t, tc.expectedMedium, availableMedium)
+		})
+	}
+}
+
+func TestCartHandler_Reservations(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	setup := func(t *testing.T) (*gorm.DB, *inventory.Service, *gin.Engine, models.ProductVariant, models.Cart) {
+		db := setupTestDB(t)
+		err := db.AutoMigrate(&models.Cart{}, &models.CartItem{}, &models.BundleSelection{}, &models.StockReservation{})
+		assert.NoError(t, err)
+
+		product := models.Product{Name: "T-shirt", Price: 20}
+		db.Create(&product)
+		variant := models.ProductVariant{ProductID: product.ID, Color: "Black", Size: "M", Stock: 10}
+		db.Create(&variant)
+		cart := models.Cart{}
+		db.Create(&cart)
+
+		inv := inventory.NewService(db, inventory.Options{})
+		handler := newCartHandler(db, inv)
+		router := gin.Default()
+		api := router.Group("/api")
+		handler.Register(api)
+		return db, inv, router, variant, cart
+	}
+
+	addItem := func(t *testing.T, router *gin.Engine, cart models.Cart, variant models.ProductVariant, quantity int) models.CartItem {
+		body, _ := json.Marshal(map[string]interface{}{"product_variant_id": variant.ID, "quantity": quantity})
+		req, _ := http.NewRequest(http.MethodPost, "/api/cart/"+cart.Token+"/items", bytes.NewBuffer(body))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+
+		var item models.CartItem
+		json.Unmarshal(rec.Body.Bytes(), &item)
+		return item
+	}
+
+	t.Run("should release reserved stock when an item is removed", func(t *testing.T) {
+		db, inv, router, variant, cart := setup(t)
+		item := addItem(t, router, cart, variant, 3)
+
+		available, _ := inv.Available(db, variant.ID)
+		assert.Equal(t, 7, available)
+
+		req, _ := http.NewRequest(http.MethodDelete, "/api/cart/"+cart.Token+"/items/"+strconv.Itoa(int(item.ID)), nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+
+		available, _ = inv.Available(db, variant.ID)
+		assert.Equal(t, 10, available)
+	})
+
+	t.Run("should release reserved stock when the cart is deleted", func(t *testing.T) {
+		db, inv, router, variant, cart := setup(t)
+		addItem(t, router, cart, variant, 4)
+
+		req, _ := http.NewRequest(http.MethodDelete, "/api/cart/"+cart.Token, nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+
+		available, _ := inv.Available(db, variant.ID)
+		assert.Equal(t, 10, available)
+	})
+
+	t.Run("should stop counting expired reservations and sweep them", func(t *testing.T) {
+		db, inv, router, variant, cart := setup(t)
+		addItem(t, router, cart, variant, 10)
+
+		db.Model(&models.StockReservation{}).Where("product_variant_id = ?", variant.ID).Update("expires_at", time.Now().Add(-time.Minute))
+
+		available, _ := inv.Available(db, variant.ID)
+		assert.Equal(t, 10, available)
+
+		released, err := inv.ReleaseExpired()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, released)
+	})
+
+	t.Run("should release an unswept expired hold before holding again", func(t *testing.T) {
+		db, inv, router, variant, cart := setup(t)
+		item := addItem(t, router, cart, variant, 4)
+
+		db.Model(&models.StockReservation{}).Where("product_variant_id = ?", variant.ID).Update("expires_at", time.Now().Add(-time.Minute))
+		addItem(t, router, cart, variant, 2)
+
+		var movements []models.InventoryMovement
+		db.Where("reference = ?", "cart_item:"+strconv.Itoa(int(item.ID))).Order("id").Find(&movements)
+		if assert.Len(t, movements, 3) {
+			assert.Equal(t, models.MovementRelease, movements[1].Type)
+			assert.Equal(t, 4, movements[1].Quantity)
+			assert.Equal(t, "expired", movements[1].Reason)
+			assert.Equal(t, -6, movements[2].Quantity)
+		}
+
+		// The ledger agrees with what is actually held
+		var net int
+		db.Model(&models.InventoryMovement{}).Select("COALESCE(SUM(quantity), 0)").
+			Where("reference = ?", "cart_item:"+strconv.Itoa(int(item.ID))).Scan(&net)
+		assert.Equal(t, -6, net)
+		available, _ := inv.Available(db, variant.ID)
+		assert.Equal(t, 4, available)
+	})
+}
+
+func TestCartHandler_AddItem_InventoryPolicy(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	shipDate := time.Date(2030, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name                string
+		variant             models.ProductVariant
+		quantity            int
+		expectedCode        int
+		expectedBackordered uint
+	}{
+		{
+			name:         "should deny items beyond stock by default",
+			variant:      models.ProductVariant{Color: "Black", Size: "M", Stock: 2},
+			quantity:     3,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:                "should backorder items beyond stock within the limit",
+			variant:             models.ProductVariant{Color: "Black", Size: "M", Stock: 2, InventoryPolicy: models.InventoryPolicyBackorder, BackorderLimit: 3, ExpectedShipDate: &shipDate},
+			quantity:            4,
+			expectedCode:        http.StatusCreated,
+			expectedBackordered: 2,
+		},
+		{
+			name:         "should reject backorders over the limit",
+			variant:      models.ProductVariant{Color: "Black", Size: "M", Stock: 2, InventoryPolicy: models.InventoryPolicyBackorder, BackorderLimit: 3, ExpectedShipDate: &shipDate},
+			quantity:     6,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:                "should preorder unreleased items",
+			variant:             models.ProductVariant{Color: "Black", Size: "M", InventoryPolicy: models.InventoryPolicyPreorder, ExpectedShipDate: &shipDate},
+			quantity:            5,
+			expectedCode:        http.StatusCreated,
+			expectedBackordered: 5,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db := setupTestDB(t)
+			err := db.AutoMigrate(&models.Cart{}, &models.CartItem{}, &models.BundleSelection{})
+			assert.NoError(t, err)
+
+			product := models.Product{Name: "T-shirt", Price: 20, Variants: []models.ProductVariant{tc.variant}}
+			db.Create(&product)
+			cart := models.Cart{}
+			db.Create(&cart)
+
+			inv := inventory.NewService(db, inventory.Options{})
+			router := gin.Default()
+			api := router.Group("/api")
+			newCartHandler(db, inv).Register(api)
+
+			body, _ := json.Marshal(map[string]interface{}{"product_variant_id": product.Variants[0].ID, "quantity": tc.quantity})
+			req, _ := http.NewRequest(http.MethodPost, "/api/cart/"+cart.Token+"/items", bytes.NewBuffer(body))
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			assert.Equal(t, tc.expectedCode, rec.Code)
+
+			if tc.expectedCode == http.StatusCreated {
+				var item models.CartItem
+				json.Unmarshal(rec.Body.Bytes(), &item)
+				assert.Equal(t, tc.variant.InventoryPolicy, item.InventoryPolicy)
+				assert.Equal(t, tc.expectedBackordered, item.BackorderedQuantity)
+				assert.True(t, shipDate.Equal(*item.ExpectedShipDate))
+
+				// The backlog is visible as negative availability
+				available, _ := inv.Available(db, product.Variants[0].ID)
+				assert.Equal(t, -int(tc.expectedBackordered), available)
+			}
+		})
+	}
+}
+
+func TestCartHandler_AddItem_Concurrent(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// An in-memory database is private to each connection, so use a file
+	// shared by every connection in the pool.
+	setup := func(t *testing.T, stock uint) (*gorm.DB, *inventory.Service, *gin.Engine, models.ProductVariant) {
+		conn, err := db.NewSQLite(filepath.Join(t.TempDir(), "stress.db"))
+		assert.NoError(t, err)
+		err = conn.AutoMigrate(&models.Product{}, &models.ProductVariant{}, &models.PersonalizationField{}, &models.BundleComponent{},
+			&models.Cart{}, &models.CartItem{}, &models.BundleSelection{}, &models.StockReservation{}, &models.Backorder{}, &models.InventoryMovement{},
+			&models.Location{}, &models.StockLevel{}, &models.LowStockAlert{}, &models.OutboxMessage{}, &models.StockSubscription{})
+		assert.NoError(t, err)
+
+		product := models.Product{Name: "T-shirt", Price: 20, Variants: []models.ProductVariant{{Color: "Black", Size: "M", Stock: stock}}}
+		conn.Create(&product)
+
+		inv := inventory.NewService(conn, inventory.Options{})
+		router := gin.New()
+		api := router.Group("/api")
+		newCartHandler(conn, inv).Register(api)
+		NewInventoryHandler(conn, inv).Register(api)
+		return conn, inv, router, product.Variants[0]
+	}
+
+	// hammer sends requests from concurrent goroutines and counts the
+	// response codes.
+	hammer := func(router *gin.Engine, requests int, newRequest func(i int) *http.Request) map[int]int {
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		codes := map[int]int{}
+		for i := 0; i < requests; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				rec := httptest.NewRecorder()
+				router.ServeHTTP(rec, newRequest(i))
+				mu.Lock()
+				codes[rec.Code]++
+				mu.Unlock()
+			}(i)
+		}
+		wg.Wait()
+		return codes
+	}
+
+	t.Run("should never reserve more than the stock across carts", func(t *testing.T) {
+		conn, inv, router, variant := setup(t, 20)
+		carts := make([]models.Cart, 50)
+		for i := range carts {
+			conn.Create(&carts[i])
+		}
+
+		codes := hammer(router, len(carts), func(i int) *http.Request {
+			body, _ := json.Marshal(map[string]interface{}{"product_variant_id": variant.ID, "quantity": 1})
+			req, _ := http.NewRequest(http.MethodPost, "/api/cart/"+carts[i].Token+"/items", bytes.NewBuffer(body))
+			return req
+		})
+		assert.Equal(t, map[int]int{http.StatusCreated: 20, http.StatusBadRequest: 30}, codes)
+
+		available, err := inv.Available(conn, variant.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, available)
+	})
+
+	t.Run("should merge concurrent additions into one line", func(t *testing.T) {
+		conn, _, router, variant := setup(t, 20)
+		cart := models.Cart{}
+		conn.Create(&cart)
+
+		codes := hammer(router, 30, func(i int) *http.Request {
+			body, _ := json.Marshal(map[string]interface{}{"product_variant_id": variant.ID, "quantity": 1})
+			req, _ := http.NewRequest(http.MethodPost, "/api/cart/"+cart.Token+"/items", bytes.NewBuffer(body))
+			return req
+		})
+		assert.Equal(t, map[int]int{http.StatusCreated: 20, http.StatusBadRequest: 10}, codes)
+
+		var items []models.CartItem
+		conn.Where("cart_id = ?", cart.ID).Find(&items)
+		assert.Len(t, items, 1)
+		assert.Equal(t, uint(20), items[0].Quantity)
+	})
+
+	t.Run("should never take stock below zero", func(t *testing.T) {
+		conn, _, router, variant := setup(t, 20)
+
+		codes := hammer(router, 30, func(i int) *http.Request {
+			body, _ := json.Marshal(gin.H{"product_variant_id": variant.ID, "delta": -1, "reason_code": "shrinkage"})
+			req, _ := http.NewRequest(http.MethodPost, "/api/inventory/adjustments", bytes.NewBuffer(body))
+			return req
+		})
+		assert.Equal(t, map[int]int{http.StatusOK: 20, http.StatusBadRequest: 10}, codes)
+
+		var stored models.ProductVariant
+		conn.First(&stored, variant.ID)
+		assert.Equal(t, uint(0), stored.Stock)
+	})
+}
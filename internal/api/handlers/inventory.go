@@ -0,0 +1,367 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/abdelmounim-dev/go-tshirt/internal/db"
+	apperrors "github.com/abdelmounim-dev/go-tshirt/internal/errors"
+	"github.com/abdelmounim-dev/go-tshirt/internal/models"
+	"github.com/abdelmounim-dev/go-tshirt/internal/service/inventory"
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"gorm.io/gorm"
+)
+
+// actorHeader identifies who made an inventory change. There is no
+// authentication yet, so it is taken at face value.
+const actorHeader = "X-Actor"
+
+type InventoryHandler struct {
+	db        *gorm.DB
+	inventory *inventory.Service
+	validate  *validator.Validate
+}
+
+func NewInventoryHandler(db *gorm.DB, inv *inventory.Service) *InventoryHandler {
+	return &InventoryHandler{
+		db:        db,
+		inventory: inv,
+		validate:  validator.New(),
+	}
+}
+
+func (h *InventoryHandler) Register(r *gin.RouterGroup) {
+	variantRoutes := r.Group("/variants")
+	{
+		variantRoutes.GET("/:id/stock-history", h.GetStockHistory)
+		variantRoutes.POST("/:id/stock-subscriptions", h.Subscribe)
+	}
+
+	inventoryRoutes := r.Group("/inventory")
+	{
+		inventoryRoutes.GET("/low-stock", h.GetLowStock)
+		inventoryRoutes.POST("/adjustments", h.CreateAdjustment)
+		inventoryRoutes.POST("/stock-counts", h.ImportStockCount)
+		inventoryRoutes.POST("/transfers", h.CreateTransfer)
+	}
+}
+
+type stockHistoryResponse struct {
+	ProductVariantID uint                       `json:"product_variant_id"`
+	Reconciliation   inventory.Reconciliation   `json:"reconciliation"`
+	Movements        []models.InventoryMovement `json:"movements"`
+}
+
+func (h *InventoryHandler) GetStockHistory(c *gin.Context) {
+	variantID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid variant ID"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive integer"})
+		return
+	}
+
+	reconciliation, err := h.inventory.Reconcile(h.db, uint(variantID))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product variant not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	movements := []models.InventoryMovement{}
+	if err := h.db.Where("product_variant_id = ?", variantID).Order("id DESC").Limit(limit).Find(&movements).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, stockHistoryResponse{
+		ProductVariantID: uint(variantID),
+		Reconciliation:   reconciliation,
+		Movements:        movements,
+	})
+}
+
+// Subscribe asks to be notified once when a variant with no stock available
+// is back in stock.
+func (h *InventoryHandler) Subscribe(c *gin.Context) {
+	variantID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid variant ID"})
+		return
+	}
+
+	var sub models.StockSubscription
+	if err := c.ShouldBindJSON(&sub); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	sub.ProductVariantID = uint(variantID)
+
+	if err := h.validate.Struct(sub); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sub, created, err := h.inventory.Subscribe(h.db, sub)
+	if err != nil {
+		var validationErr *apperrors.ValidationError
+		switch {
+		case errors.As(err, &validationErr):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product variant not found"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	if !created {
+		c.JSON(http.StatusOK, sub)
+		return
+	}
+	c.JSON(http.StatusCreated, sub)
+}
+
+// GetLowStock lists the variants whose available stock is below their
+// low-stock threshold.
+func (h *InventoryHandler) GetLowStock(c *gin.Context) {
+	entries, err := h.inventory.LowStock(h.db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, entries)
+}
+
+type transferRequest struct {
+	ProductVariantID uint   `json:"product_variant_id" validate:"required"`
+	FromLocationID   uint   `json:"from_location_id" validate:"required"`
+	ToLocationID     uint   `json:"to_location_id" validate:"required"`
+	Quantity         uint   `json:"quantity" validate:"required,gt=0"`
+	Reason           string `json:"reason"`
+}
+
+// CreateTransfer moves stock of a variant from one location to another.
+func (h *InventoryHandler) CreateTransfer(c *gin.Context) {
+	var req transferRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.validate.Struct(req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.db.First(&models.ProductVariant{}, req.ProductVariantID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product variant not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var levels []models.StockLevel
+	err := db.Transaction(h.db, func(tx *gorm.DB) error {
+		levels = nil
+		if err := h.inventory.Transfer(tx, req.ProductVariantID, req.FromLocationID, req.ToLocationID, req.Quantity, req.Reason, actor(c)); err != nil {
+			return err
+		}
+		return tx.Preload("Location").
+			Where("product_variant_id = ? AND location_id IN ?", req.ProductVariantID, []uint{req.FromLocationID, req.ToLocationID}).
+			Order("id").
+			Find(&levels).Error
+	})
+	if err != nil {
+		var validationErr *apperrors.ValidationError
+		var notFoundErr *apperrors.NotFoundError
+		switch {
+		case errors.As(err, &validationErr), errors.Is(err, inventory.ErrInsufficientStock):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.As(err, &notFoundErr):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, levels)
+}
+
+type adjustmentRequest struct {
+	ProductVariantID uint   `json:"product_variant_id" validate:"required"`
+	LocationID       *uint  `json:"location_id"`
+	Delta            *int   `json:"delta"`
+	Quantity         *uint  `json:"quantity"`
+	ReasonCode       string `json:"reason_code" validate:"required,oneof=count damage return shrinkage correction"`
+	Note             string `json:"note"`
+}
+
+type adjustmentResponse struct {
+	Movement *models.InventoryMovement `json:"movement"`
+	Stock    uint                      `json:"stock"`
+}
+
+// CreateAdjustment corrects a variant's stock by a relative delta or to an
+// absolute quantity.
+func (h *InventoryHandler) CreateAdjustment(c *gin.Context) {
+	var req adjustmentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.validate.Struct(req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.LocationID != nil && !h.locationExists(c, *req.LocationID) {
+		return
+	}
+
+	var resp adjustmentResponse
+	err := db.Transaction(h.db, func(tx *gorm.DB) error {
+		resp = adjustmentResponse{}
+		var err error
+		resp.Movement, err = h.inventory.Adjust(tx, inventory.Adjustment{
+			ProductVariantID: req.ProductVariantID,
+			LocationID:       req.LocationID,
+			Delta:            req.Delta,
+			Quantity:         req.Quantity,
+			ReasonCode:       req.ReasonCode,
+			Note:             req.Note,
+			Actor:            actor(c),
+		})
+		if err != nil {
+			return err
+		}
+		var variant models.ProductVariant
+		if err := tx.First(&variant, req.ProductVariantID).Error; err != nil {
+			return err
+		}
+		resp.Stock = variant.Stock
+		return nil
+	})
+	if err != nil {
+		var validationErr *apperrors.ValidationError
+		switch {
+		case errors.As(err, &validationErr):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product variant not found"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	h.inventory.CheckLowStock(c.Request.Context(), req.ProductVariantID)
+	c.JSON(http.StatusOK, resp)
+}
+
+// errDryRun rolls back a stock count that was only being previewed.
+var errDryRun = errors.New("dry run")
+
+// ImportStockCount applies an uploaded stock count CSV in a single
+// transaction and reports the discrepancies it found. With dry_run=true the
+// report is returned without changing stock.
+func (h *InventoryHandler) ImportStockCount(c *gin.Context) {
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file is required"})
+		return
+	}
+	dryRun := c.Query("dry_run") == "true"
+
+	var locationID *uint
+	if param := c.Query("location_id"); param != "" {
+		id, err := strconv.Atoi(param)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid location ID"})
+			return
+		}
+		if !h.locationExists(c, uint(id)) {
+			return
+		}
+		lid := uint(id)
+		locationID = &lid
+	}
+
+	f, err := file.Open()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer f.Close()
+
+	lines, err := inventory.ParseStockCount(f)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var report inventory.StockCountReport
+	err = db.Transaction(h.db, func(tx *gorm.DB) error {
+		var err error
+		if report, err = h.inventory.ApplyStockCount(tx, lines, locationID, actor(c)); err != nil {
+			return err
+		}
+		if dryRun {
+			report.Applied = false
+			return errDryRun
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errDryRun) {
+		var validationErr *apperrors.ValidationError
+		if errors.As(err, &validationErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if report.Applied {
+		var changed []uint
+		for _, line := range report.Lines {
+			if line.Difference != 0 {
+				changed = append(changed, line.ProductVariantID)
+			}
+		}
+		h.inventory.CheckLowStock(c.Request.Context(), changed...)
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// locationExists writes a 404 response and returns false when the location
+// does not exist.
+func (h *InventoryHandler) locationExists(c *gin.Context, id uint) bool {
+	if err := h.db.First(&models.Location{}, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Location not found"})
+			return false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// actor returns who is making the request, for the inventory ledger.
+func actor(c *gin.Context) string {
+	if a := c.GetHeader(actorHeader); a != "" {
+		return a
+	}
+	return inventory.SystemActor
+}
@@ -0,0 +1,484 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/abdelmounim-dev/go-tshirt/internal/models"
+	"github.com/abdelmounim-dev/go-tshirt/internal/service/inventory"
+	"github.com/abdelmounim-dev/go-tshirt/internal/service/notify"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInventoryHandler_GetStockHistory(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	t.Run("should list ledger movements and reconcile stock", func(t *testing.T) {
+		db := setupTestDB(t)
+		inv := inventory.NewService(db, inventory.Options{})
+		router := gin.Default()
+		api := router.Group("/api")
+		NewProductHandler(db, inv).Register(api)
+		NewInventoryHandler(db, inv).Register(api)
+
+		body, _ := json.Marshal(models.Product{Name: "T-shirt", Price: 20, Variants: []models.ProductVariant{{Color: "Black", Size: "M", Stock: 20}}})
+		req, _ := http.NewRequest(http.MethodPost, "/api/products", bytes.NewBuffer(body))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+
+		var product models.Product
+		json.Unmarshal(rec.Body.Bytes(), &product)
+		variantURL := "/api/products/" + strconv.Itoa(int(product.ID)) + "/variants/" + strconv.Itoa(int(product.Variants[0].ID))
+
+		body, _ = json.Marshal(gin.H{"color": "Black", "size": "M", "stock": 15})
+		req, _ = http.NewRequest(http.MethodPut, variantURL, bytes.NewBuffer(body))
+		req.Header.Set("X-Actor", "alice")
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		req, _ = http.NewRequest(http.MethodGet, "/api/variants/"+strconv.Itoa(int(product.Variants[0].ID))+"/stock-history", nil)
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		var history stockHistoryResponse
+		err := json.Unmarshal(rec.Body.Bytes(), &history)
+		assert.NoError(t, err)
+		assert.Len(t, history.Movements, 2)
+		assert.Equal(t, models.MovementAdjustment, history.Movements[0].Type)
+		assert.Equal(t, -5, history.Movements[0].Quantity)
+		assert.Equal(t, "alice", history.Movements[0].Actor)
+		assert.Equal(t, models.MovementReceipt, history.Movements[1].Type)
+		assert.Equal(t, 20, history.Movements[1].Quantity)
+		assert.Equal(t, uint(15), history.Reconciliation.Stock)
+		assert.Equal(t, 0, history.Reconciliation.Difference)
+	})
+
+	t.Run("should return 404 for an unknown variant", func(t *testing.T) {
+		db := setupTestDB(t)
+		inv := inventory.NewService(db, inventory.Options{})
+		router := gin.Default()
+		api := router.Group("/api")
+		NewInventoryHandler(db, inv).Register(api)
+
+		req, _ := http.NewRequest(http.MethodGet, "/api/variants/999/stock-history", nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		assert.JSONEq(t, `{"error":"Product variant not found"}`, rec.Body.String())
+	})
+}
+
+func TestInventoryHandler_LowStock(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	t.Run("should alert once per threshold crossing and report low stock", func(t *testing.T) {
+		db := setupTestDB(t)
+		err := db.AutoMigrate(&models.Cart{}, &models.CartItem{}, &models.BundleSelection{}, &models.LowStockAlert{}, &models.OutboxMessage{})
+		assert.NoError(t, err)
+
+		inv := inventory.NewService(db, inventory.Options{Notifier: notify.NewOutboxNotifier(db, notify.ChannelEmail, "ops@example.com")})
+		router := gin.Default()
+		api := router.Group("/api")
+		NewInventoryHandler(db, inv).Register(api)
+		newCartHandler(db, inv).Register(api)
+
+		// The product default applies to Black; White has its own, lower threshold
+		threshold, whiteThreshold := uint(5), uint(1)
+		product := models.Product{Name: "T-shirt", Price: 20, LowStockThreshold: &threshold, Variants: []models.ProductVariant{
+			{Color: "Black", Size: "M", Stock: 8},
+			{Color: "White", Size: "M", Stock: 8, LowStockThreshold: &whiteThreshold},
+		}}
+		db.Create(&product)
+		black, white := product.Variants[0], product.Variants[1]
+
+		cart := models.Cart{}
+		db.Create(&cart)
+		addItem := func(variantID uint, quantity uint) models.CartItem {
+			body, _ := json.Marshal(models.CartItem{ProductVariantID: variantID, Quantity: quantity})
+			req, _ := http.NewRequest(http.MethodPost, "/api/cart/"+cart.Token+"/items", bytes.NewBuffer(body))
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			assert.Equal(t, http.StatusCreated, rec.Code)
+
+			var item models.CartItem
+			json.Unmarshal(rec.Body.Bytes(), &item)
+			return item
+		}
+		outbox := func() int64 {
+			var count int64
+			db.Model(&models.OutboxMessage{}).Count(&count)
+			return count
+		}
+
+		addItem(white.ID, 4)
+		item := addItem(black.ID, 4)
+		assert.Equal(t, int64(1), outbox())
+
+		// Still below the threshold, so no second alert
+		addItem(black.ID, 1)
+		assert.Equal(t, int64(1), outbox())
+
+		var message models.OutboxMessage
+		db.First(&message)
+		assert.Equal(t, "ops@example.com", message.Recipient)
+		assert.Equal(t, inventory.EventLowStock, message.Event)
+		assert.Equal(t, "Low stock: T-shirt (Black, M)", message.Subject)
+
+		req, _ := http.NewRequest(http.MethodGet, "/api/inventory/low-stock", nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		var report []inventory.LowStockEntry
+		json.Unmarshal(rec.Body.Bytes(), &report)
+		assert.Len(t, report, 1)
+		assert.Equal(t, black.ID, report[0].ProductVariantID)
+		assert.Equal(t, 3, report[0].Available)
+		assert.Equal(t, uint(5), report[0].Threshold)
+		assert.NotNil(t, report[0].AlertedAt)
+
+		// Recovering re-arms the alert for the next crossing
+		req, _ = http.NewRequest(http.MethodDelete, "/api/cart/"+cart.Token+"/items/"+strconv.Itoa(int(item.ID)), nil)
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+
+		addItem(black.ID, 6)
+		assert.Equal(t, int64(2), outbox())
+	})
+
+	t.Run("should queue webhook alerts for the dispatcher", func(t *testing.T) {
+		db := setupTestDB(t)
+		err := db.AutoMigrate(&models.Cart{}, &models.CartItem{}, &models.BundleSelection{}, &models.LowStockAlert{})
+		assert.NoError(t, err)
+
+		var received []notify.Message
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var m notify.Message
+			json.NewDecoder(r.Body).Decode(&m)
+			received = append(received, m)
+		}))
+		defer server.Close()
+
+		notifier, err := notify.New(db, notify.Options{Kind: notify.KindWebhook, WebhookURL: server.URL})
+		assert.NoError(t, err)
+		inv := inventory.NewService(db, inventory.Options{Notifier: notifier})
+		router := gin.Default()
+		newCartHandler(db, inv).Register(router.Group("/api"))
+
+		threshold := uint(5)
+		product := models.Product{Name: "T-shirt", Price: 20, LowStockThreshold: &threshold, Variants: []models.ProductVariant{{Color: "Black", Size: "M", Stock: 8}}}
+		db.Create(&product)
+		cart := models.Cart{}
+		db.Create(&cart)
+
+		body, _ := json.Marshal(models.CartItem{ProductVariantID: product.Variants[0].ID, Quantity: 4})
+		req, _ := http.NewRequest(http.MethodPost, "/api/cart/"+cart.Token+"/items", bytes.NewBuffer(body))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+
+		// The request only queues the alert
+		assert.Empty(t, received)
+		var message models.OutboxMessage
+		assert.NoError(t, db.First(&message).Error)
+		assert.Equal(t, notify.ChannelWebhook, message.Channel)
+		assert.Equal(t, server.URL, message.Recipient)
+
+		// The test server listens on a loopback address, which only a trusted
+		// recipient may use
+		delivered, err := notify.NewDispatcher(db, nil).DeliverPending(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 0, delivered)
+		assert.Empty(t, received)
+		assert.NoError(t, db.First(&message).Error)
+		assert.Contains(t, message.LastError, notify.ErrPrivateAddress.Error())
+
+		delivered, err = notify.NewDispatcher(db, nil, server.URL).DeliverPending(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 1, delivered)
+		if assert.Len(t, received, 1) {
+			assert.Equal(t, inventory.EventLowStock, received[0].Event)
+			data, _ := received[0].Data.(map[string]interface{})
+			assert.Equal(t, float64(product.Variants[0].ID), data["product_variant_id"])
+			assert.Equal(t, float64(4), data["available"])
+		}
+	})
+}
+
+func TestInventoryHandler_CreateAdjustment(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	testCases := []struct {
+		name          string
+		body          gin.H
+		expectedCode  int
+		expectedStock uint
+		expectedType  string
+	}{
+		{
+			name:          "should apply a relative adjustment",
+			body:          gin.H{"delta": -3, "reason_code": "damage", "note": "torn seam"},
+			expectedCode:  http.StatusOK,
+			expectedStock: 7,
+			expectedType:  models.MovementDamage,
+		},
+		{
+			name:          "should set an absolute quantity",
+			body:          gin.H{"quantity": 12, "reason_code": "count"},
+			expectedCode:  http.StatusOK,
+			expectedStock: 12,
+			expectedType:  models.MovementAdjustment,
+		},
+		{
+			name:         "should reject both delta and quantity",
+			body:         gin.H{"delta": 1, "quantity": 12, "reason_code": "count"},
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "should reject an unknown reason code",
+			body:         gin.H{"delta": 1, "reason_code": "lost"},
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "should reject taking stock below zero",
+			body:         gin.H{"delta": -11, "reason_code": "shrinkage"},
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db := setupTestDB(t)
+			inv := inventory.NewService(db, inventory.Options{})
+			router := gin.Default()
+			api := router.Group("/api")
+			NewInventoryHandler(db, inv).Register(api)
+
+			product := models.Product{Name: "T-shirt", Price: 20, Variants: []models.ProductVariant{{Color: "Black", Size: "M", Stock: 10}}}
+			db.Create(&product)
+			variantID := product.Variants[0].ID
+
+			tc.body["product_variant_id"] = variantID
+			body, _ := json.Marshal(tc.body)
+			req, _ := http.NewRequest(http.MethodPost, "/api/inventory/adjustments", bytes.NewBuffer(body))
+			req.Header.Set("X-Actor", "bob")
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			assert.Equal(t, tc.expectedCode, rec.Code)
+
+			var variant models.ProductVariant
+			db.First(&variant, variantID)
+			if tc.expectedCode != http.StatusOK {
+				assert.Equal(t, uint(10), variant.Stock)
+				return
+			}
+
+			var resp adjustmentResponse
+			json.Unmarshal(rec.Body.Bytes(), &resp)
+			assert.Equal(t, tc.expectedStock, resp.Stock)
+			assert.Equal(t, tc.expectedStock, variant.Stock)
+			assert.Equal(t, tc.expectedType, resp.Movement.Type)
+			assert.Equal(t, "bob", resp.Movement.Actor)
+		})
+	}
+}
+
+func TestInventoryHandler_ImportStockCount(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	testCases := []struct {
+		name           string
+		csv            string
+		query          string
+		expectedCode   int
+		expectedStocks []uint
+		expectedBody   string
+	}{
+		{
+			name:           "should apply counted quantities by variant ID and SKU",
+			csv:            "variant_id,sku,quantity\n1,,7\n,TEE-WHT-M,5\n",
+			expectedCode:   http.StatusOK,
+			expectedStocks: []uint{7, 5},
+		},
+		{
+			name:           "should report without applying on a dry run",
+			csv:            "variant_id,quantity\n1,7\n",
+			query:          "?dry_run=true",
+			expectedCode:   http.StatusOK,
+			expectedStocks: []uint{10, 5},
+		},
+		{
+			name:           "should apply nothing when a line is invalid",
+			csv:            "sku,quantity\nTEE-BLK-M,7\nTEE-RED-M,3\n",
+			expectedCode:   http.StatusBadRequest,
+			expectedStocks: []uint{10, 5},
+			expectedBody:   `{"error":"Line 3: SKU \"TEE-RED-M\" not found"}`,
+		},
+		{
+			name:           "should reject a file without a quantity column",
+			csv:            "variant_id,count\n1,7\n",
+			expectedCode:   http.StatusBadRequest,
+			expectedStocks: []uint{10, 5},
+			expectedBody:   `{"error":"Stock count requires a quantity column"}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db := setupTestDB(t)
+			inv := inventory.NewService(db, inventory.Options{})
+			router := gin.Default()
+			api := router.Group("/api")
+			NewInventoryHandler(db, inv).Register(api)
+
+			product := models.Product{Name: "T-shirt", Price: 20, Variants: []models.ProductVariant{
+				{Color: "Black", Size: "M", SKU: "TEE-BLK-M", Stock: 10},
+				{Color: "White", Size: "M", SKU: "TEE-WHT-M", Stock: 5},
+			}}
+			db.Create(&product)
+
+			req := multipartRequest(t, "/api/inventory/stock-counts"+tc.query, nil, "file", []byte(tc.csv))
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			assert.Equal(t, tc.expectedCode, rec.Code)
+			if tc.expectedBody != "" {
+				assert.JSONEq(t, tc.expectedBody, rec.Body.String())
+			}
+
+			for i, expected := range tc.expectedStocks {
+				var variant models.ProductVariant
+				db.First(&variant, product.Variants[i].ID)
+				assert.Equal(t, expected, variant.Stock)
+			}
+
+			if tc.expectedCode == http.StatusOK {
+				var report inventory.StockCountReport
+				json.Unmarshal(rec.Body.Bytes(), &report)
+				assert.Equal(t, tc.query == "", report.Applied)
+				assert.Equal(t, uint(10), report.Lines[0].Expected)
+				assert.Equal(t, -3, report.Lines[0].Difference)
+			}
+		})
+	}
+}
+
+func TestInventoryHandler_StockSubscriptions(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	db := setupTestDB(t)
+	inv := inventory.NewService(db, inventory.Options{})
+	router := gin.Default()
+	api := router.Group("/api")
+	NewProductHandler(db, inv).Register(api)
+	NewInventoryHandler(db, inv).Register(api)
+
+	product := models.Product{Name: "T-shirt", Price: 20, Variants: []models.ProductVariant{
+		{Color: "Black", Size: "M"},
+		{Color: "White", Size: "M", Stock: 4},
+		{Color: "Red", Size: "M", Stock: 2},
+	}}
+	db.Create(&product)
+	black, white, red := product.Variants[0], product.Variants[1], product.Variants[2]
+	// All of the red stock is held by a cart
+	db.Create(&models.StockReservation{CartItemID: 1, ProductVariantID: red.ID, Quantity: 2, ExpiresAt: time.Now().Add(time.Hour)})
+
+	subscribe := func(variantID uint, channel, target string) (int, models.StockSubscription) {
+		body, _ := json.Marshal(gin.H{"channel": channel, "target": target})
+		req, _ := http.NewRequest(http.MethodPost, "/api/variants/"+strconv.Itoa(int(variantID))+"/stock-subscriptions", bytes.NewBuffer(body))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		var sub models.StockSubscription
+		json.Unmarshal(rec.Body.Bytes(), &sub)
+		return rec.Code, sub
+	}
+	adjust := func(delta int) {
+		body, _ := json.Marshal(gin.H{"product_variant_id": black.ID, "delta": delta, "reason_code": "correction"})
+		req, _ := http.NewRequest(http.MethodPost, "/api/inventory/adjustments", bytes.NewBuffer(body))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+	}
+	outbox := func() []models.OutboxMessage {
+		var messages []models.OutboxMessage
+		db.Order("id").Find(&messages)
+		return messages
+	}
+
+	code, first := subscribe(black.ID, "email", "ann@example.com")
+	assert.Equal(t, http.StatusCreated, code)
+	code, again := subscribe(black.ID, "email", "ann@example.com")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, first.ID, again.ID)
+	code, _ = subscribe(black.ID, "webhook", "https://hooks.example.com/stock")
+	assert.Equal(t, http.StatusCreated, code)
+
+	code, _ = subscribe(black.ID, "email", "not-an-email")
+	assert.Equal(t, http.StatusBadRequest, code)
+	for _, target := range []string{"http://localhost:8080/hook", "http://127.0.0.1/hook", "http://10.0.0.5/hook", "http://169.254.169.254/latest", "http://[::1]/hook"} {
+		code, _ = subscribe(black.ID, "webhook", target)
+		assert.Equal(t, http.StatusBadRequest, code, target)
+	}
+	code, _ = subscribe(white.ID, "email", "ann@example.com")
+	assert.Equal(t, http.StatusBadRequest, code)
+	// Stock that carts hold is not available
+	code, _ = subscribe(red.ID, "email", "ann@example.com")
+	assert.Equal(t, http.StatusCreated, code)
+
+	// Restocking through a variant update queues one message per subscriber
+	body, _ := json.Marshal(gin.H{"color": "Black", "size": "M", "stock": 3})
+	req, _ := http.NewRequest(http.MethodPut, "/api/products/"+strconv.Itoa(int(product.ID))+"/variants/"+strconv.Itoa(int(black.ID)), bytes.NewBuffer(body))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	messages := outbox()
+	assert.Len(t, messages, 2)
+	assert.Equal(t, "ann@example.com", messages[0].Recipient)
+	assert.Equal(t, inventory.EventBackInStock, messages[0].Event)
+	assert.Equal(t, "Back in stock: T-shirt (Black, M)", messages[0].Subject)
+	assert.Equal(t, notify.ChannelWebhook, messages[1].Channel)
+	assert.Equal(t, "https://hooks.example.com/stock", messages[1].Recipient)
+
+	// Selling out and restocking again within the cooldown notifies nobody
+	// yet: earlier subscribers were one-shot and the new one waits
+	adjust(-3)
+	code, _ = subscribe(black.ID, "email", "bob@example.com")
+	assert.Equal(t, http.StatusCreated, code)
+	adjust(2)
+	assert.Len(t, outbox(), 2)
+
+	pending := func() []string {
+		var targets []string
+		db.Model(&models.StockSubscription{}).Where("notified_at IS NULL").Order("id").Pluck("target", &targets)
+		return targets
+	}
+	assert.Equal(t, []string{"ann@example.com", "bob@example.com"}, pending())
+
+	// Once the cooldown is over, the sweep notifies whoever waits on a
+	// variant that is still available
+	queued, err := inv.QueueBackInStock()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, queued)
+	db.Model(&models.StockSubscription{}).Where("notified_at IS NOT NULL").Update("notified_at", time.Now().Add(-2*inventory.DefaultBackInStockCooldown))
+	queued, err = inv.QueueBackInStock()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, queued)
+	messages = outbox()
+	assert.Len(t, messages, 3)
+	assert.Equal(t, "bob@example.com", messages[2].Recipient)
+	// The red variant is still held by a cart
+	assert.Equal(t, []string{"ann@example.com"}, pending())
+}
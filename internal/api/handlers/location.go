@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/abdelmounim-dev/go-tshirt/internal/db"
+	"github.com/abdelmounim-dev/go-tshirt/internal/models"
+	"github.com/abdelmounim-dev/go-tshirt/internal/service/inventory"
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"gorm.io/gorm"
+)
+
+type LocationHandler struct {
+	db        *gorm.DB
+	inventory *inventory.Service
+	validate  *validator.Validate
+}
+
+func NewLocationHandler(db *gorm.DB, inv *inventory.Service) *LocationHandler {
+	return &LocationHandler{
+		db:        db,
+		inventory: inv,
+		validate:  validator.New(),
+	}
+}
+
+func (h *LocationHandler) Register(r *gin.RouterGroup) {
+	locationRoutes := r.Group("/locations")
+	{
+		locationRoutes.GET("", h.GetAll)
+		locationRoutes.POST("", h.Create)
+		locationRoutes.PUT("/:id", h.Update)
+		locationRoutes.PUT("/:id/stock/:variant_id", h.SetStock)
+	}
+
+	r.GET("/variants/:id/stock-levels", h.GetStockLevels)
+}
+
+func (h *LocationHandler) GetAll(c *gin.Context) {
+	locations := []models.Location{}
+	if err := h.db.Order("priority, id").Find(&locations).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, locations)
+}
+
+func (h *LocationHandler) Create(c *gin.Context) {
+	var location models.Location
+	if err := c.ShouldBindJSON(&location); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.validate.Struct(location); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	location.ID = 0
+	if err := h.db.Create(&location).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, location)
+}
+
+func (h *LocationHandler) Update(c *gin.Context) {
+	var location models.Location
+	if err := c.ShouldBindJSON(&location); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.validate.Struct(location); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var existing models.Location
+	if err := h.db.First(&existing, c.Param("id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Location not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	location.ID = existing.ID // Ensure the ID from the URL is used
+	location.CreatedAt = existing.CreatedAt
+	if err := h.db.Save(&location).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, location)
+}
+
+type setStockRequest struct {
+	Quantity *uint  `json:"quantity" validate:"required"`
+	Reason   string `json:"reason"`
+}
+
+// SetStock sets the on-hand quantity of a variant at a location. The
+// difference is recorded as an adjustment, so the variant's total stock moves
+// with it.
+func (h *LocationHandler) SetStock(c *gin.Context) {
+	var req setStockRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.validate.Struct(req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var location models.Location
+	if err := h.db.First(&location, c.Param("id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Location not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	variantID, err := strconv.Atoi(c.Param("variant_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid variant ID"})
+		return
+	}
+
+	reason := req.Reason
+	if reason == "" {
+		reason = "stock count"
+	}
+	var level models.StockLevel
+	err = db.Transaction(h.db, func(tx *gorm.DB) error {
+		level = models.StockLevel{}
+		_, err := h.inventory.SetStock(tx, uint(variantID), *req.Quantity, models.InventoryMovement{
+			Type:       models.MovementAdjustment,
+			LocationID: &location.ID,
+			Reason:     reason,
+			Actor:      actor(c),
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Preload("Location").
+			Where("location_id = ? AND product_variant_id = ?", location.ID, variantID).
+			Attrs(models.StockLevel{LocationID: location.ID, ProductVariantID: uint(variantID)}).
+			FirstOrInit(&level).Error
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product variant not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.inventory.CheckLowStock(c.Request.Context(), uint(variantID))
+	level.Location = location
+	c.JSON(http.StatusOK, level)
+}
+
+type stockLevelsResponse struct {
+	ProductVariantID uint                `json:"product_variant_id"`
+	Stock            uint                `json:"stock"`
+	Unassigned       int                 `json:"unassigned"`
+	Levels           []models.StockLevel `json:"levels"`
+}
+
+// GetStockLevels lists a variant's stock at each location alongside its
+// total. Unassigned is the part of the total not held at any location.
+func (h *LocationHandler) GetStockLevels(c *gin.Context) {
+	var variant models.ProductVariant
+	if err := h.db.First(&variant, c.Param("id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product variant not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	levels := []models.StockLevel{}
+	err := h.db.Joins("Location").
+		Where("stock_levels.product_variant_id = ?", variant.ID).
+		Order("Location.priority, Location.id").
+		Find(&levels).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	unassigned := int(variant.Stock)
+	for _, level := range levels {
+		unassigned -= int(level.Quantity)
+	}
+	c.JSON(http.StatusOK, stockLevelsResponse{
+		ProductVariantID: variant.ID,
+		Stock:            variant.Stock,
+		Unassigned:       unassigned,
+		Levels:           levels,
+	})
+}
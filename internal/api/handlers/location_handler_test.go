@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/abdelmounim-dev/go-tshirt/internal/models"
+	"github.com/abdelmounim-dev/go-tshirt/internal/service/inventory"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocationHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	setup := func(t *testing.T) (*gin.Engine, models.Product, []models.Location) {
+		db := setupTestDB(t)
+		err := db.AutoMigrate(&models.Cart{}, &models.CartItem{}, &models.BundleSelection{})
+		assert.NoError(t, err)
+
+		inv := inventory.NewService(db, inventory.Options{})
+		router := gin.Default()
+		api := router.Group("/api")
+		NewLocationHandler(db, inv).Register(api)
+		NewInventoryHandler(db, inv).Register(api)
+		NewProductHandler(db, inv).Register(api)
+		newCartHandler(db, inv).Register(api)
+
+		product := models.Product{Name: "T-shirt", Price: 20, Variants: []models.ProductVariant{{Color: "Black", Size: "M"}}}
+		db.Create(&product)
+
+		var locations []models.Location
+		for _, l := range []models.Location{{Code: "partner", Name: "Print partner", Priority: 2}, {Code: "main", Name: "Main warehouse", Priority: 1}} {
+			body, _ := json.Marshal(l)
+			req, _ := http.NewRequest(http.MethodPost, "/api/locations", bytes.NewBuffer(body))
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			assert.Equal(t, http.StatusCreated, rec.Code)
+
+			var created models.Location
+			json.Unmarshal(rec.Body.Bytes(), &created)
+			locations = append(locations, created)
+		}
+		return router, product, locations
+	}
+
+	setStock := func(t *testing.T, router *gin.Engine, locationID, variantID uint, quantity int) {
+		body, _ := json.Marshal(gin.H{"quantity": quantity})
+		req, _ := http.NewRequest(http.MethodPut, "/api/locations/"+strconv.Itoa(int(locationID))+"/stock/"+strconv.Itoa(int(variantID)), bytes.NewBuffer(body))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	getLevels := func(t *testing.T, router *gin.Engine, variantID uint) stockLevelsResponse {
+		req, _ := http.NewRequest(http.MethodGet, "/api/variants/"+strconv.Itoa(int(variantID))+"/stock-levels", nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		var levels stockLevelsResponse
+		json.Unmarshal(rec.Body.Bytes(), &levels)
+		return levels
+	}
+
+	t.Run("should aggregate stock levels into the variant total", func(t *testing.T) {
+		router, product, locations := setup(t)
+		variantID := product.Variants[0].ID
+		partner, main := locations[0], locations[1]
+
+		setStock(t, router, partner.ID, variantID, 4)
+		setStock(t, router, main.ID, variantID, 6)
+
+		levels := getLevels(t, router, variantID)
+		assert.Equal(t, uint(10), levels.Stock)
+		assert.Equal(t, 0, levels.Unassigned)
+		assert.Len(t, levels.Levels, 2)
+		assert.Equal(t, "main", levels.Levels[0].Location.Code)
+		assert.Equal(t, uint(6), levels.Levels[0].Quantity)
+	})
+
+	t.Run("should transfer stock between locations", func(t *testing.T) {
+		router, product, locations := setup(t)
+		variantID := product.Variants[0].ID
+		partner, main := locations[0], locations[1]
+		setStock(t, router, main.ID, variantID, 6)
+
+		body, _ := json.Marshal(gin.H{"product_variant_id": variantID, "from_location_id": main.ID, "to_location_id": partner.ID, "quantity": 4})
+		req, _ := http.NewRequest(http.MethodPost, "/api/inventory/transfers", bytes.NewBuffer(body))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		levels := getLevels(t, router, variantID)
+		assert.Equal(t, uint(6), levels.Stock)
+		assert.Equal(t, uint(2), levels.Levels[0].Quantity)
+		assert.Equal(t, uint(4), levels.Levels[1].Quantity)
+
+		// Only 2 are left at the main warehouse
+		body, _ = json.Marshal(gin.H{"product_variant_id": variantID, "from_location_id": main.ID, "to_location_id": partner.ID, "quantity": 3})
+		req, _ = http.NewRequest(http.MethodPost, "/api/inventory/transfers", bytes.NewBuffer(body))
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.JSONEq(t, `{"error":"Insufficient stock"}`, rec.Body.String())
+	})
+
+	t.Run("should fulfil cart lines from the highest priority location with stock", func(t *testing.T) {
+		router, product, locations := setup(t)
+		variantID := product.Variants[0].ID
+		partner, main := locations[0], locations[1]
+		setStock(t, router, partner.ID, variantID, 5)
+		setStock(t, router, main.ID, variantID, 2)
+
+		req, _ := http.NewRequest(http.MethodPost, "/api/cart", nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		var cart models.Cart
+		json.Unmarshal(rec.Body.Bytes(), &cart)
+		itemsURL := "/api/cart/" + cart.Token + "/items"
+
+		body, _ := json.Marshal(models.CartItem{ProductVariantID: variantID, Quantity: 2})
+		req, _ = http.NewRequest(http.MethodPost, itemsURL, bytes.NewBuffer(body))
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+
+		var item models.CartItem
+		json.Unmarshal(rec.Body.Bytes(), &item)
+		assert.Equal(t, main.ID, *item.FulfillmentLocationID)
+
+		// Growing the line beyond what the main warehouse holds moves it to the partner
+		body, _ = json.Marshal(models.CartItem{ProductVariantID: variantID, Quantity: 3})
+		req, _ = http.NewRequest(http.MethodPost, itemsURL, bytes.NewBuffer(body))
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+
+		json.Unmarshal(rec.Body.Bytes(), &item)
+		assert.Equal(t, uint(5), item.Quantity)
+		assert.Equal(t, partner.ID, *item.FulfillmentLocationID)
+	})
+
+	t.Run("should not sell stock held at disabled locations", func(t *testing.T) {
+		router, product, locations := setup(t)
+		variantID := product.Variants[0].ID
+		partner, main := locations[0], locations[1]
+		setStock(t, router, partner.ID, variantID, 4)
+		setStock(t, router, main.ID, variantID, 6)
+
+		main.Disabled = true
+		body, _ := json.Marshal(main)
+		req, _ := http.NewRequest(http.MethodPut, "/api/locations/"+strconv.Itoa(int(main.ID)), bytes.NewBuffer(body))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		req, _ = http.NewRequest(http.MethodGet, "/api/products/"+strconv.Itoa(int(product.ID))+"/variants/"+strconv.Itoa(int(variantID)), nil)
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		var variant models.ProductVariant
+		json.Unmarshal(rec.Body.Bytes(), &variant)
+		assert.Equal(t, 4, *variant.Available)
+
+		req, _ = http.NewRequest(http.MethodPost, "/api/cart", nil)
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		var cart models.Cart
+		json.Unmarshal(rec.Body.Bytes(), &cart)
+		itemsURL := "/api/cart/" + cart.Token + "/items"
+
+		// Only the 4 at the partner can be sold
+		body, _ = json.Marshal(models.CartItem{ProductVariantID: variantID, Quantity: 5})
+		req, _ = http.NewRequest(http.MethodPost, itemsURL, bytes.NewBuffer(body))
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+		body, _ = json.Marshal(models.CartItem{ProductVariantID: variantID, Quantity: 4})
+		req, _ = http.NewRequest(http.MethodPost, itemsURL, bytes.NewBuffer(body))
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+	})
+
+	t.Run("should require a location to change stock held at locations", func(t *testing.T) {
+		router, product, locations := setup(t)
+		variantID := product.Variants[0].ID
+		setStock(t, router, locations[1].ID, variantID, 6)
+
+		body, _ := json.Marshal(gin.H{"product_variant_id": variantID, "delta": 2, "reason_code": "correction"})
+		req, _ := http.NewRequest(http.MethodPost, "/api/inventory/adjustments", bytes.NewBuffer(body))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.JSONEq(t, `{"error":"A location is required to change the stock of a variant held at locations"}`, rec.Body.String())
+
+		levels := getLevels(t, router, variantID)
+		assert.Equal(t, uint(6), levels.Stock)
+	})
+}
@@ -0,0 +1,385 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	apperrors "github.com/abdelmounim-dev/go-tshirt/internal/errors"
+	"github.com/abdelmounim-dev/go-tshirt/internal/models"
+	"github.com/abdelmounim-dev/go-tshirt/internal/service/mockup"
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"gorm.io/gorm"
+)
+
+const (
+	maxUploadBytes = 10 << 20
+	// maxUploadRequestBytes leaves room for the form fields sent with an
+	// upload.
+	maxUploadRequestBytes = maxUploadBytes + 1<<20
+	maxUploadDimensions   = 6000
+	// maxUploadPixels bounds the memory an upload takes once decoded.
+	maxUploadPixels = 12_000_000
+)
+
+// merchantKeyHeader carries the merchant's key on requests only the merchant
+// may make.
+const merchantKeyHeader = "X-Merchant-Key"
+
+type MockupHandler struct {
+	db          *gorm.DB
+	validate    *validator.Validate
+	dir         string
+	merchantKey string
+}
+
+// NewMockupHandler returns a handler storing images under dir. Requests
+// publishing to the gallery must carry merchantKey; none can when it is empty.
+func NewMockupHandler(db *gorm.DB, dir, merchantKey string) *MockupHandler {
+	return &MockupHandler{
+		db:          db,
+		validate:    validator.New(),
+		dir:         dir,
+		merchantKey: merchantKey,
+	}
+}
+
+func (h *MockupHandler) Register(r *gin.RouterGroup) {
+	productRoutes := r.Group("/products/:id")
+	{
+		productRoutes.GET("/mockup-templates", h.GetTemplates)
+		productRoutes.POST("/mockup-templates", h.CreateTemplate)
+		productRoutes.GET("/mockups", h.GetMockups)
+		productRoutes.POST("/mockups", h.CreateMockup)
+	}
+
+	mockupRoutes := r.Group("/mockups")
+	{
+		mockupRoutes.GET("/:token", h.GetMockup)
+		mockupRoutes.GET("/:token/image", h.GetMockupImage)
+	}
+}
+
+// BackfillTokens gives a token to every mockup rendered before mockups had
+// one. Such mockups stay out of the gallery.
+func (h *MockupHandler) BackfillTokens() error {
+	var pending []models.Mockup
+	if err := h.db.Where("token IS NULL OR token = ''").Find(&pending).Error; err != nil {
+		return err
+	}
+	for _, m := range pending {
+		token, err := models.NewCartToken()
+		if err != nil {
+			return err
+		}
+		if err := h.db.Model(&models.Mockup{}).Where("id = ?", m.ID).UpdateColumn("token", token).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *MockupHandler) GetTemplates(c *gin.Context) {
+	productID := c.Param("id")
+	var templates []models.MockupTemplate
+	if err := h.db.Where("product_id = ?", productID).Find(&templates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, templates)
+}
+
+func (h *MockupHandler) CreateTemplate(c *gin.Context) {
+	productID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+		return
+	}
+
+	var tmpl models.MockupTemplate
+	if !bindUpload(c, &tmpl) {
+		return
+	}
+	if err := h.validate.Struct(tmpl); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.db.First(&models.Product{}, productID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	file, err := c.FormFile("image")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Template image is required"})
+		return
+	}
+	img, err := readPNG(file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	area := image.Rect(tmpl.PrintX, tmpl.PrintY, tmpl.PrintX+tmpl.PrintWidth, tmpl.PrintY+tmpl.PrintHeight)
+	if !area.In(img.Bounds()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Print area is outside the template image"})
+		return
+	}
+
+	path, err := h.savePNG(img)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	tmpl.ProductID = uint(productID)
+	tmpl.ImagePath = path
+	if err := h.db.Create(&tmpl).Error; err != nil {
+		os.Remove(path)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, tmpl)
+}
+
+type mockupRequest struct {
+	Color string  `form:"color" validate:"required"`
+	X     float64 `form:"x"`
+	Y     float64 `form:"y"`
+	Scale float64 `form:"scale"`
+	// Gallery publishes the mockup with the product; it is for the merchant's
+	// own renders, not customer designs, and requires the merchant's key.
+	Gallery bool `form:"gallery"`
+}
+
+// CreateMockup renders a design onto the product's template for the color.
+// The response carries the mockup's token, the only way to reach a mockup
+// that is not in the gallery.
+func (h *MockupHandler) CreateMockup(c *gin.Context) {
+	productID := c.Param("id")
+
+	var req mockupRequest
+	if !bindUpload(c, &req) {
+		return
+	}
+	if err := h.validate.Struct(req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Gallery && !h.isMerchant(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the merchant can publish mockups to the gallery"})
+		return
+	}
+	if req.Scale == 0 {
+		req.Scale = 1
+	}
+
+	var tmpl models.MockupTemplate
+	if err := h.db.Where("product_id = ? AND color = ?", productID, req.Color).Order("id DESC").First(&tmpl).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Mockup template not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	file, err := c.FormFile("design")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Design image is required"})
+		return
+	}
+	design, err := readPNG(file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	base, err := loadPNG(tmpl.ImagePath)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	area := mockup.PrintArea{
+		Bounds:      image.Rect(tmpl.PrintX, tmpl.PrintY, tmpl.PrintX+tmpl.PrintWidth, tmpl.PrintY+tmpl.PrintHeight),
+		WidthInches: tmpl.PrintWidthInches,
+		MinDPI:      tmpl.MinDPI,
+		MaxDPI:      tmpl.MaxDPI,
+	}
+	rendered, err := mockup.Render(base, design, area, mockup.Placement{X: req.X, Y: req.Y, Scale: req.Scale})
+	if err != nil {
+		var validationErr *apperrors.ValidationError
+		if errors.As(err, &validationErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	path, err := h.savePNG(rendered)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	m := models.Mockup{ProductID: tmpl.ProductID, TemplateID: tmpl.ID, Color: tmpl.Color, Gallery: req.Gallery, ImagePath: path}
+	if err := h.db.Create(&m).Error; err != nil {
+		os.Remove(path)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	m.ImageURL = mockupImageURL(m.Token)
+	c.JSON(http.StatusCreated, m)
+}
+
+// GetMockups lists the product's gallery mockups. Customer designs are never
+// listed.
+func (h *MockupHandler) GetMockups(c *gin.Context) {
+	productID := c.Param("id")
+	var mockups []models.Mockup
+	if err := h.db.Where("product_id = ? AND gallery = ?", productID, true).Find(&mockups).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for i := range mockups {
+		mockups[i].ImageURL = mockupImageURL(mockups[i].Token)
+	}
+	c.JSON(http.StatusOK, mockups)
+}
+
+func (h *MockupHandler) GetMockup(c *gin.Context) {
+	var m models.Mockup
+	if err := h.db.Where("token = ?", c.Param("token")).First(&m).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Mockup not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	m.ImageURL = mockupImageURL(m.Token)
+	c.JSON(http.StatusOK, m)
+}
+
+func (h *MockupHandler) GetMockupImage(c *gin.Context) {
+	var m models.Mockup
+	if err := h.db.Where("token = ?", c.Param("token")).First(&m).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Mockup not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.File(m.ImagePath)
+}
+
+// isMerchant reports whether the request carries the merchant's key.
+func (h *MockupHandler) isMerchant(c *gin.Context) bool {
+	key := c.GetHeader(merchantKeyHeader)
+	return h.merchantKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(h.merchantKey)) == 1
+}
+
+// bindUpload binds a multipart upload into obj, reading at most
+// maxUploadRequestBytes of the body. It responds and returns false when the
+// request is too large or malformed.
+func bindUpload(c *gin.Context, obj any) bool {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxUploadRequestBytes)
+	if err := c.ShouldBind(obj); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Upload must be at most %d bytes", maxUploadBytes)})
+			return false
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// savePNG encodes img into a new file under the handler's storage directory.
+func (h *MockupHandler) savePNG(img image.Image) (string, error) {
+	if err := os.MkdirAll(h.dir, 0o755); err != nil {
+		return "", err
+	}
+	name := make([]byte, 16)
+	if _, err := rand.Read(name); err != nil {
+		return "", err
+	}
+	path := filepath.Join(h.dir, hex.EncodeToString(name)+".png")
+
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
+
+// readPNG decodes an uploaded PNG, rejecting oversized files and images before
+// they are fully decoded. Images are limited both per side and in total
+// pixels, so a decoded upload stays within a few tens of megabytes.
+func readPNG(fh *multipart.FileHeader) (image.Image, error) {
+	if fh.Size > maxUploadBytes {
+		return nil, fmt.Errorf("Image must be at most %d bytes", maxUploadBytes)
+	}
+	f, err := fh.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cfg, err := png.DecodeConfig(f)
+	if err != nil {
+		return nil, errors.New("Image must be a PNG")
+	}
+	if cfg.Width > maxUploadDimensions || cfg.Height > maxUploadDimensions {
+		return nil, fmt.Errorf("Image must be at most %dx%d pixels", maxUploadDimensions, maxUploadDimensions)
+	}
+	if cfg.Width*cfg.Height > maxUploadPixels {
+		return nil, fmt.Errorf("Image must be at most %d pixels in total", maxUploadPixels)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, err := png.Decode(f)
+	if err != nil {
+		return nil, errors.New("Image must be a PNG")
+	}
+	return img, nil
+}
+
+func loadPNG(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return png.Decode(f)
+}
+
+func mockupImageURL(token string) string {
+	return "/api/mockups/" + token + "/image"
+}
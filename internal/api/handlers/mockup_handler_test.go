@@ -0,0 +1,277 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/abdelmounim-dev/go-tshirt/internal/models"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func solidPNG(t *testing.T, width, height int, c color.Color) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{C: c}, image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, img))
+	return buf.Bytes()
+}
+
+func multipartRequest(t *testing.T, url string, fields map[string]string, fileField string, file []byte) *http.Request {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for k, v := range fields {
+		assert.NoError(t, w.WriteField(k, v))
+	}
+	if fileField != "" {
+		fw, err := w.CreateFormFile(fileField, fileField+".png")
+		assert.NoError(t, err)
+		fw.Write(file)
+	}
+	assert.NoError(t, w.Close())
+
+	req, _ := http.NewRequest(http.MethodPost, url, &body)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	return req
+}
+
+func TestMockupHandler_CreateMockup(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	testCases := []struct {
+		name         string
+		designWidth  int
+		scale        string
+		expectedCode int
+	}{
+		{
+			name:         "should render a mockup inside the print area",
+			designWidth:  100,
+			scale:        "0.5",
+			expectedCode: http.StatusCreated,
+		},
+		{
+			name:         "should reject a design below the minimum DPI",
+			designWidth:  10,
+			scale:        "1",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "should reject a design that exceeds the print area",
+			designWidth:  100,
+			scale:        "1.5",
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db := setupTestDB(t)
+			err := db.AutoMigrate(&models.MockupTemplate{}, &models.Mockup{})
+			assert.NoError(t, err)
+
+			product := models.Product{Name: "T-shirt", Price: 20}
+			db.Create(&product)
+			productURL := "/api/products/" + strconv.Itoa(int(product.ID))
+
+			handler := NewMockupHandler(db, t.TempDir(), "merchant-key")
+			router := gin.Default()
+			api := router.Group("/api")
+			handler.Register(api)
+
+			// 200x200 white shirt with a 100x100 print area that is 10 inches wide
+			req := multipartRequest(t, productURL+"/mockup-templates", map[string]string{
+				"color":              "White",
+				"print_x":            "50",
+				"print_y":            "50",
+				"print_width":        "100",
+				"print_height":       "100",
+				"print_width_inches": "10",
+				"min_dpi":            "5",
+			}, "image", solidPNG(t, 200, 200, color.White))
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			assert.Equal(t, http.StatusCreated, rec.Code)
+
+			req = multipartRequest(t, productURL+"/mockups", map[string]string{
+				"color": "White",
+				"scale": tc.scale,
+			}, "design", solidPNG(t, tc.designWidth, tc.designWidth, color.RGBA{R: 255, A: 255}))
+			rec = httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			assert.Equal(t, tc.expectedCode, rec.Code)
+
+			if tc.expectedCode == http.StatusCreated {
+				var m models.Mockup
+				json.Unmarshal(rec.Body.Bytes(), &m)
+				assert.Equal(t, product.ID, m.ProductID)
+				assert.NotEmpty(t, m.ImageURL)
+
+				req, _ = http.NewRequest(http.MethodGet, m.ImageURL, nil)
+				rec = httptest.NewRecorder()
+				router.ServeHTTP(rec, req)
+				assert.Equal(t, http.StatusOK, rec.Code)
+
+				img, err := png.Decode(rec.Body)
+				assert.NoError(t, err)
+				r, g, _, _ := img.At(75, 75).RGBA()
+				assert.Equal(t, uint32(0xffff), r)
+				assert.Equal(t, uint32(0), g)
+				r, g, _, _ = img.At(150, 150).RGBA()
+				assert.Equal(t, uint32(0xffff), r)
+				assert.Equal(t, uint32(0xffff), g)
+			}
+		})
+	}
+}
+
+func TestMockupHandler_GetMockups(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	db := setupTestDB(t)
+	err := db.AutoMigrate(&models.MockupTemplate{}, &models.Mockup{})
+	assert.NoError(t, err)
+
+	product := models.Product{Name: "T-shirt", Price: 20}
+	db.Create(&product)
+	productURL := "/api/products/" + strconv.Itoa(int(product.ID))
+
+	handler := NewMockupHandler(db, t.TempDir(), "merchant-key")
+	router := gin.Default()
+	api := router.Group("/api")
+	handler.Register(api)
+
+	req := multipartRequest(t, productURL+"/mockup-templates", map[string]string{
+		"color":              "White",
+		"print_x":            "50",
+		"print_y":            "50",
+		"print_width":        "100",
+		"print_height":       "100",
+		"print_width_inches": "10",
+	}, "image", solidPNG(t, 200, 200, color.White))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	render := func(gallery string) models.Mockup {
+		req := multipartRequest(t, productURL+"/mockups", map[string]string{
+			"color":   "White",
+			"scale":   "0.5",
+			"gallery": gallery,
+		}, "design", solidPNG(t, 100, 100, color.Black))
+		req.Header.Set(merchantKeyHeader, "merchant-key")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		var m models.Mockup
+		json.Unmarshal(rec.Body.Bytes(), &m)
+		return m
+	}
+	customer := render("false")
+	gallery := render("true")
+
+	t.Run("should list only gallery mockups", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodGet, productURL+"/mockups", nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		var mockups []models.Mockup
+		json.Unmarshal(rec.Body.Bytes(), &mockups)
+		if assert.Len(t, mockups, 1) {
+			assert.Equal(t, gallery.Token, mockups[0].Token)
+		}
+	})
+
+	t.Run("should only let the merchant publish to the gallery", func(t *testing.T) {
+		for _, key := range []string{"", "wrong"} {
+			req := multipartRequest(t, productURL+"/mockups", map[string]string{
+				"color":   "White",
+				"scale":   "0.5",
+				"gallery": "true",
+			}, "design", solidPNG(t, 100, 100, color.Black))
+			if key != "" {
+				req.Header.Set(merchantKeyHeader, key)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			assert.Equal(t, http.StatusForbidden, rec.Code, key)
+		}
+
+		var published int64
+		db.Model(&models.Mockup{}).Where("gallery = ?", true).Count(&published)
+		assert.Equal(t, int64(1), published)
+	})
+
+	t.Run("should reach a customer mockup by its token only", func(t *testing.T) {
+		assert.NotEmpty(t, customer.Token)
+		for url, code := range map[string]int{
+			"/api/mockups/" + customer.Token:                 http.StatusOK,
+			customer.ImageURL:                                http.StatusOK,
+			"/api/mockups/" + strconv.Itoa(int(customer.ID)): http.StatusNotFound,
+		} {
+			req, _ := http.NewRequest(http.MethodGet, url, nil)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			assert.Equal(t, code, rec.Code, url)
+		}
+	})
+}
+
+func TestMockupHandler_UploadLimits(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	db := setupTestDB(t)
+	err := db.AutoMigrate(&models.MockupTemplate{}, &models.Mockup{})
+	assert.NoError(t, err)
+
+	product := models.Product{Name: "T-shirt", Price: 20}
+	db.Create(&product)
+	productURL := "/api/products/" + strconv.Itoa(int(product.ID))
+
+	handler := NewMockupHandler(db, t.TempDir(), "merchant-key")
+	router := gin.Default()
+	api := router.Group("/api")
+	handler.Register(api)
+
+	fields := map[string]string{
+		"color":              "White",
+		"print_x":            "0",
+		"print_y":            "0",
+		"print_width":        "10",
+		"print_height":       "10",
+		"print_width_inches": "10",
+	}
+
+	t.Run("should reject a request over the upload size before parsing it", func(t *testing.T) {
+		req := multipartRequest(t, productURL+"/mockup-templates", fields, "image", bytes.Repeat([]byte{0}, maxUploadRequestBytes))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	})
+
+	t.Run("should reject an image over the pixel budget", func(t *testing.T) {
+		img := image.NewGray(image.Rect(0, 0, 5000, 2500))
+		var buf bytes.Buffer
+		assert.NoError(t, png.Encode(&buf, img))
+
+		req := multipartRequest(t, productURL+"/mockup-templates", fields, "image", buf.Bytes())
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), "pixels in total")
+
+		var templates int64
+		db.Model(&models.MockupTemplate{}).Count(&templates)
+		assert.Equal(t, int64(0), templates)
+	})
+}
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/abdelmounim-dev/go-tshirt/internal/db"
+	apperrors "github.com/abdelmounim-dev/go-tshirt/internal/errors"
+	"github.com/abdelmounim-dev/go-tshirt/internal/models"
+	"github.com/abdelmounim-dev/go-tshirt/internal/service/carts"
+	"github.com/abdelmounim-dev/go-tshirt/internal/service/inventory"
+	"github.com/abdelmounim-dev/go-tshirt/internal/service/orders"
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"gorm.io/gorm"
+)
+
+type OrderHandler struct {
+	db        *gorm.DB
+	inventory *inventory.Service
+	carts     *carts.Service
+	orders    *orders.Service
+	validate  *validator.Validate
+}
+
+func NewOrderHandler(db *gorm.DB, inv *inventory.Service, cartService *carts.Service, orderService *orders.Service) *OrderHandler {
+	return &OrderHandler{
+		db:        db,
+		inventory: inv,
+		carts:     cartService,
+		orders:    orderService,
+		validate:  validator.New(),
+	}
+}
+
+func (h *OrderHandler) Register(r *gin.RouterGroup) {
+	r.POST("/cart/:token/checkout", h.Checkout)
+	r.GET("/orders/:token", h.GetOrder)
+}
+
+type checkoutRequest struct {
+	Email           string          `json:"email" validate:"required,email"`
+	ShippingAddress models.Address  `json:"shipping_address"`
+	BillingAddress  *models.Address `json:"billing_address" validate:"omitempty"`
+}
+
+// Checkout places an order for the cart's items and responds with it. A cart
+// that cannot be checked out as it is is rejected with its blocking problems.
+func (h *OrderHandler) Checkout(c *gin.Context) {
+	var req checkoutRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.validate.Struct(req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	cart, ok := activeCart(c, h.db, h.carts)
+	if !ok {
+		return
+	}
+
+	var order models.Order
+	var problems []carts.Warning
+	var changed []uint
+	err := db.Transaction(h.db, func(tx *gorm.DB) error {
+		if err := h.carts.Touch(tx, cart.ID); err != nil {
+			return err
+		}
+		var err error
+		order, problems, changed, err = h.orders.Checkout(tx, cart, orders.Details{
+			Email:           req.Email,
+			ShippingAddress: req.ShippingAddress,
+			BillingAddress:  req.BillingAddress,
+		})
+		return err
+	})
+	if err != nil {
+		var validationErr *apperrors.ValidationError
+		if errors.As(err, &validationErr) && len(problems) > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": validationErr.Code, "problems": problems})
+			return
+		}
+		respondItemError(c, err)
+		return
+	}
+	h.inventory.CheckLowStock(c.Request.Context(), changed...)
+
+	c.JSON(http.StatusCreated, order)
+}
+
+// GetOrder returns an order with its lines.
+func (h *OrderHandler) GetOrder(c *gin.Context) {
+	var order models.Order
+	if err := h.db.Preload("Lines").Where("token = ?", c.Param("token")).First(&order).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, order)
+}
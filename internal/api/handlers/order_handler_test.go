@@ -0,0 +1,465 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/abdelmounim-dev/go-tshirt/internal/models"
+	"github.com/abdelmounim-dev/go-tshirt/internal/service/carts"
+	"github.com/abdelmounim-dev/go-tshirt/internal/service/inventory"
+	"github.com/abdelmounim-dev/go-tshirt/internal/service/orders"
+	"github.com/abdelmounim-dev/go-tshirt/internal/service/pricing"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestOrderHandler_Checkout(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// setup returns a router serving the cart and order APIs, with a T-shirt
+	// in two colours and a 2-pack bundle of it.
+	setup := func(t *testing.T) (*gorm.DB, *gin.Engine, *inventory.Service, models.Product, models.Product) {
+		db := setupTestDB(t)
+		err := db.AutoMigrate(&models.Cart{}, &models.CartItem{}, &models.BundleSelection{}, &models.Order{}, &models.OrderLine{})
+		assert.NoError(t, err)
+
+		inv := inventory.NewService(db, inventory.Options{})
+		prices := pricing.New(pricing.Options{})
+		cartService := carts.NewService(db, inv, carts.Options{})
+		router := gin.Default()
+		api := router.Group("/api")
+		NewCartHandler(db, inv, prices, cartService).Register(api)
+		NewOrderHandler(db, inv, cartService, orders.NewService(inv, cartService, prices, orders.Options{})).Register(api)
+
+		tee := models.Product{Name: "Basic Tee", Price: 20, Variants: []models.ProductVariant{
+			{Color: "Black", Size: "M", SKU: "TEE-BLK-M", Stock: 10},
+			{Color: "White", Size: "L", SKU: "TEE-WHT-L", Stock: 10},
+		}}
+		db.Create(&tee)
+		bundle := models.Product{Name: "2-pack", Price: 35, Type: models.ProductTypeBundle, BundleComponents: []models.BundleComponent{
+			{ComponentProductID: tee.ID, Quantity: 2},
+		}}
+		db.Create(&bundle)
+		return db, router, inv, tee, bundle
+	}
+
+	send := func(router *gin.Engine, method, path string, body interface{}) *httptest.ResponseRecorder {
+		var payload []byte
+		if body != nil {
+			payload, _ = json.Marshal(body)
+		}
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer(payload))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	address := map[string]string{"name": "Ada Lovelace", "line1": "12 Main St", "city": "London", "postal_code": "N1 9GU", "country": "GB"}
+	details := map[string]interface{}{"email": "ada@example.com", "shipping_address": address}
+
+	newCart := func(db *gorm.DB, customerID string) models.Cart {
+		cart := models.Cart{CustomerID: customerID}
+		db.Create(&cart)
+		return cart
+	}
+
+	t.Run("should place an order and finalize stock", func(t *testing.T) {
+		db, router, inv, tee, bundle := setup(t)
+		cart := newCart(db, "customer-1")
+		black, white := tee.Variants[0], tee.Variants[1]
+
+		rec := send(router, http.MethodPost, "/api/cart/"+cart.Token+"/items", map[string]interface{}{"product_variant_id": black.ID, "quantity": 2})
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		rec = send(router, http.MethodPost, "/api/cart/"+cart.Token+"/items", map[string]interface{}{
+			"bundle_product_id": bundle.ID,
+			"quantity":          1,
+			"bundle_selections": []map[string]uint{{"product_variant_id": black.ID}, {"product_variant_id": white.ID}},
+		})
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		rec = send(router, http.MethodPost, "/api/cart/"+cart.Token+"/items", map[string]interface{}{"product_variant_id": white.ID, "quantity": 1})
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		var saved models.CartItem
+		json.Unmarshal(rec.Body.Bytes(), &saved)
+		rec = send(router, http.MethodPost, "/api/cart/"+cart.Token+"/items/"+strconv.Itoa(int(saved.ID))+"/save-for-later", nil)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		rec = send(router, http.MethodPost, "/api/cart/"+cart.Token+"/checkout", details)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		var order models.Order
+		json.Unmarshal(rec.Body.Bytes(), &order)
+		assert.NotEmpty(t, order.Token)
+		assert.Equal(t, "customer-1", order.CustomerID)
+		assert.Equal(t, models.OrderStatusPlaced, order.Status)
+		assert.Equal(t, "ada@example.com", order.Email)
+		assert.Equal(t, "London", order.ShippingAddress.City)
+		assert.Equal(t, order.ShippingAddress, order.BillingAddress)
+		assert.Equal(t, 75.0, order.Total)
+
+		if assert.Len(t, order.Lines, 2) {
+			assert.Equal(t, "Basic Tee", order.Lines[0].ProductName)
+			assert.Equal(t, "Black", order.Lines[0].Color)
+			assert.Equal(t, "M", order.Lines[0].Size)
+			assert.Equal(t, "TEE-BLK-M", order.Lines[0].SKU)
+			assert.Equal(t, uint(2), order.Lines[0].Quantity)
+			assert.Equal(t, 20.0, order.Lines[0].UnitPrice)
+			assert.Equal(t, 40.0, order.Lines[0].Total)
+
+			assert.Equal(t, "2-pack", order.Lines[1].ProductName)
+			assert.Nil(t, order.Lines[1].ProductVariantID)
+			assert.Equal(t, []models.OrderLineComponent{
+				{ProductID: tee.ID, ProductVariantID: black.ID, ProductName: "Basic Tee", SKU: "TEE-BLK-M", Color: "Black", Size: "M", Quantity: 1},
+				{ProductID: tee.ID, ProductVariantID: white.ID, ProductName: "Basic Tee", SKU: "TEE-WHT-L", Color: "White", Size: "L", Quantity: 1},
+			}, order.Lines[1].Components)
+		}
+
+		// Stock is sold rather than held
+		var stock []uint
+		db.Model(&models.ProductVariant{}).Order("id").Pluck("stock", &stock)
+		assert.Equal(t, []uint{7, 9}, stock)
+		var reservations, sales int64
+		db.Model(&models.StockReservation{}).Count(&reservations)
+		db.Model(&models.InventoryMovement{}).Where("type = ? AND reference LIKE ?", models.MovementSale, "order:%").Count(&sales)
+		assert.Zero(t, reservations)
+		assert.Equal(t, int64(3), sales)
+		available, _ := inv.Available(db, black.ID)
+		assert.Equal(t, 7, available)
+
+		// Only the saved line is left in the cart
+		var items []models.CartItem
+		db.Where("cart_id = ?", cart.ID).Find(&items)
+		if assert.Len(t, items, 1) {
+			assert.Equal(t, saved.ID, items[0].ID)
+		}
+
+		// The order keeps what was bought when the catalog changes
+		db.Model(&models.Product{}).Where("id = ?", tee.ID).Updates(map[string]interface{}{"name": "Premium Tee", "price": 30})
+		rec = send(router, http.MethodGet, "/api/orders/"+order.Token, nil)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var fetched models.Order
+		json.Unmarshal(rec.Body.Bytes(), &fetched)
+		assert.Equal(t, order.Token, fetched.Token)
+		if assert.Len(t, fetched.Lines, 2) {
+			assert.Equal(t, "Basic Tee", fetched.Lines[0].ProductName)
+			assert.Equal(t, 20.0, fetched.Lines[0].UnitPrice)
+		}
+	})
+
+	t.Run("should reject invalid details", func(t *testing.T) {
+		db, router, _, tee, _ := setup(t)
+		cart := newCart(db, "")
+		send(router, http.MethodPost, "/api/cart/"+cart.Token+"/items", map[string]interface{}{"product_variant_id": tee.Variants[0].ID, "quantity": 1})
+
+		withAddress := func(field, value string) map[string]string {
+			a := map[string]string{}
+			for k, v := range address {
+				a[k] = v
+			}
+			a[field] = value
+			return a
+		}
+		tests := []struct {
+			name string
+			body map[string]interface{}
+		}{
+			{"missing email", map[string]interface{}{"shipping_address": address}},
+			{"invalid email", map[string]interface{}{"email": "ada", "shipping_address": address}},
+			{"missing address", map[string]interface{}{"email": "ada@example.com"}},
+			{"missing city", map[string]interface{}{"email": "ada@example.com", "shipping_address": withAddress("city", "")}},
+			{"unknown country", map[string]interface{}{"email": "ada@example.com", "shipping_address": withAddress("country", "XX")}},
+			{"invalid billing address", map[string]interface{}{"email": "ada@example.com", "shipping_address": address, "billing_address": withAddress("line1", "")}},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				rec := send(router, http.MethodPost, "/api/cart/"+cart.Token+"/checkout", tt.body)
+				assert.Equal(t, http.StatusBadRequest, rec.Code)
+			})
+		}
+
+		var n int64
+		db.Model(&models.Order{}).Count(&n)
+		assert.Zero(t, n)
+	})
+
+	t.Run("should reject an empty cart", func(t *testing.T) {
+		db, router, _, _, _ := setup(t)
+		cart := newCart(db, "")
+
+		rec := send(router, http.MethodPost, "/api/cart/"+cart.Token+"/checkout", details)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), orders.CodeCartEmpty)
+	})
+
+	t.Run("should reject a cart with blocking problems", func(t *testing.T) {
+		db, router, _, tee, _ := setup(t)
+		cart := newCart(db, "")
+		send(router, http.MethodPost, "/api/cart/"+cart.Token+"/items", map[string]interface{}{"product_variant_id": tee.Variants[0].ID, "quantity": 3})
+		db.Model(&models.ProductVariant{}).Where("id = ?", tee.Variants[0].ID).Update("stock", 2)
+
+		rec := send(router, http.MethodPost, "/api/cart/"+cart.Token+"/checkout", details)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		var body struct {
+			Code     string          `json:"code"`
+			Problems []carts.Warning `json:"problems"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		assert.Equal(t, orders.CodeCartInvalid, body.Code)
+		if assert.Len(t, body.Problems, 1) {
+			assert.Equal(t, carts.WarningInsufficientStock, body.Problems[0].Code)
+		}
+
+		var n int64
+		db.Model(&models.Order{}).Count(&n)
+		assert.Zero(t, n)
+		db.Model(&models.CartItem{}).Where("cart_id = ?", cart.ID).Count(&n)
+		assert.Equal(t, int64(1), n)
+	})
+
+	t.Run("should sell stock whose reservation expired while it is still free", func(t *testing.T) {
+		db, router, _, tee, _ := setup(t)
+		cart := newCart(db, "")
+		send(router, http.MethodPost, "/api/cart/"+cart.Token+"/items", map[string]interface{}{"product_variant_id": tee.Variants[0].ID, "quantity": 4})
+		db.Model(&models.StockReservation{}).Where("1 = 1").Update("expires_at", time.Now().Add(-time.Minute))
+
+		rec := send(router, http.MethodPost, "/api/cart/"+cart.Token+"/checkout", details)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		var stock uint
+		db.Model(&models.ProductVariant{}).Where("id = ?", tee.Variants[0].ID).Pluck("stock", &stock)
+		assert.Equal(t, uint(6), stock)
+	})
+
+	t.Run("should sell a line no single location covers from several", func(t *testing.T) {
+		db, router, inv, tee, _ := setup(t)
+		black := tee.Variants[0]
+		first, second := models.Location{Code: "first", Name: "First", Priority: 1}, models.Location{Code: "second", Name: "Second", Priority: 2}
+		db.Create(&first)
+		db.Create(&second)
+		// 10 unassigned units plus 3 at each location
+		for _, l := range []models.Location{first, second} {
+			_, err := inv.SetStock(db, black.ID, 3, models.InventoryMovement{Type: models.MovementAdjustment, LocationID: &l.ID})
+			assert.NoError(t, err)
+		}
+
+		cart := newCart(db, "")
+		rec := send(router, http.MethodPost, "/api/cart/"+cart.Token+"/items", map[string]interface{}{"product_variant_id": black.ID, "quantity": 14})
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		rec = send(router, http.MethodPost, "/api/cart/"+cart.Token+"/checkout", details)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+
+		// Unassigned stock goes first, then locations in priority order
+		var stock uint
+		db.Model(&models.ProductVariant{}).Where("id = ?", black.ID).Pluck("stock", &stock)
+		assert.Equal(t, uint(2), stock)
+		var levels []uint
+		db.Model(&models.StockLevel{}).Where("product_variant_id = ?", black.ID).Order("location_id").Pluck("quantity", &levels)
+		assert.Equal(t, []uint{0, 2}, levels)
+	})
+
+	t.Run("should sell from elsewhere when a hold's location can no longer cover it", func(t *testing.T) {
+		for name, change := range map[string]func(db *gorm.DB, inv *inventory.Service, variantID uint, location models.Location){
+			"emptied": func(db *gorm.DB, inv *inventory.Service, variantID uint, location models.Location) {
+				_, err := inv.SetStock(db, variantID, 0, models.InventoryMovement{Type: models.MovementAdjustment, LocationID: &location.ID})
+				assert.NoError(t, err)
+			},
+			"disabled": func(db *gorm.DB, inv *inventory.Service, variantID uint, location models.Location) {
+				db.Model(&location).Update("disabled", true)
+			},
+		} {
+			t.Run(name, func(t *testing.T) {
+				db, router, inv, tee, _ := setup(t)
+				black := tee.Variants[0]
+				first, second := models.Location{Code: "first", Name: "First", Priority: 1}, models.Location{Code: "second", Name: "Second", Priority: 2}
+				db.Create(&first)
+				db.Create(&second)
+				for _, l := range []models.Location{first, second} {
+					_, err := inv.SetStock(db, black.ID, 3, models.InventoryMovement{Type: models.MovementAdjustment, LocationID: &l.ID})
+					assert.NoError(t, err)
+				}
+
+				cart := newCart(db, "")
+				rec := send(router, http.MethodPost, "/api/cart/"+cart.Token+"/items", map[string]interface{}{"product_variant_id": black.ID, "quantity": 3})
+				assert.Equal(t, http.StatusCreated, rec.Code)
+				var line models.CartItem
+				json.Unmarshal(rec.Body.Bytes(), &line)
+				assert.Equal(t, first.ID, *line.FulfillmentLocationID)
+
+				change(db, inv, black.ID, first)
+				var before []uint
+				db.Model(&models.StockLevel{}).Where("product_variant_id = ?", black.ID).Order("location_id").Pluck("quantity", &before)
+
+				// Checkout renews the hold first, so commit the stale one directly
+				assert.NoError(t, inv.Commit(db, line.ID, "order:test"))
+
+				// Unassigned stock is sold first, leaving the locations alone
+				var levels []uint
+				db.Model(&models.StockLevel{}).Where("product_variant_id = ?", black.ID).Order("location_id").Pluck("quantity", &levels)
+				assert.Equal(t, before, levels)
+				var sales int64
+				db.Model(&models.InventoryMovement{}).Where("type = ? AND location_id IS NULL", models.MovementSale).Count(&sales)
+				assert.Equal(t, int64(1), sales)
+			})
+		}
+	})
+
+	t.Run("should not charge a higher price until the shopper accepts it", func(t *testing.T) {
+		db, router, _, tee, _ := setup(t)
+		cart := newCart(db, "")
+		rec := send(router, http.MethodPost, "/api/cart/"+cart.Token+"/items", map[string]interface{}{"product_variant_id": tee.Variants[0].ID, "quantity": 1})
+		assert.Equal(t, http.StatusCreated, rec.Code)
+
+		db.Model(&tee).Update("price", 25)
+		rec = send(router, http.MethodPost, "/api/cart/"+cart.Token+"/checkout", details)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		var rejected struct {
+			Code     string          `json:"code"`
+			Problems []carts.Warning `json:"problems"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &rejected)
+		assert.Equal(t, orders.CodeCartInvalid, rejected.Code)
+		if assert.Len(t, rejected.Problems, 1) {
+			assert.Equal(t, carts.WarningPriceIncreased, rejected.Problems[0].Code)
+		}
+
+		rec = send(router, http.MethodPost, "/api/cart/"+cart.Token+"/validate", map[string]bool{"fix": true})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		rec = send(router, http.MethodPost, "/api/cart/"+cart.Token+"/checkout", details)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		var order models.Order
+		json.Unmarshal(rec.Body.Bytes(), &order)
+		assert.Equal(t, 25.0, order.Subtotal)
+
+		// A lower price needs no confirmation
+		cart = newCart(db, "")
+		rec = send(router, http.MethodPost, "/api/cart/"+cart.Token+"/items", map[string]interface{}{"product_variant_id": tee.Variants[0].ID, "quantity": 1})
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		db.Model(&tee).Update("price", 18)
+		rec = send(router, http.MethodPost, "/api/cart/"+cart.Token+"/checkout", details)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		json.Unmarshal(rec.Body.Bytes(), &order)
+		assert.Equal(t, 18.0, order.Subtotal)
+	})
+
+	t.Run("should limit what one customer buys within the window", func(t *testing.T) {
+		db, router, _, tee, bundle := setup(t)
+		db.Model(&tee).Update("max_per_customer", 3)
+		black := tee.Variants[0]
+		// Carts turned away at checkout keep holding their stock
+		db.Model(&black).Update("stock", 20)
+		checkout := func(customerID string, item map[string]interface{}) *httptest.ResponseRecorder {
+			cart := newCart(db, customerID)
+			rec := send(router, http.MethodPost, "/api/cart/"+cart.Token+"/items", item)
+			assert.Equal(t, http.StatusCreated, rec.Code)
+			return send(router, http.MethodPost, "/api/cart/"+cart.Token+"/checkout", details)
+		}
+		two := map[string]interface{}{"product_variant_id": black.ID, "quantity": 2}
+
+		rec := checkout("cust-1", two)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		rec = checkout("cust-1", two)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.JSONEq(t, `{"error": "At most 3 of Basic Tee per customer; 2 already ordered", "code": "customer_limit_exceeded"}`, rec.Body.String())
+		// Bundle components count towards their product
+		rec = checkout("cust-1", map[string]interface{}{"bundle_product_id": bundle.ID, "quantity": 1, "bundle_selections": []map[string]interface{}{
+			{"product_variant_id": black.ID, "quantity": 2},
+		}})
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+		// Other customers and carts without a customer are not affected
+		rec = checkout("cust-2", two)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		rec = checkout("", two)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+
+		// Orders placed before the window no longer count
+		db.Model(&models.Order{}).Where("customer_id = ?", "cust-1").Update("created_at", time.Now().Add(-orders.DefaultCustomerLimitWindow-time.Hour))
+		rec = checkout("cust-1", two)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+	})
+
+	t.Run("should hold received stock for backordered orders", func(t *testing.T) {
+		db, router, inv, tee, _ := setup(t)
+		white := tee.Variants[1]
+		db.Model(&white).Updates(map[string]interface{}{"stock": 2, "inventory_policy": models.InventoryPolicyBackorder, "backorder_limit": 5})
+
+		first := newCart(db, "")
+		rec := send(router, http.MethodPost, "/api/cart/"+first.Token+"/items", map[string]interface{}{"product_variant_id": white.ID, "quantity": 5})
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		rec = send(router, http.MethodPost, "/api/cart/"+first.Token+"/checkout", details)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+
+		var backorder models.Backorder
+		assert.NoError(t, db.Where("product_variant_id = ?", white.ID).First(&backorder).Error)
+		assert.Equal(t, uint(3), backorder.Outstanding)
+		available, err := inv.Available(db, white.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, -3, available)
+
+		// The order's 3 units count against the backorder limit of 5
+		second := newCart(db, "")
+		rec = send(router, http.MethodPost, "/api/cart/"+second.Token+"/items", map[string]interface{}{"product_variant_id": white.ID, "quantity": 3})
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		rec = send(router, http.MethodPost, "/api/cart/"+second.Token+"/items", map[string]interface{}{"product_variant_id": white.ID, "quantity": 2})
+		assert.Equal(t, http.StatusCreated, rec.Code)
+
+		// Received stock goes to the order before the cart
+		_, err = inv.SetStock(db, white.ID, 4, models.InventoryMovement{Type: models.MovementReceipt})
+		assert.NoError(t, err)
+		assert.NoError(t, db.First(&backorder, backorder.ID).Error)
+		assert.Equal(t, uint(0), backorder.Outstanding)
+		var stock uint
+		db.Model(&models.ProductVariant{}).Where("id = ?", white.ID).Pluck("stock", &stock)
+		assert.Equal(t, uint(1), stock)
+		var sold int
+		db.Model(&models.InventoryMovement{}).Select("COALESCE(SUM(quantity), 0)").
+			Where("product_variant_id = ? AND type = ? AND reference = ?", white.ID, models.MovementSale, backorder.Reference).Scan(&sold)
+		assert.Equal(t, -5, sold)
+	})
+}
+
+func TestOrderHandler_GetOrder(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	db := setupTestDB(t)
+	err := db.AutoMigrate(&models.Order{}, &models.OrderLine{})
+	assert.NoError(t, err)
+	inv := inventory.NewService(db, inventory.Options{})
+	cartService := carts.NewService(db, inv, carts.Options{})
+	router := gin.Default()
+	NewOrderHandler(db, inv, cartService, orders.NewService(inv, cartService, pricing.New(pricing.Options{}), orders.Options{})).Register(router.Group("/api"))
+
+	order := models.Order{CustomerID: "customer-1", Email: "a@example.com", Status: models.OrderStatusPlaced,
+		Lines: []models.OrderLine{{ProductName: "Basic Tee", Quantity: 1}}}
+	db.Create(&order)
+
+	tests := []struct {
+		name         string
+		path         string
+		expectedCode int
+	}{
+		{"order by token", "/api/orders/" + order.Token, http.StatusOK},
+		{"unknown order", "/api/orders/unknown", http.StatusNotFound},
+		// Without authentication, orders are only reachable by their token
+		{"orders by customer", "/api/orders?customer_id=customer-1", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, tt.path, nil)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			assert.Equal(t, tt.expectedCode, rec.Code)
+			if tt.expectedCode != http.StatusOK {
+				return
+			}
+
+			var found models.Order
+			json.Unmarshal(rec.Body.Bytes(), &found)
+			assert.Equal(t, order.Token, found.Token)
+			assert.Len(t, found.Lines, 1)
+		})
+	}
+}
@@ -2,24 +2,43 @@ package handlers
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
+	"slices"
 	"strconv"
+	"time"
 
+	"github.com/abdelmounim-dev/go-tshirt/internal/db"
+	apperrors "github.com/abdelmounim-dev/go-tshirt/internal/errors"
 	"github.com/abdelmounim-dev/go-tshirt/internal/models"
+	"github.com/abdelmounim-dev/go-tshirt/internal/service/inventory"
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+// Ways of handling existing variants that are missing from a product update.
+const (
+	missingVariantsArchive = "archive"
+	missingVariantsDelete  = "delete"
+)
+
+// errVariantInUse is returned when deleting a variant that cart lines or
+// stock reservations still refer to.
+var errVariantInUse = &apperrors.ValidationError{Message: "Product variant is in use by carts; archive it instead", Code: "variant_in_use"}
+
 type ProductHandler struct {
-	db       *gorm.DB
-	validate *validator.Validate
+	db        *gorm.DB
+	inventory *inventory.Service
+	validate  *validator.Validate
 }
 
-func NewProductHandler(db *gorm.DB) *ProductHandler {
+func NewProductHandler(db *gorm.DB, inv *inventory.Service) *ProductHandler {
 	return &ProductHandler{
-		db:       db,
-		validate: validator.New(),
+		db:        db,
+		inventory: inv,
+		validate:  validator.New(),
 	}
 }
 
@@ -47,17 +66,23 @@ func (h *ProductHandler) Register(r *gin.RouterGroup) {
 
 func (h *ProductHandler) GetAll(c *gin.Context) {
 	var products []models.Product
-	if err := h.db.Preload("Variants").Find(&products).Error; err != nil {
+	if err := h.db.Preload("Variants", "archived_at IS NULL").Preload("PersonalizationFields").Preload("BundleComponents").Find(&products).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	for i := range products {
+		if err := h.inventory.FillAvailability(h.db, products[i].Variants); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
 	c.JSON(http.StatusOK, products)
 }
 
 func (h *ProductHandler) GetByID(c *gin.Context) {
 	id := c.Param("id")
 	var product models.Product
-	if err := h.db.Preload("Variants").First(&product, id).Error; err != nil {
+	if err := h.db.Preload("Variants", "archived_at IS NULL").Preload("PersonalizationFields").Preload("BundleComponents").First(&product, id).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
 			return
@@ -65,6 +90,10 @@ func (h *ProductHandler) GetByID(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if err := h.inventory.FillAvailability(h.db, product.Variants); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 	c.JSON(http.StatusOK, product)
 }
 
@@ -80,10 +109,34 @@ func (h *ProductHandler) Create(c *gin.Context) {
 		return
 	}
 
-	if err := h.db.Create(&p).Error; err != nil {
+	if err := h.validateBundle(&p); err != nil {
+		var validationErr *apperrors.ValidationError
+		if errors.As(err, &validationErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	requested := p
+	err := db.Transaction(h.db, func(tx *gorm.DB) error {
+		p = cloneProduct(requested)
+		if err := tx.Create(&p).Error; err != nil {
+			return err
+		}
+		for _, v := range p.Variants {
+			if err := h.inventory.RecordInitialStock(tx, v, actor(c)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	h.inventory.CheckLowStock(c.Request.Context(), variantIDs(p.Variants)...)
 	c.JSON(http.StatusCreated, p)
 }
 
@@ -100,6 +153,22 @@ func (h *ProductHandler) Update(c *gin.Context) {
 		return
 	}
 
+	if err := h.validateBundle(&p); err != nil {
+		var validationErr *apperrors.ValidationError
+		if errors.As(err, &validationErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	missing := c.DefaultQuery("missing", missingVariantsArchive)
+	if missing != missingVariantsArchive && missing != missingVariantsDelete {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing must be one of: archive, delete"})
+		return
+	}
+
 	var existingProduct models.Product
 	if err := h.db.First(&existingProduct, id).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
@@ -111,11 +180,69 @@ func (h *ProductHandler) Update(c *gin.Context) {
 	}
 
 	p.ID = existingProduct.ID // Ensure the ID from the URL is used
-	if err := h.db.Save(&p).Error; err != nil {
+	p.CreatedAt = existingProduct.CreatedAt
+
+	var changes variantChanges
+	requested := p
+	err := db.Transaction(h.db, func(tx *gorm.DB) error {
+		p = cloneProduct(requested)
+		changes = variantChanges{Created: []uint{}, Updated: []uint{}, Archived: []uint{}, Deleted: []uint{}}
+		if err := tx.Omit(clause.Associations).Save(&p).Error; err != nil {
+			return err
+		}
+
+		// Variants are only synchronized when the body lists them; an empty
+		// list archives or deletes them all
+		if p.Variants != nil {
+			var err error
+			if changes, err = h.syncVariants(tx, p.ID, p.Variants, missing, actor(c)); err != nil {
+				return err
+			}
+		}
+
+		if p.PersonalizationFields != nil {
+			if err := tx.Where("product_id = ?", p.ID).Delete(&models.PersonalizationField{}).Error; err != nil {
+				return err
+			}
+			for i := range p.PersonalizationFields {
+				p.PersonalizationFields[i].ID = 0
+				p.PersonalizationFields[i].ProductID = p.ID
+			}
+			if len(p.PersonalizationFields) > 0 {
+				if err := tx.Create(&p.PersonalizationFields).Error; err != nil {
+					return err
+				}
+			}
+		}
+
+		if p.BundleComponents != nil {
+			if err := tx.Where("bundle_id = ?", p.ID).Delete(&models.BundleComponent{}).Error; err != nil {
+				return err
+			}
+			for i := range p.BundleComponents {
+				p.BundleComponents[i].ID = 0
+				p.BundleComponents[i].BundleID = p.ID
+			}
+			if len(p.BundleComponents) > 0 {
+				if err := tx.Create(&p.BundleComponents).Error; err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		respondVariantError(c, err)
+		return
+	}
+
+	var updated models.Product
+	if err := h.db.Preload("Variants", "archived_at IS NULL").Preload("PersonalizationFields").Preload("BundleComponents").First(&updated, p.ID).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, p)
+	h.inventory.CheckLowStock(c.Request.Context(), variantIDs(updated.Variants)...)
+	c.JSON(http.StatusOK, productUpdateResponse{Product: updated, VariantChanges: changes})
 }
 
 func (h *ProductHandler) Delete(c *gin.Context) {
@@ -139,6 +266,10 @@ func (h *ProductHandler) GetAllVariants(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if err := h.inventory.FillAvailability(h.db, variants); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 	c.JSON(http.StatusOK, variants)
 }
 
@@ -154,7 +285,12 @@ func (h *ProductHandler) GetVariantByID(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, variant)
+	variants := []models.ProductVariant{variant}
+	if err := h.inventory.FillAvailability(h.db, variants); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, variants[0])
 }
 
 func (h *ProductHandler) CreateVariant(c *gin.Context) {
@@ -178,10 +314,19 @@ func (h *ProductHandler) CreateVariant(c *gin.Context) {
 		return
 	}
 
-	if err := h.db.Create(&variant).Error; err != nil {
+	requested := variant
+	err = db.Transaction(h.db, func(tx *gorm.DB) error {
+		variant = requested
+		if err := tx.Create(&variant).Error; err != nil {
+			return err
+		}
+		return h.inventory.RecordInitialStock(tx, variant, actor(c))
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	h.inventory.CheckLowStock(c.Request.Context(), variant.ID)
 	c.JSON(http.StatusCreated, variant)
 }
 
@@ -211,24 +356,229 @@ func (h *ProductHandler) UpdateVariant(c *gin.Context) {
 
 	variant.ID = existingVariant.ID // Ensure the ID from the URL is used
 	variant.ProductID = existingVariant.ProductID
-	if err := h.db.Save(&variant).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	variant.ArchivedAt = existingVariant.ArchivedAt
+	requested := variant
+	err := db.Transaction(h.db, func(tx *gorm.DB) error {
+		variant = requested
+		return h.saveVariant(tx, &variant, actor(c), "variant update")
+	})
+	if err != nil {
+		respondVariantError(c, err)
 		return
 	}
+	h.inventory.CheckLowStock(c.Request.Context(), variant.ID)
 	c.JSON(http.StatusOK, variant)
 }
 
+// DeleteVariant deletes a variant that no cart refers to. Variants in carts
+// must be archived instead.
 func (h *ProductHandler) DeleteVariant(c *gin.Context) {
 	id := c.Param("variant_id")
 	productId := c.Param("id")
-	result := h.db.Where("id = ? AND product_id = ?", id, productId).Delete(&models.ProductVariant{})
-	if result.Error != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error.Error()})
+	var variant models.ProductVariant
+	if err := h.db.Where("id = ? AND product_id = ?", id, productId).First(&variant).Error; err != nil {
+		respondVariantError(c, err)
 		return
 	}
-	if result.RowsAffected == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Product variant not found"})
+	err := db.Transaction(h.db, func(tx *gorm.DB) error {
+		return deleteVariant(tx, variant)
+	})
+	if err != nil {
+		respondVariantError(c, err)
 		return
 	}
 	c.Status(http.StatusNoContent)
 }
+
+// cloneProduct copies a product along with its nested lists, so a transaction
+// that is retried starts again from the request rather than from the IDs a
+// failed attempt assigned.
+func cloneProduct(p models.Product) models.Product {
+	p.Variants = slices.Clone(p.Variants)
+	p.PersonalizationFields = slices.Clone(p.PersonalizationFields)
+	p.BundleComponents = slices.Clone(p.BundleComponents)
+	return p
+}
+
+// validateBundle defaults the product type and checks that bundles are made of
+// existing simple products and carry no variants of their own. Only bundles
+// may be priced as a discount on their components.
+func (h *ProductHandler) validateBundle(p *models.Product) error {
+	if p.Type == "" {
+		p.Type = models.ProductTypeSimple
+	}
+	if p.Type != models.ProductTypeBundle {
+		if len(p.BundleComponents) > 0 {
+			return &apperrors.ValidationError{Message: "Only bundle products can have components"}
+		}
+		if p.BundleDiscountPercent > 0 {
+			return &apperrors.ValidationError{Message: "Only bundle products can have a bundle discount"}
+		}
+		return nil
+	}
+
+	if len(p.Variants) > 0 {
+		return &apperrors.ValidationError{Message: "Bundle products cannot have variants"}
+	}
+	if len(p.BundleComponents) == 0 {
+		return &apperrors.ValidationError{Message: "Bundle products require at least one component"}
+	}
+	for _, comp := range p.BundleComponents {
+		var component models.Product
+		if err := h.db.First(&component, comp.ComponentProductID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return &apperrors.ValidationError{Message: fmt.Sprintf("Component product %d not found", comp.ComponentProductID)}
+			}
+			return err
+		}
+		if component.Type == models.ProductTypeBundle {
+			return &apperrors.ValidationError{Message: "Bundles cannot contain other bundles"}
+		}
+	}
+	return nil
+}
+
+// variantChanges lists the variant IDs touched by a product update.
+type variantChanges struct {
+	Created  []uint `json:"created"`
+	Updated  []uint `json:"updated"`
+	Archived []uint `json:"archived"`
+	Deleted  []uint `json:"deleted"`
+}
+
+type productUpdateResponse struct {
+	models.Product
+	VariantChanges variantChanges `json:"variant_changes"`
+}
+
+// syncVariants makes the product's variants match the request: variants with an
+// ID are updated, variants without one are created and existing variants that
+// are not mentioned are archived or deleted according to missing. Deleting a
+// variant that carts still refer to fails with errVariantInUse.
+func (h *ProductHandler) syncVariants(tx *gorm.DB, productID uint, variants []models.ProductVariant, missing, actor string) (variantChanges, error) {
+	changes := variantChanges{Created: []uint{}, Updated: []uint{}, Archived: []uint{}, Deleted: []uint{}}
+
+	var existing []models.ProductVariant
+	if err := tx.Where("product_id = ?", productID).Find(&existing).Error; err != nil {
+		return changes, err
+	}
+	current := make(map[uint]models.ProductVariant, len(existing))
+	for _, v := range existing {
+		current[v.ID] = v
+	}
+
+	kept := make(map[uint]bool, len(variants))
+	for i := range variants {
+		v := &variants[i]
+		v.ProductID = productID
+		v.ArchivedAt = nil
+		if v.ID == 0 {
+			if err := tx.Create(v).Error; err != nil {
+				return changes, err
+			}
+			if err := h.inventory.RecordInitialStock(tx, *v, actor); err != nil {
+				return changes, err
+			}
+			changes.Created = append(changes.Created, v.ID)
+			continue
+		}
+
+		if _, ok := current[v.ID]; !ok {
+			return changes, &apperrors.ValidationError{Message: fmt.Sprintf("Variant %d does not belong to this product", v.ID)}
+		}
+		if kept[v.ID] {
+			return changes, &apperrors.ValidationError{Message: fmt.Sprintf("Variant %d is listed more than once", v.ID)}
+		}
+		kept[v.ID] = true
+		if err := h.saveVariant(tx, v, actor, "product update"); err != nil {
+			return changes, err
+		}
+		changes.Updated = append(changes.Updated, v.ID)
+	}
+
+	now := time.Now()
+	for _, v := range existing {
+		if kept[v.ID] {
+			continue
+		}
+		if missing == missingVariantsDelete {
+			if err := deleteVariant(tx, v); err != nil {
+				return changes, err
+			}
+			changes.Deleted = append(changes.Deleted, v.ID)
+			continue
+		}
+		if v.ArchivedAt != nil {
+			continue
+		}
+		if err := tx.Model(&v).Update("archived_at", now).Error; err != nil {
+			return changes, err
+		}
+		changes.Archived = append(changes.Archived, v.ID)
+	}
+	return changes, nil
+}
+
+// saveVariant updates an existing variant. A stock change is not written
+// directly but recorded as an adjustment in the inventory ledger.
+func (h *ProductHandler) saveVariant(tx *gorm.DB, variant *models.ProductVariant, actor, reason string) error {
+	stock := variant.Stock
+	if err := tx.Omit("stock").Save(variant).Error; err != nil {
+		return err
+	}
+	_, err := h.inventory.SetStock(tx, variant.ID, stock, models.InventoryMovement{
+		Type:   models.MovementAdjustment,
+		Reason: reason,
+		Actor:  actor,
+	})
+	return err
+}
+
+// deleteVariant deletes a variant unless a cart line, bundle selection or
+// stock reservation refers to it, in which case it returns errVariantInUse.
+func deleteVariant(tx *gorm.DB, variant models.ProductVariant) error {
+	for _, model := range []interface{}{&models.CartItem{}, &models.BundleSelection{}, &models.StockReservation{}} {
+		var n int64
+		if err := tx.Model(model).Where("product_variant_id = ?", variant.ID).Count(&n).Error; err != nil {
+			return err
+		}
+		if n > 0 {
+			return errVariantInUse
+		}
+	}
+	return tx.Delete(&variant).Error
+}
+
+// respondVariantError responds with the status for an error from changing a
+// product's variants: conflicts with stock or carts are 409, invalid changes
+// 400 and unknown variants 404.
+func respondVariantError(c *gin.Context, err error) {
+	var validationErr *apperrors.ValidationError
+	var notFoundErr *apperrors.NotFoundError
+	switch {
+	case errors.As(err, &validationErr):
+		status := http.StatusBadRequest
+		if errors.Is(err, inventory.ErrInsufficientStock) || errors.Is(err, errVariantInUse) {
+			status = http.StatusConflict
+		}
+		body := gin.H{"error": err.Error()}
+		if validationErr.Code != "" {
+			body["code"] = validationErr.Code
+		}
+		c.JSON(status, body)
+	case errors.As(err, &notFoundErr):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product variant not found"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+func variantIDs(variants []models.ProductVariant) []uint {
+	ids := make([]uint, len(variants))
+	for i, v := range variants {
+		ids[i] = v.ID
+	}
+	return ids
+}
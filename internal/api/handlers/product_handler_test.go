@@ -10,6 +10,7 @@ import (
 	"testing"
 
 	"github.com/abdelmounim-dev/go-tshirt/internal/models"
+	"github.com/abdelmounim-dev/go-tshirt/internal/service/inventory"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 	"gorm.io/driver/sqlite"
@@ -19,7 +20,7 @@ import (
 func setupTestDB(t *testing.T) *gorm.DB {
 	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
 	assert.NoError(t, err)
-	err = db.AutoMigrate(&models.Product{}, &models.ProductVariant{})
+	err = db.AutoMigrate(&models.Product{}, &models.ProductVariant{}, &models.PersonalizationField{}, &models.BundleComponent{}, &models.CartItem{}, &models.BundleSelection{}, &models.StockReservation{}, &models.Backorder{}, &models.InventoryMovement{}, &models.Location{}, &models.StockLevel{}, &models.StockSubscription{}, &models.OutboxMessage{})
 	assert.NoError(t, err)
 	return db
 }
@@ -43,7 +44,7 @@ func TestProductHandler_Create(t *testing.T) {
 			name:         "should return 400 when price is zero",
 			product:      models.Product{Name: "T-shirt", Price: 0},
 			expectedCode: http.StatusBadRequest,
-			expectedBody: `{"error":"Key: 'Product.Price' Error:Field validation for 'Price' failed on the 'required' tag"}`,
+			expectedBody: `{"error":"Key: 'Product.Price' Error:Field validation for 'Price' failed on the 'required_without' tag"}`,
 		},
 		{
 			name:         "should return 400 when variant color is empty",
@@ -57,6 +58,30 @@ func TestProductHandler_Create(t *testing.T) {
 			expectedCode: http.StatusBadRequest,
 			expectedBody: `{"error":"Key: 'Product.Variants[0].Size' Error:Field validation for 'Size' failed on the 'required' tag"}`,
 		},
+		{
+			name:         "should return 400 when a preorder variant has no expected ship date",
+			product:      models.Product{Name: "T-shirt", Price: 10, Variants: []models.ProductVariant{{Color: "Black", Size: "M", InventoryPolicy: models.InventoryPolicyPreorder}}},
+			expectedCode: http.StatusBadRequest,
+			expectedBody: `{"error":"Key: 'Product.Variants[0].ExpectedShipDate' Error:Field validation for 'ExpectedShipDate' failed on the 'required_if' tag"}`,
+		},
+		{
+			name:         "should return 400 when bundle has no components",
+			product:      models.Product{Name: "3-pack", Price: 50, Type: models.ProductTypeBundle},
+			expectedCode: http.StatusBadRequest,
+			expectedBody: `{"error":"Bundle products require at least one component"}`,
+		},
+		{
+			name:         "should return 400 when bundle component does not exist",
+			product:      models.Product{Name: "3-pack", Price: 50, Type: models.ProductTypeBundle, BundleComponents: []models.BundleComponent{{ComponentProductID: 999, Quantity: 3}}},
+			expectedCode: http.StatusBadRequest,
+			expectedBody: `{"error":"Component product 999 not found"}`,
+		},
+		{
+			name:         "should return 400 when a simple product has a bundle discount",
+			product:      models.Product{Name: "T-shirt", BundleDiscountPercent: 10},
+			expectedCode: http.StatusBadRequest,
+			expectedBody: `{"error":"Only bundle products can have a bundle discount"}`,
+		},
 		{
 			name:         "should return 201 when product is created successfully",
 			product:      models.Product{Name: "T-shirt", Price: 10},
@@ -67,7 +92,7 @@ func TestProductHandler_Create(t *testing.T) {
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			db := setupTestDB(t)
-			handler := NewProductHandler(db)
+			handler := NewProductHandler(db, inventory.NewService(db, inventory.Options{}))
 			router := gin.Default()
 			api := router.Group("/api")
 			handler.Register(api)
@@ -100,6 +125,33 @@ func TestProductHandler_Create(t *testing.T) {
 	}
 }
 
+func TestProductHandler_CreateDiscountBundle(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	db := setupTestDB(t)
+	handler := NewProductHandler(db, inventory.NewService(db, inventory.Options{}))
+	router := gin.Default()
+	api := router.Group("/api")
+	handler.Register(api)
+
+	tee := models.Product{Name: "T-shirt", Price: 20}
+	db.Create(&tee)
+
+	// A bundle priced as a discount on its components needs no price
+	bundle := models.Product{Name: "2-pack", Type: models.ProductTypeBundle, BundleDiscountPercent: 10, BundleComponents: []models.BundleComponent{{ComponentProductID: tee.ID, Quantity: 2}}}
+	body, _ := json.Marshal(bundle)
+	req, _ := http.NewRequest(http.MethodPost, "/api/products", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	var created models.Product
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &created))
+	assert.Equal(t, float64(0), created.Price)
+	assert.Equal(t, float64(10), created.BundleDiscountPercent)
+}
+
 func TestProductHandler_Update(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
@@ -133,7 +185,7 @@ func TestProductHandler_Update(t *testing.T) {
 				return p.ID
 			},
 			expectedCode: http.StatusBadRequest,
-			expectedBody: `{"error":"Key: 'Product.Price' Error:Field validation for 'Price' failed on the 'required' tag"}`,
+			expectedBody: `{"error":"Key: 'Product.Price' Error:Field validation for 'Price' failed on the 'required_without' tag"}`,
 		},
 		{
 			name:      "should return 400 when variant color is empty",
@@ -184,7 +236,7 @@ func TestProductHandler_Update(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			db := setupTestDB(t)
 			productID := tc.setupDB(db)
-			handler := NewProductHandler(db)
+			handler := NewProductHandler(db, inventory.NewService(db, inventory.Options{}))
 			router := gin.Default()
 			api := router.Group("/api")
 			handler.Register(api)
@@ -221,12 +273,167 @@ func TestProductHandler_Update(t *testing.T) {
 	}
 }
 
+func TestProductHandler_UpdateSyncsVariants(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	testCases := []struct {
+		name             string
+		query            string
+		inCart           bool
+		expectedCode     int
+		expectedArchived int
+		expectedDeleted  int
+	}{
+		{
+			name:             "should archive variants missing from the update by default",
+			expectedCode:     http.StatusOK,
+			expectedArchived: 1,
+		},
+		{
+			name:            "should delete variants missing from the update when requested",
+			query:           "?missing=delete",
+			expectedCode:    http.StatusOK,
+			expectedDeleted: 1,
+		},
+		{
+			name:         "should return 409 when deleting a variant that is in a cart",
+			query:        "?missing=delete",
+			inCart:       true,
+			expectedCode: http.StatusConflict,
+		},
+		{
+			name:         "should return 400 for an unknown missing mode",
+			query:        "?missing=ignore",
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db := setupTestDB(t)
+			handler := NewProductHandler(db, inventory.NewService(db, inventory.Options{}))
+			router := gin.Default()
+			api := router.Group("/api")
+			handler.Register(api)
+
+			product := models.Product{Name: "T-shirt", Price: 20, Variants: []models.ProductVariant{
+				{Color: "Black", Size: "M", Stock: 10},
+				{Color: "White", Size: "L", Stock: 5},
+			}}
+			db.Create(&product)
+			kept, dropped := product.Variants[0], product.Variants[1]
+			if tc.inCart {
+				db.Create(&models.CartItem{CartID: 1, ProductVariantID: dropped.ID, Quantity: 1})
+			}
+
+			update := models.Product{Name: "T-shirt", Price: 25, Variants: []models.ProductVariant{
+				{ID: kept.ID, Color: "Black", Size: "M", Stock: 8},
+				{Color: "Red", Size: "S", Stock: 3},
+			}}
+			body, _ := json.Marshal(update)
+			req, _ := http.NewRequest(http.MethodPut, "/api/products/"+strconv.Itoa(int(product.ID))+tc.query, bytes.NewBuffer(body))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+
+			router.ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.expectedCode, rec.Code)
+			if tc.expectedCode == http.StatusConflict {
+				// Nothing is changed, so the cart line still resolves
+				var variants []models.ProductVariant
+				db.Where("product_id = ?", product.ID).Order("id").Find(&variants)
+				assert.Equal(t, []uint{kept.ID, dropped.ID}, variantIDs(variants))
+				assert.Equal(t, uint(10), variants[0].Stock)
+			}
+			if tc.expectedCode != http.StatusOK {
+				return
+			}
+
+			var resp productUpdateResponse
+			err := json.Unmarshal(rec.Body.Bytes(), &resp)
+			assert.NoError(t, err)
+			assert.Equal(t, []uint{kept.ID}, resp.VariantChanges.Updated)
+			assert.Len(t, resp.VariantChanges.Created, 1)
+			assert.Len(t, resp.VariantChanges.Archived, tc.expectedArchived)
+			assert.Len(t, resp.VariantChanges.Deleted, tc.expectedDeleted)
+			assert.Len(t, resp.Variants, 2)
+
+			var variants []models.ProductVariant
+			db.Where("product_id = ?", product.ID).Order("id").Find(&variants)
+			assert.Len(t, variants, 2+tc.expectedArchived)
+			assert.Equal(t, uint(8), variants[0].Stock)
+
+			var droppedVariant models.ProductVariant
+			err = db.First(&droppedVariant, dropped.ID).Error
+			if tc.expectedArchived > 0 {
+				assert.NoError(t, err)
+				assert.NotNil(t, droppedVariant.ArchivedAt)
+			} else {
+				assert.True(t, errors.Is(err, gorm.ErrRecordNotFound))
+			}
+		})
+	}
+}
+
+func TestProductHandler_UpdateWithoutVariants(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	testCases := []struct {
+		name             string
+		body             string
+		expectedArchived int
+	}{
+		{
+			name:             "should leave variants alone when the body has no variants key",
+			body:             `{"name": "T-shirt", "price": 25}`,
+			expectedArchived: 0,
+		},
+		{
+			name:             "should archive every variant for an empty variants list",
+			body:             `{"name": "T-shirt", "price": 25, "variants": []}`,
+			expectedArchived: 2,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db := setupTestDB(t)
+			handler := NewProductHandler(db, inventory.NewService(db, inventory.Options{}))
+			router := gin.Default()
+			api := router.Group("/api")
+			handler.Register(api)
+
+			product := models.Product{Name: "T-shirt", Price: 20, Variants: []models.ProductVariant{
+				{Color: "Black", Size: "M", Stock: 10},
+				{Color: "White", Size: "L", Stock: 5},
+			}}
+			db.Create(&product)
+
+			req, _ := http.NewRequest(http.MethodPut, "/api/products/"+strconv.Itoa(int(product.ID)), bytes.NewBufferString(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			assert.Equal(t, http.StatusOK, rec.Code)
+
+			var resp productUpdateResponse
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+			assert.Equal(t, 25.0, resp.Price)
+			assert.Len(t, resp.VariantChanges.Archived, tc.expectedArchived)
+			assert.Len(t, resp.Variants, 2-tc.expectedArchived)
+
+			var archived int64
+			db.Model(&models.ProductVariant{}).Where("archived_at IS NOT NULL").Count(&archived)
+			assert.Equal(t, int64(tc.expectedArchived), archived)
+		})
+	}
+}
+
 func TestProductHandler_GetAll(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
 	t.Run("should return 200 with products and variants", func(t *testing.T) {
 		db := setupTestDB(t)
-		handler := NewProductHandler(db)
+		handler := NewProductHandler(db, inventory.NewService(db, inventory.Options{}))
 		router := gin.Default()
 		api := router.Group("/api")
 		handler.Register(api)
@@ -252,7 +459,7 @@ func TestProductHandler_GetAll(t *testing.T) {
 
 	t.Run("should return empty array if no products", func(t *testing.T) {
 		db := setupTestDB(t)
-		handler := NewProductHandler(db)
+		handler := NewProductHandler(db, inventory.NewService(db, inventory.Options{}))
 		router := gin.Default()
 		api := router.Group("/api")
 		handler.Register(api)
@@ -301,7 +508,7 @@ func TestProductHandler_GetByID(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			db := setupTestDB(t)
 			productID := tc.setupDB(db)
-			handler := NewProductHandler(db)
+			handler := NewProductHandler(db, inventory.NewService(db, inventory.Options{}))
 			router := gin.Default()
 			api := router.Group("/api")
 			handler.Register(api)
@@ -365,7 +572,7 @@ func TestProductHandler_Delete(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			db := setupTestDB(t)
 			productID := tc.setupDB(db)
-			handler := NewProductHandler(db)
+			handler := NewProductHandler(db, inventory.NewService(db, inventory.Options{}))
 			router := gin.Default()
 			api := router.Group("/api")
 			handler.Register(api)
@@ -398,7 +605,7 @@ func TestProductHandler_Delete(t *testing.T) {
 func TestProductHandler_GetAllVariants(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 	db := setupTestDB(t)
-	handler := NewProductHandler(db)
+	handler := NewProductHandler(db, inventory.NewService(db, inventory.Options{}))
 	router := gin.Default()
 	api := router.Group("/api")
 	handler.Register(api)
@@ -423,7 +630,7 @@ func TestProductHandler_GetAllVariants(t *testing.T) {
 func TestProductHandler_GetVariantByID(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 	db := setupTestDB(t)
-	handler := NewProductHandler(db)
+	handler := NewProductHandler(db, inventory.NewService(db, inventory.Options{}))
 	router := gin.Default()
 	api := router.Group("/api")
 	handler.Register(api)
@@ -447,7 +654,7 @@ func TestProductHandler_GetVariantByID(t *testing.T) {
 func TestProductHandler_CreateVariant(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 	db := setupTestDB(t)
-	handler := NewProductHandler(db)
+	handler := NewProductHandler(db, inventory.NewService(db, inventory.Options{}))
 	router := gin.Default()
 	api := router.Group("/api")
 	handler.Register(api)
@@ -476,7 +683,7 @@ func TestProductHandler_CreateVariant(t *testing.T) {
 func TestProductHandler_UpdateVariant(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 	db := setupTestDB(t)
-	handler := NewProductHandler(db)
+	handler := NewProductHandler(db, inventory.NewService(db, inventory.Options{}))
 	router := gin.Default()
 	api := router.Group("/api")
 	handler.Register(api)
@@ -507,7 +714,7 @@ func TestProductHandler_UpdateVariant(t *testing.T) {
 func TestProductHandler_DeleteVariant(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 	db := setupTestDB(t)
-	handler := NewProductHandler(db)
+	handler := NewProductHandler(db, inventory.NewService(db, inventory.Options{}))
 	router := gin.Default()
 	api := router.Group("/api")
 	handler.Register(api)
@@ -526,4 +733,18 @@ func TestProductHandler_DeleteVariant(t *testing.T) {
 	err := db.First(&deletedVariant, variant.ID).Error
 	assert.Error(t, err)
 	assert.True(t, errors.Is(err, gorm.ErrRecordNotFound))
+
+	t.Run("should return 409 for a variant that is in a cart", func(t *testing.T) {
+		inCart := models.ProductVariant{ProductID: product.ID, Color: "White", Size: "M", Stock: 10}
+		db.Create(&inCart)
+		db.Create(&models.CartItem{CartID: 1, ProductVariantID: inCart.ID, Quantity: 1})
+
+		req, _ := http.NewRequest(http.MethodDelete, "/api/products/"+strconv.Itoa(int(product.ID))+"/variants/"+strconv.Itoa(int(inCart.ID)), nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusConflict, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"code":"variant_in_use"`)
+		assert.NoError(t, db.First(&models.ProductVariant{}, inCart.ID).Error)
+	})
 }
\ No newline at end of file
@@ -30,7 +30,7 @@ func (h *RecommendationHandler) GetRecommendations(c *gin.Context) {
 	}
 
 	var products []models.Product
-	if err := h.db.Joins("JOIN product_variants ON product_variants.product_id = products.id").Where("product_variants.color = ?", color).Find(&products).Error; err != nil {
+	if err := h.db.Joins("JOIN product_variants ON product_variants.product_id = products.id").Where("product_variants.color = ? AND product_variants.archived_at IS NULL", color).Find(&products).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -0,0 +1,245 @@
+// Package middleware holds Gin middleware shared by the API routes.
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/abdelmounim-dev/go-tshirt/internal/models"
+	"github.com/abdelmounim-dev/go-tshirt/internal/service/carts"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// IdempotencyHeader is the request header carrying the client's key.
+const IdempotencyHeader = "Idempotency-Key"
+
+// ReplayedHeader is set on responses replayed from an earlier request.
+const ReplayedHeader = "Idempotent-Replayed"
+
+// DefaultIdempotencyTTL is used when no window is configured.
+const DefaultIdempotencyTTL = 24 * time.Hour
+
+// maxKeyLength bounds the keys clients may send.
+const maxKeyLength = 255
+
+// maxBodyBytes bounds the request bodies read to fingerprint a request. It
+// leaves room for the largest upload, a mockup image, and its form fields.
+const maxBodyBytes = 16 << 20
+
+// replayedHeaders are the response headers stored for replays. Cookies are
+// never replayed, as they belong to the caller that first received them.
+var replayedHeaders = []string{"Content-Type"}
+
+// Idempotency makes POST, PATCH and DELETE requests carrying an
+// Idempotency-Key header safe to retry. The first request with a key is
+// processed and its response stored; repeats within the window get the stored
+// response instead of running again. Keys are scoped to the caller, identified
+// by their cart cookie or else their address, and to the method and path, so
+// one caller's key never replays another's response. Reusing a key for a
+// different request is rejected.
+type Idempotency struct {
+	db  *gorm.DB
+	ttl time.Duration
+}
+
+// NewIdempotency returns a middleware keeping keys for ttl.
+func NewIdempotency(db *gorm.DB, ttl time.Duration) *Idempotency {
+	if ttl <= 0 {
+		ttl = DefaultIdempotencyTTL
+	}
+	return &Idempotency{db: db, ttl: ttl}
+}
+
+// Handler returns the Gin middleware.
+func (m *Idempotency) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(IdempotencyHeader)
+		switch c.Request.Method {
+		case http.MethodPost, http.MethodPatch, http.MethodDelete:
+		default:
+			key = ""
+		}
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > maxKeyLength {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key is too long"})
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxBodyBytes))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Request body is too large"})
+				return
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		scope := scope(c)
+		fingerprint := fingerprint(scope, c.Request, body)
+
+		record, claimed, err := m.claim(scopedKey(scope, key), fingerprint)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !claimed {
+			m.replay(c, record, fingerprint)
+			return
+		}
+
+		// Release the key unless the response is stored, so that a request
+		// whose handler panicked, failed on the server or could not be
+		// recorded can be retried instead of being refused as in progress
+		stored := false
+		defer func() {
+			if stored {
+				return
+			}
+			if err := m.db.Delete(&record).Error; err != nil {
+				log.Printf("Failed to release idempotency key: %v", err)
+			}
+		}()
+
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		c.Next()
+
+		// Server errors are not stored so the client can retry
+		status := recorder.Status()
+		if status >= http.StatusInternalServerError {
+			return
+		}
+		header := http.Header{}
+		for _, name := range replayedHeaders {
+			if values := recorder.Header().Values(name); len(values) > 0 {
+				header[name] = values
+			}
+		}
+		err = m.db.Model(&record).Updates(models.IdempotencyKey{StatusCode: status, Header: header, Body: recorder.body.Bytes()}).Error
+		if err != nil {
+			log.Printf("Failed to store idempotent response: %v", err)
+			return
+		}
+		stored = true
+	}
+}
+
+// claim records key as being processed for the request with fingerprint. It
+// returns false with the existing record when the key is already in use.
+func (m *Idempotency) claim(key, fingerprint string) (models.IdempotencyKey, bool, error) {
+	now := time.Now()
+	// An expired key is free to use again
+	if err := m.db.Where("key = ? AND expires_at <= ?", key, now).Delete(&models.IdempotencyKey{}).Error; err != nil {
+		return models.IdempotencyKey{}, false, err
+	}
+
+	record := models.IdempotencyKey{Key: key, Fingerprint: fingerprint, ExpiresAt: now.Add(m.ttl)}
+	result := m.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&record)
+	if result.Error != nil {
+		return record, false, result.Error
+	}
+	if result.RowsAffected == 1 {
+		return record, true, nil
+	}
+	var existing models.IdempotencyKey
+	err := m.db.Where("key = ?", key).First(&existing).Error
+	return existing, false, err
+}
+
+// replay answers a request whose key is already in use.
+func (m *Idempotency) replay(c *gin.Context, record models.IdempotencyKey, fingerprint string) {
+	if record.Fingerprint != fingerprint {
+		c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key was already used for a different request"})
+		return
+	}
+	if record.StatusCode == 0 {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "A request with this Idempotency-Key is still being processed"})
+		return
+	}
+	for name, values := range record.Header {
+		for _, v := range values {
+			c.Writer.Header().Add(name, v)
+		}
+	}
+	c.Writer.Header().Set(ReplayedHeader, "true")
+	c.Status(record.StatusCode)
+	c.Writer.Write(record.Body)
+	c.Abort()
+}
+
+// DeleteExpired deletes keys whose window has passed.
+func (m *Idempotency) DeleteExpired() error {
+	return m.db.Where("expires_at <= ?", time.Now()).Delete(&models.IdempotencyKey{}).Error
+}
+
+// RunSweeper deletes expired keys every interval until ctx is done.
+func (m *Idempotency) RunSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.DeleteExpired(); err != nil {
+				log.Printf("Failed to delete expired idempotency keys: %v", err)
+			}
+		}
+	}
+}
+
+// scope identifies who is making a request and to which endpoint: the
+// caller's cart cookie, or their address when they have none, along with the
+// method and path.
+func scope(c *gin.Context) string {
+	caller, err := c.Cookie(carts.CookieName)
+	if err != nil || caller == "" {
+		caller = "ip:" + c.ClientIP()
+	}
+	h := sha256.New()
+	io.WriteString(h, caller+"\n"+c.Request.Method+" "+c.Request.URL.Path)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// scopedKey is the key stored for a client's key within scope.
+func scopedKey(scope, key string) string {
+	return scope + ":" + key
+}
+
+// fingerprint identifies a request by its scope, method, URL and body.
+func fingerprint(scope string, r *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, scope+"\n"+r.Method+" "+r.URL.RequestURI()+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// responseRecorder keeps a copy of the response body as it is written.
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *responseRecorder) WriteString(s string) (int, error) {
+	r.body.WriteString(s)
+	return r.ResponseWriter.WriteString(s)
+}
@@ -0,0 +1,200 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abdelmounim-dev/go-tshirt/internal/models"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestIdempotency(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// setup returns a router whose routes count how often they run. The
+	// failing route answers 500 and the panicking route panics until they have
+	// run twice.
+	setup := func(t *testing.T) (*gorm.DB, *gin.Engine, *int) {
+		db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+		assert.NoError(t, err)
+		assert.NoError(t, db.AutoMigrate(&models.IdempotencyKey{}))
+
+		calls := 0
+		count := func(c *gin.Context) {
+			calls++
+			http.SetCookie(c.Writer, &http.Cookie{Name: "cart_token", Value: "abc"})
+			c.JSON(http.StatusCreated, gin.H{"calls": calls})
+		}
+		router := gin.Default()
+		router.Use(NewIdempotency(db, time.Hour).Handler())
+		router.POST("/items", count)
+		router.GET("/items", count)
+		router.POST("/flaky", func(c *gin.Context) {
+			calls++
+			if calls < 2 {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "boom"})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"calls": calls})
+		})
+		router.POST("/panicky", func(c *gin.Context) {
+			calls++
+			if calls < 2 {
+				panic("boom")
+			}
+			c.JSON(http.StatusOK, gin.H{"calls": calls})
+		})
+		return db, router, &calls
+	}
+
+	// sendAs sends a request carrying cookie, if any, as the caller's cart
+	// cookie.
+	sendAs := func(router *gin.Engine, cookie, method, path, key, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		if key != "" {
+			req.Header.Set(IdempotencyHeader, key)
+		}
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "cart_token", Value: cookie})
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	send := func(router *gin.Engine, method, path, key, body string) *httptest.ResponseRecorder {
+		return sendAs(router, "", method, path, key, body)
+	}
+
+	t.Run("should replay the stored response for a repeated request", func(t *testing.T) {
+		_, router, calls := setup(t)
+
+		first := send(router, http.MethodPost, "/items", "key-1", `{"quantity": 1}`)
+		second := send(router, http.MethodPost, "/items", "key-1", `{"quantity": 1}`)
+		assert.Equal(t, 1, *calls)
+		assert.Equal(t, http.StatusCreated, second.Code)
+		assert.Equal(t, first.Body.String(), second.Body.String())
+		assert.Equal(t, "true", second.Header().Get(ReplayedHeader))
+		assert.Empty(t, first.Header().Get(ReplayedHeader))
+		assert.Equal(t, first.Header().Get("Content-Type"), second.Header().Get("Content-Type"))
+		assert.NotEmpty(t, first.Header().Get("Set-Cookie"))
+		assert.Empty(t, second.Header().Get("Set-Cookie"))
+	})
+
+	t.Run("should keep each caller's keys apart", func(t *testing.T) {
+		_, router, calls := setup(t)
+
+		first := sendAs(router, "first", http.MethodPost, "/items", "1", "")
+		second := sendAs(router, "second", http.MethodPost, "/items", "1", "")
+		anonymous := send(router, http.MethodPost, "/items", "1", "")
+		assert.Equal(t, 3, *calls)
+		assert.Equal(t, `{"calls":1}`, first.Body.String())
+		assert.Equal(t, `{"calls":2}`, second.Body.String())
+		assert.Equal(t, `{"calls":3}`, anonymous.Body.String())
+		assert.Empty(t, second.Header().Get(ReplayedHeader))
+
+		rec := sendAs(router, "second", http.MethodPost, "/items", "1", "")
+		assert.Equal(t, `{"calls":2}`, rec.Body.String())
+		assert.Equal(t, "true", rec.Header().Get(ReplayedHeader))
+		assert.Equal(t, 3, *calls)
+	})
+
+	t.Run("should reject bodies over the size limit", func(t *testing.T) {
+		_, router, calls := setup(t)
+
+		rec := send(router, http.MethodPost, "/items", "key-1", strings.Repeat("x", maxBodyBytes+1))
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+		assert.Equal(t, 0, *calls)
+	})
+
+	t.Run("should reject a key reused for a different request", func(t *testing.T) {
+		_, router, calls := setup(t)
+
+		send(router, http.MethodPost, "/items", "key-1", `{"quantity": 1}`)
+		rec := send(router, http.MethodPost, "/items", "key-1", `{"quantity": 2}`)
+		assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+		assert.Equal(t, 1, *calls)
+	})
+
+	t.Run("should reject a repeat while the first request is in progress", func(t *testing.T) {
+		db, router, calls := setup(t)
+
+		rec := send(router, http.MethodPost, "/items", "key-1", `{}`)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		db.Model(&models.IdempotencyKey{}).Where("1 = 1").Update("status_code", 0)
+
+		rec = send(router, http.MethodPost, "/items", "key-1", `{}`)
+		assert.Equal(t, http.StatusConflict, rec.Code)
+		assert.Equal(t, 1, *calls)
+	})
+
+	t.Run("should run requests without a key or with other keys", func(t *testing.T) {
+		_, router, calls := setup(t)
+
+		send(router, http.MethodPost, "/items", "", `{}`)
+		send(router, http.MethodPost, "/items", "", `{}`)
+		send(router, http.MethodPost, "/items", "key-1", `{}`)
+		send(router, http.MethodPost, "/items", "key-2", `{}`)
+		send(router, http.MethodGet, "/items", "key-3", "")
+		send(router, http.MethodGet, "/items", "key-3", "")
+		assert.Equal(t, 6, *calls)
+	})
+
+	t.Run("should let a request that failed on the server be retried", func(t *testing.T) {
+		_, router, calls := setup(t)
+
+		rec := send(router, http.MethodPost, "/flaky", "key-1", `{}`)
+		assert.Equal(t, http.StatusInternalServerError, rec.Code)
+		rec = send(router, http.MethodPost, "/flaky", "key-1", `{}`)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		rec = send(router, http.MethodPost, "/flaky", "key-1", `{}`)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, 2, *calls)
+	})
+
+	t.Run("should let a request whose handler panicked be retried", func(t *testing.T) {
+		db, router, calls := setup(t)
+
+		rec := send(router, http.MethodPost, "/panicky", "key-1", `{}`)
+		assert.Equal(t, http.StatusInternalServerError, rec.Code)
+		var keys int64
+		db.Model(&models.IdempotencyKey{}).Count(&keys)
+		assert.Equal(t, int64(0), keys)
+
+		rec = send(router, http.MethodPost, "/panicky", "key-1", `{}`)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, 2, *calls)
+	})
+
+	t.Run("should forget keys once they expire", func(t *testing.T) {
+		db, router, calls := setup(t)
+
+		send(router, http.MethodPost, "/items", "key-1", `{}`)
+		send(router, http.MethodPost, "/items", "key-2", `{}`)
+		db.Model(&models.IdempotencyKey{}).Where("1 = 1").Update("expires_at", time.Now().Add(-time.Minute))
+
+		rec := send(router, http.MethodPost, "/items", "key-1", `{}`)
+		assert.Equal(t, `{"calls":3}`, rec.Body.String())
+		assert.Equal(t, 3, *calls)
+
+		assert.NoError(t, NewIdempotency(db, time.Hour).DeleteExpired())
+		var keys []string
+		db.Model(&models.IdempotencyKey{}).Pluck("key", &keys)
+		if assert.Len(t, keys, 1) {
+			assert.True(t, strings.HasSuffix(keys[0], ":key-1"))
+		}
+	})
+
+	t.Run("should reject overlong keys", func(t *testing.T) {
+		_, router, calls := setup(t)
+
+		rec := send(router, http.MethodPost, "/items", strings.Repeat("k", maxKeyLength+1), `{}`)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Equal(t, 0, *calls)
+	})
+}
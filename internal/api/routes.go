@@ -1,29 +1,68 @@
 package api
 
 import (
+	"log"
+
 	"github.com/abdelmounim-dev/go-tshirt/internal/api/handlers"
+	"github.com/abdelmounim-dev/go-tshirt/internal/api/middleware"
+	"github.com/abdelmounim-dev/go-tshirt/internal/config"
 	"github.com/abdelmounim-dev/go-tshirt/internal/models"
+	"github.com/abdelmounim-dev/go-tshirt/internal/service/carts"
+	"github.com/abdelmounim-dev/go-tshirt/internal/service/inventory"
+	"github.com/abdelmounim-dev/go-tshirt/internal/service/orders"
+	"github.com/abdelmounim-dev/go-tshirt/internal/service/pricing"
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
 
-func SetupRouter(db *gorm.DB) *gin.Engine {
+func SetupRouter(db *gorm.DB, cfg config.Config, inv *inventory.Service, cartService *carts.Service, idempotency *middleware.Idempotency) *gin.Engine {
 	r := gin.Default()
 
 	// Auto-migrate models
-	db.AutoMigrate(&models.Product{}, &models.ProductVariant{}, &models.Cart{}, &models.CartItem{})
+	db.AutoMigrate(&models.Product{}, &models.ProductVariant{}, &models.PersonalizationField{}, &models.BundleComponent{}, &models.Cart{}, &models.CartItem{}, &models.BundleSelection{}, &models.CartShare{}, &models.StockReservation{}, &models.Backorder{}, &models.InventoryMovement{}, &models.Location{}, &models.StockLevel{}, &models.LowStockAlert{}, &models.OutboxMessage{}, &models.StockSubscription{}, &models.MockupTemplate{}, &models.Mockup{}, &models.IdempotencyKey{}, &models.Order{}, &models.OrderLine{})
+
+	// Give stock that predates the inventory ledger an opening balance
+	if err := inv.BackfillOpeningBalances(); err != nil {
+		log.Printf("Failed to backfill inventory opening balances: %v", err)
+	}
+
+	// Give carts created before tokens were introduced a token
+	if err := cartService.BackfillTokens(); err != nil {
+		log.Printf("Failed to backfill cart tokens: %v", err)
+	}
 
 	// Setup routes
 	api := r.Group("/api")
+	api.Use(idempotency.Handler())
 	{
-		productHandler := handlers.NewProductHandler(db)
+		productHandler := handlers.NewProductHandler(db, inv)
 		productHandler.Register(api)
 
-		cartHandler := handlers.NewCartHandler(db)
+		prices := pricing.New(pricing.Options{
+			ShippingRate:          cfg.ShippingRate,
+			FreeShippingThreshold: cfg.FreeShippingThreshold,
+			TaxRate:               cfg.TaxRate,
+		})
+		cartHandler := handlers.NewCartHandler(db, inv, prices, cartService)
 		cartHandler.Register(api)
 
+		orderHandler := handlers.NewOrderHandler(db, inv, cartService, orders.NewService(inv, cartService, prices, orders.Options{CustomerLimitWindow: cfg.CustomerLimitWindow}))
+		orderHandler.Register(api)
+
 		recommendationHandler := handlers.NewRecommendationHandler(db)
 		recommendationHandler.Register(api)
+
+		inventoryHandler := handlers.NewInventoryHandler(db, inv)
+		inventoryHandler.Register(api)
+
+		locationHandler := handlers.NewLocationHandler(db, inv)
+		locationHandler.Register(api)
+
+		mockupHandler := handlers.NewMockupHandler(db, cfg.MockupDir, cfg.MerchantKey)
+		if err := mockupHandler.BackfillTokens(); err != nil {
+			log.Printf("Failed to backfill mockup tokens: %v", err)
+		}
+		mockupHandler.Register(api)
 	}
 
 	return r
@@ -1,13 +1,80 @@
 package config
 
+import "time"
+
 type Config struct {
-	DBPath        string
-	ServerAddress string
+	DBPath                   string
+	ServerAddress            string
+	MockupDir                string
+	ReservationTTL           time.Duration
+	ReservationSweepInterval time.Duration
+	// LowStockNotifier selects how low-stock alerts are sent: "log",
+	// "webhook" or "email" (queued in the outbox).
+	LowStockNotifier   string
+	LowStockWebhookURL string
+	LowStockEmail      string
+	// BackInStockCooldown is the minimum time between two rounds of
+	// back-in-stock notifications for the same variant.
+	BackInStockCooldown time.Duration
+	// OutboxInterval is how often queued webhook messages are delivered.
+	OutboxInterval time.Duration
+	// ShippingRate, FreeShippingThreshold and TaxRate drive cart pricing.
+	// TaxRate is a fraction, e.g. 0.2 for 20%.
+	ShippingRate          float64
+	FreeShippingThreshold float64
+	TaxRate               float64
+	// CartIdleTTL is how long a cart lives after it was last accessed;
+	// CartSweepInterval is how often expired carts are deleted.
+	CartIdleTTL       time.Duration
+	CartSweepInterval time.Duration
+	// CartCookieSecret signs the cart_token cookie issued with new carts.
+	// No cookie is issued when it is empty.
+	CartCookieSecret string
+	// CartMaxLineQuantity caps the quantity of a single cart line. Zero means
+	// no limit.
+	CartMaxLineQuantity uint
+	// CartMaxQuantity caps the total quantity of a cart and CartMaxLines the
+	// number of its lines. Zero means no limit.
+	CartMaxQuantity uint
+	CartMaxLines    uint
+	// CartShareTTL is how long a shared cart link works unless the sharer
+	// asks for less.
+	CartShareTTL time.Duration
+	// MerchantKey is the secret the merchant sends in the X-Merchant-Key
+	// header to publish mockups to the gallery. No one can publish when it is
+	// empty.
+	MerchantKey string
+	// CustomerLimitWindow is how far back the orders counted against a
+	// product's per-customer limit go.
+	CustomerLimitWindow time.Duration
+	// IdempotencyKeyTTL is how long a response is replayed for requests
+	// repeating its Idempotency-Key; IdempotencySweepInterval is how often
+	// expired keys are deleted.
+	IdempotencyKeyTTL        time.Duration
+	IdempotencySweepInterval time.Duration
 }
 
 func Load() Config {
 	return Config{
-		DBPath:        "data.db",
-		ServerAddress: ":8080",
+		DBPath:                   "data.db",
+		ServerAddress:            ":8080",
+		MockupDir:                "mockups",
+		ReservationTTL:           30 * time.Minute,
+		ReservationSweepInterval: time.Minute,
+		LowStockNotifier:         "log",
+		BackInStockCooldown:      time.Hour,
+		OutboxInterval:           10 * time.Second,
+		ShippingRate:             4.95,
+		FreeShippingThreshold:    75,
+		TaxRate:                  0.2,
+		CartIdleTTL:              30 * 24 * time.Hour,
+		CartSweepInterval:        time.Hour,
+		CartMaxLineQuantity:      99,
+		CartMaxQuantity:          500,
+		CartMaxLines:             100,
+		CartShareTTL:             7 * 24 * time.Hour,
+		CustomerLimitWindow:      30 * 24 * time.Hour,
+		IdempotencyKeyTTL:        24 * time.Hour,
+		IdempotencySweepInterval: time.Hour,
 	}
 }
@@ -0,0 +1,37 @@
+package db
+
+import (
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Retry settings for transactions that fail because SQLite is busy.
+const (
+	maxAttempts  = 5
+	retryBackoff = 20 * time.Millisecond
+)
+
+// Transaction runs fn in a transaction, retrying the whole transaction with a
+// growing backoff while SQLite reports the database as busy or locked. fn may
+// run more than once, so it must not keep state from a failed attempt.
+func Transaction(db *gorm.DB, fn func(tx *gorm.DB) error) error {
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if err = db.Transaction(fn); err == nil || !IsBusy(err) {
+			return err
+		}
+		time.Sleep(time.Duration(attempt) * retryBackoff)
+	}
+	return err
+}
+
+// IsBusy reports whether err is SQLite's SQLITE_BUSY or SQLITE_LOCKED error.
+func IsBusy(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "database is locked") || strings.Contains(msg, "database table is locked")
+}
@@ -1,12 +1,25 @@
 package db
 
 import (
+	"strings"
+
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
+// sqliteOptions make writers wait for each other instead of failing
+// immediately. Transactions take the write lock when they begin, so two
+// transactions cannot both read and then deadlock trying to write.
+const sqliteOptions = "_busy_timeout=5000&_txlock=immediate"
+
 func NewSQLite(path string) (*gorm.DB, error) {
-	db, err := gorm.Open(sqlite.Open(path), &gorm.Config{})
+	dsn := path
+	if strings.Contains(dsn, "?") {
+		dsn += "&" + sqliteOptions
+	} else {
+		dsn += "?" + sqliteOptions
+	}
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
 	if err != nil {
 		return nil, err
 	}
@@ -2,6 +2,8 @@ package errors
 
 type ValidationError struct {
 	Message string
+	// Code is a machine-readable reason, for errors clients act on.
+	Code string
 }
 
 func (e *ValidationError) Error() string {
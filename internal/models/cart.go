@@ -1,20 +1,138 @@
 package models
 
-import "time"
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"sort"
+	"strings"
+	"time"
 
-// Cart represents a shopping cart
+	"gorm.io/gorm"
+)
+
+// cartTokenBytes is the amount of randomness in a cart token.
+const cartTokenBytes = 24
+
+// Cart represents a shopping cart. Carts are addressed by their random Token;
+// the numeric ID is internal and never exposed.
 type Cart struct {
-	ID        uint      `json:"id" gorm:"primaryKey"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
-	Items     []CartItem `json:"items" gorm:"foreignKey:CartID"`
+	ID    uint   `json:"-" gorm:"primaryKey"`
+	Token string `json:"token" gorm:"uniqueIndex"`
+	// CustomerID is set once a signed-in customer owns the cart.
+	CustomerID string    `json:"customer_id,omitempty" gorm:"index"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	// Items are the lines being bought; SavedItems are the lines saved for
+	// later, which hold no stock.
+	Items      []CartItem `json:"items" gorm:"foreignKey:CartID"`
+	SavedItems []CartItem `json:"saved_items" gorm:"foreignKey:CartID"`
+	// ExpiresAt is when the cart is deleted unless it is accessed again. It is
+	// only computed for responses.
+	ExpiresAt *time.Time `json:"expires_at,omitempty" gorm:"-"`
+}
+
+// BeforeCreate gives a new cart its token.
+func (c *Cart) BeforeCreate(tx *gorm.DB) error {
+	if c.Token != "" {
+		return nil
+	}
+	token, err := NewCartToken()
+	c.Token = token
+	return err
+}
+
+// NewCartToken returns a random, URL-safe cart, share, order or mockup token.
+func NewCartToken() (string, error) {
+	b := make([]byte, cartTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
 // CartItem represents an item in a shopping cart
 type CartItem struct {
+	ID                       uint            `json:"id" gorm:"primaryKey"`
+	CartID                   uint            `json:"-"`
+	ProductVariantID         uint            `json:"product_variant_id"`
+	ProductVariant           ProductVariant  `json:"product_variant,omitempty" gorm:"foreignKey:ProductVariantID" validate:"omitempty"`
+	Quantity                 uint            `json:"quantity" validate:"required,gte=1"`
+	Personalization          Personalization `json:"personalization,omitempty" gorm:"serializer:json"`
+	PersonalizationKey       string          `json:"-" gorm:"index"`
+	PersonalizationSurcharge float64         `json:"personalization_surcharge"`
+	// UnitPrice is the price per unit, surcharge included, when the item was
+	// last added. It is compared with the current price to warn the shopper of
+	// changes; zero means it was added before prices were recorded.
+	UnitPrice float64 `json:"unit_price"`
+	// MockupID attaches a gallery mockup; a customer's own mockup is attached
+	// by passing its MockupToken instead, which is filled in when the cart is
+	// viewed.
+	MockupID              *uint  `json:"mockup_id,omitempty"`
+	MockupToken           string `json:"mockup_token,omitempty" gorm:"-"`
+	FulfillmentLocationID *uint  `json:"fulfillment_location_id,omitempty"`
+	// InventoryPolicy, BackorderedQuantity and ExpectedShipDate describe the
+	// part of the line sold beyond stock, if any.
+	InventoryPolicy     string            `json:"inventory_policy,omitempty"`
+	BackorderedQuantity uint              `json:"backordered_quantity"`
+	ExpectedShipDate    *time.Time        `json:"expected_ship_date,omitempty"`
+	BundleProductID     *uint             `json:"bundle_product_id,omitempty"`
+	BundleSelections    []BundleSelection `json:"bundle_selections,omitempty" gorm:"foreignKey:CartItemID"`
+	// SavedAt is set while the line is saved for later.
+	SavedAt *time.Time `json:"saved_at,omitempty" gorm:"index"`
+}
+
+// BundleSelection is the variant chosen for one slot of a bundle cart item.
+// Quantity is per bundle, so the stock consumed is Quantity times the item's quantity.
+type BundleSelection struct {
 	ID               uint           `json:"id" gorm:"primaryKey"`
-	CartID           uint           `json:"cart_id"`
+	CartItemID       uint           `json:"cart_item_id" gorm:"index"`
 	ProductVariantID uint           `json:"product_variant_id"`
-	ProductVariant   ProductVariant `json:"product_variant,omitempty" gorm:"foreignKey:ProductVariantID" validate:"omitempty"`
-	Quantity         uint           `json:"quantity" validate:"required,gte=1"`
+	ProductVariant   ProductVariant `json:"product_variant,omitempty" gorm:"foreignKey:ProductVariantID"`
+	Quantity         uint           `json:"quantity"`
+}
+
+// PersonalizationValue is the customer's input for a single PersonalizationField.
+type PersonalizationValue struct {
+	Field string `json:"field"`
+	Text  string `json:"text"`
+	Font  string `json:"font,omitempty"`
+	Color string `json:"color,omitempty"`
+}
+
+// Personalization is the set of personalization values attached to a cart item.
+type Personalization []PersonalizationValue
+
+// Key returns a canonical representation of the personalization so that cart
+// lines for the same variant are only merged when their personalization matches.
+func (p Personalization) Key() string {
+	if len(p) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(p))
+	for _, v := range p {
+		parts = append(parts, strings.Join([]string{v.Field, v.Text, v.Font, v.Color}, "\x1f"))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "\x1e")
+}
+
+// CartShare is a read-only snapshot of a cart's lines that anyone holding its
+// token can view, and copy into their own cart, until it expires.
+type CartShare struct {
+	ID    uint   `json:"-" gorm:"primaryKey"`
+	Token string `json:"token" gorm:"uniqueIndex"`
+	// Items are copies of the cart's lines when it was shared.
+	Items     []CartItem `json:"items" gorm:"serializer:json"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at" gorm:"index"`
+}
+
+// BeforeCreate gives a new share its token.
+func (s *CartShare) BeforeCreate(tx *gorm.DB) error {
+	if s.Token != "" {
+		return nil
+	}
+	token, err := NewCartToken()
+	s.Token = token
+	return err
 }
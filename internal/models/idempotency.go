@@ -0,0 +1,21 @@
+package models
+
+import (
+	"net/http"
+	"time"
+)
+
+// IdempotencyKey records a mutating request made with an Idempotency-Key
+// header and, once it has completed, the response to replay for repeats.
+type IdempotencyKey struct {
+	ID  uint   `json:"id" gorm:"primaryKey"`
+	Key string `json:"key" gorm:"uniqueIndex"`
+	// Fingerprint identifies the request the key was first used with.
+	Fingerprint string `json:"fingerprint"`
+	// StatusCode is zero while the request is still being processed.
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header" gorm:"serializer:json"`
+	Body       []byte      `json:"body"`
+	CreatedAt  time.Time   `json:"created_at"`
+	ExpiresAt  time.Time   `json:"expires_at" gorm:"index"`
+}
@@ -0,0 +1,129 @@
+package models
+
+import "time"
+
+// StockReservation holds stock of a variant for a cart item until it expires,
+// is released, or is converted into a permanent decrement at checkout.
+type StockReservation struct {
+	ID               uint  `json:"id" gorm:"primaryKey"`
+	CartItemID       uint  `json:"cart_item_id" gorm:"index"`
+	ProductVariantID uint  `json:"product_variant_id" gorm:"index"`
+	Quantity         uint  `json:"quantity"`
+	LocationID       *uint `json:"location_id,omitempty"`
+	// Backordered is the part of Quantity not covered by stock when it was
+	// reserved, sold under the variant's backorder or preorder policy.
+	Backordered uint      `json:"backordered"`
+	ExpiresAt   time.Time `json:"expires_at" gorm:"index"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Backorder records units of a variant sold beyond stock that still wait for
+// stock. Outstanding units count against the variant's availability and are
+// allocated stock, oldest first, as soon as it is free.
+type Backorder struct {
+	ID               uint `json:"id" gorm:"primaryKey"`
+	ProductVariantID uint `json:"product_variant_id" gorm:"index"`
+	// Reference is the reference of the sale, such as "order:12".
+	Reference   string    `json:"reference"`
+	Quantity    uint      `json:"quantity"`
+	Outstanding uint      `json:"outstanding"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Inventory movement types. Receipts, sales, adjustments, returns and damage
+// change on-hand stock; reservations and releases only change what is
+// available to other carts and are recorded for traceability. Transfers move
+// stock between locations in pairs that leave the variant's total unchanged.
+const (
+	MovementReceipt     = "receipt"
+	MovementSale        = "sale"
+	MovementReservation = "reservation"
+	MovementRelease     = "release"
+	MovementAdjustment  = "adjustment"
+	MovementReturn      = "return"
+	MovementDamage      = "damage"
+	MovementTransfer    = "transfer"
+)
+
+// Reason codes for manual stock adjustments. Damage and return adjustments are
+// recorded with the movement type of the same name, the rest as adjustments.
+const (
+	ReasonCount      = "count"
+	ReasonDamage     = "damage"
+	ReasonReturn     = "return"
+	ReasonShrinkage  = "shrinkage"
+	ReasonCorrection = "correction"
+)
+
+// InventoryMovement is an append-only ledger entry for a change to a variant's
+// stock. Quantity is a signed delta.
+type InventoryMovement struct {
+	ID               uint      `json:"id" gorm:"primaryKey"`
+	ProductVariantID uint      `json:"product_variant_id" gorm:"index"`
+	Type             string    `json:"type" validate:"required,oneof=receipt sale reservation release adjustment return damage transfer"`
+	Quantity         int       `json:"quantity"`
+	LocationID       *uint     `json:"location_id,omitempty" gorm:"index"`
+	Reason           string    `json:"reason,omitempty"`
+	Actor            string    `json:"actor,omitempty"`
+	Reference        string    `json:"reference,omitempty"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// ChangesOnHand reports whether the movement type affects the variant's total
+// on-hand stock.
+func (m InventoryMovement) ChangesOnHand() bool {
+	return m.Type != MovementReservation && m.Type != MovementRelease && m.Type != MovementTransfer
+}
+
+// ChangesLocation reports whether the movement affects a location's stock level.
+func (m InventoryMovement) ChangesLocation() bool {
+	return m.LocationID != nil && m.Type != MovementReservation && m.Type != MovementRelease
+}
+
+// Location is a place stock is held, such as our own warehouse or a
+// print-on-demand partner. Cart lines are fulfilled from the enabled location
+// with the lowest Priority that can cover them.
+type Location struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	Code      string    `json:"code" gorm:"uniqueIndex" validate:"required"`
+	Name      string    `json:"name" validate:"required"`
+	Priority  int       `json:"priority"`
+	Disabled  bool      `json:"disabled"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// StockLevel is the on-hand quantity of a variant at a location. A variant's
+// Stock is the total across locations plus any stock not assigned to one.
+type StockLevel struct {
+	ID               uint     `json:"id" gorm:"primaryKey"`
+	LocationID       uint     `json:"location_id" gorm:"uniqueIndex:idx_stock_level"`
+	Location         Location `json:"location,omitempty" gorm:"foreignKey:LocationID"`
+	ProductVariantID uint     `json:"product_variant_id" gorm:"uniqueIndex:idx_stock_level"`
+	Quantity         uint     `json:"quantity"`
+}
+
+// LowStockAlert records a variant's available stock dropping below its
+// low-stock threshold. The alert stays open until stock recovers, so each
+// crossing is notified once.
+type LowStockAlert struct {
+	ID               uint       `json:"id" gorm:"primaryKey"`
+	ProductVariantID uint       `json:"product_variant_id" gorm:"index"`
+	Threshold        uint       `json:"threshold"`
+	Available        int        `json:"available"`
+	ResolvedAt       *time.Time `json:"resolved_at,omitempty"`
+	CreatedAt        time.Time  `json:"created_at"`
+}
+
+// StockSubscription asks to be told once when a sold-out variant is back in
+// stock. Target is an email address or a webhook URL depending on Channel.
+type StockSubscription struct {
+	ID               uint       `json:"id" gorm:"primaryKey"`
+	ProductVariantID uint       `json:"product_variant_id" gorm:"index"`
+	Channel          string     `json:"channel" validate:"required,oneof=email webhook"`
+	Target           string     `json:"target" validate:"required"`
+	NotifiedAt       *time.Time `json:"notified_at,omitempty" gorm:"index"`
+	CreatedAt        time.Time  `json:"created_at"`
+}
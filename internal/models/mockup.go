@@ -0,0 +1,48 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// MockupTemplate is a blank product photo with the area a design is printed on.
+type MockupTemplate struct {
+	ID               uint      `json:"id" gorm:"primaryKey"`
+	ProductID        uint      `json:"product_id" gorm:"index"`
+	Color            string    `json:"color" form:"color" validate:"required"`
+	ImagePath        string    `json:"-"`
+	PrintX           int       `json:"print_x" form:"print_x" validate:"gte=0"`
+	PrintY           int       `json:"print_y" form:"print_y" validate:"gte=0"`
+	PrintWidth       int       `json:"print_width" form:"print_width" validate:"gt=0"`
+	PrintHeight      int       `json:"print_height" form:"print_height" validate:"gt=0"`
+	PrintWidthInches float64   `json:"print_width_inches" form:"print_width_inches" validate:"gte=0"`
+	MinDPI           int       `json:"min_dpi" form:"min_dpi" validate:"gte=0"`
+	MaxDPI           int       `json:"max_dpi" form:"max_dpi" validate:"gte=0"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// Mockup is a rendered preview of a design on a product template. Gallery
+// mockups are the merchant's and are listed with the product; other mockups
+// are customer designs, reachable only through their random Token.
+type Mockup struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	Token      string    `json:"token" gorm:"uniqueIndex"`
+	ProductID  uint      `json:"product_id" gorm:"index"`
+	TemplateID uint      `json:"template_id"`
+	Color      string    `json:"color"`
+	Gallery    bool      `json:"gallery"`
+	ImagePath  string    `json:"-"`
+	ImageURL   string    `json:"image_url" gorm:"-"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// BeforeCreate gives a new mockup its token.
+func (m *Mockup) BeforeCreate(tx *gorm.DB) error {
+	if m.Token != "" {
+		return nil
+	}
+	token, err := NewCartToken()
+	m.Token = token
+	return err
+}
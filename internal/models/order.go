@@ -0,0 +1,101 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Order statuses.
+const (
+	OrderStatusPlaced = "placed"
+)
+
+// Order is a checked-out cart. Like carts, orders are addressed by their
+// random Token; the numeric ID is internal and never exposed. Lines and
+// totals are copies taken at checkout, so later catalog changes do not
+// alter them.
+type Order struct {
+	ID         uint   `json:"-" gorm:"primaryKey"`
+	Token      string `json:"token" gorm:"uniqueIndex"`
+	CustomerID string `json:"customer_id,omitempty" gorm:"index"`
+	Email      string `json:"email"`
+	Status     string `json:"status"`
+	// BillingAddress is the shipping address unless another was given.
+	ShippingAddress Address     `json:"shipping_address" gorm:"serializer:json"`
+	BillingAddress  Address     `json:"billing_address" gorm:"serializer:json"`
+	Lines           []OrderLine `json:"lines" gorm:"foreignKey:OrderID"`
+	Subtotal        float64     `json:"subtotal"`
+	Discount        float64     `json:"discount"`
+	Shipping        float64     `json:"shipping"`
+	Tax             float64     `json:"tax"`
+	Total           float64     `json:"total"`
+	CreatedAt       time.Time   `json:"created_at"`
+	UpdatedAt       time.Time   `json:"updated_at"`
+}
+
+// BeforeCreate gives a new order its token.
+func (o *Order) BeforeCreate(tx *gorm.DB) error {
+	if o.Token != "" {
+		return nil
+	}
+	token, err := NewCartToken()
+	o.Token = token
+	return err
+}
+
+// Address is a postal address given at checkout.
+type Address struct {
+	Name       string `json:"name" validate:"required"`
+	Line1      string `json:"line1" validate:"required"`
+	Line2      string `json:"line2,omitempty"`
+	City       string `json:"city" validate:"required"`
+	Region     string `json:"region,omitempty"`
+	PostalCode string `json:"postal_code" validate:"required"`
+	// Country is an ISO 3166-1 alpha-2 code.
+	Country string `json:"country" validate:"required,iso3166_1_alpha2"`
+	Phone   string `json:"phone,omitempty"`
+}
+
+// OrderLine is a cart line as it was bought: the product's name, the
+// variant's attributes and the prices at checkout are copied onto it.
+// ProductID is the bundle for bundle lines, whose chosen variants are listed
+// in Components.
+type OrderLine struct {
+	ID               uint                 `json:"id" gorm:"primaryKey"`
+	OrderID          uint                 `json:"-" gorm:"index"`
+	ProductID        uint                 `json:"product_id"`
+	ProductVariantID *uint                `json:"product_variant_id,omitempty"`
+	ProductName      string               `json:"product_name"`
+	SKU              string               `json:"sku,omitempty"`
+	Color            string               `json:"color,omitempty"`
+	Size             string               `json:"size,omitempty"`
+	Components       []OrderLineComponent `json:"components,omitempty" gorm:"serializer:json"`
+	Personalization  Personalization      `json:"personalization,omitempty" gorm:"serializer:json"`
+	MockupID         *uint                `json:"mockup_id,omitempty"`
+	Quantity         uint                 `json:"quantity"`
+	// UnitPrice includes the personalization surcharge.
+	UnitPrice                float64 `json:"unit_price"`
+	PersonalizationSurcharge float64 `json:"personalization_surcharge"`
+	Subtotal                 float64 `json:"subtotal"`
+	Discount                 float64 `json:"discount"`
+	Total                    float64 `json:"total"`
+	// FulfillmentLocationID, InventoryPolicy, BackorderedQuantity and
+	// ExpectedShipDate are copied from the cart line.
+	FulfillmentLocationID *uint      `json:"fulfillment_location_id,omitempty"`
+	InventoryPolicy       string     `json:"inventory_policy,omitempty"`
+	BackorderedQuantity   uint       `json:"backordered_quantity"`
+	ExpectedShipDate      *time.Time `json:"expected_ship_date,omitempty"`
+}
+
+// OrderLineComponent is a variant chosen for a bundle order line. Quantity is
+// per bundle.
+type OrderLineComponent struct {
+	ProductID        uint   `json:"product_id"`
+	ProductVariantID uint   `json:"product_variant_id"`
+	ProductName      string `json:"product_name"`
+	SKU              string `json:"sku,omitempty"`
+	Color            string `json:"color"`
+	Size             string `json:"size"`
+	Quantity         uint   `json:"quantity"`
+}
@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// OutboxMessage is a notification waiting to be delivered by a separate
+// sender, such as an email to a merchant or customer or a webhook call.
+type OutboxMessage struct {
+	ID        uint   `json:"id" gorm:"primaryKey"`
+	Channel   string `json:"channel" gorm:"index"`
+	Event     string `json:"event"`
+	Recipient string `json:"recipient"`
+	Subject   string `json:"subject"`
+	Body      string `json:"body"`
+	// Data is the JSON encoding of the event's details, if any.
+	Data      string     `json:"data,omitempty"`
+	Attempts  int        `json:"attempts"`
+	LastError string     `json:"last_error,omitempty"`
+	SentAt    *time.Time `json:"sent_at,omitempty" gorm:"index"`
+	CreatedAt time.Time  `json:"created_at"`
+}
@@ -2,21 +2,101 @@ package models
 
 import "time"
 
+// Product types. Bundles have no variants of their own; they are composed of
+// other products and draw stock from the component variants chosen in the cart.
+const (
+	ProductTypeSimple = "simple"
+	ProductTypeBundle = "bundle"
+)
+
 type Product struct {
-	ID          uint             `json:"id" gorm:"primaryKey"`
-	Name        string           `json:"name" validate:"required"`
-	Description string           `json:"description"`
-	Price       float64          `json:"price" validate:"required,gt=0"`
-	ImageURL    string           `json:"image_url"`
-	Variants    []ProductVariant `json:"variants" gorm:"foreignKey:ProductID" validate:"dive"`
-	CreatedAt   time.Time        `json:"created_at"`
-	UpdatedAt   time.Time        `json:"updated_at"`
+	ID                    uint                   `json:"id" gorm:"primaryKey"`
+	Name                  string                 `json:"name" validate:"required"`
+	Description           string                 `json:"description"`
+	Price                 float64                `json:"price" validate:"required_without=BundleDiscountPercent,gte=0"`
+	ImageURL              string                 `json:"image_url"`
+	Type                  string                 `json:"type" gorm:"default:simple" validate:"omitempty,oneof=simple bundle"`
+	BundleComponents      []BundleComponent      `json:"bundle_components,omitempty" gorm:"foreignKey:BundleID" validate:"dive"`
+	BundleDiscountPercent float64                `json:"bundle_discount_percent" validate:"gte=0,lt=100"`
+	Variants              []ProductVariant       `json:"variants" gorm:"foreignKey:ProductID" validate:"dive"`
+	PersonalizationFields []PersonalizationField `json:"personalization_fields,omitempty" gorm:"foreignKey:ProductID" validate:"dive"`
+	// LowStockThreshold is the default for variants without their own.
+	LowStockThreshold *uint `json:"low_stock_threshold,omitempty"`
+	// MaxPerCart caps the units of the product, across its variants, that
+	// one cart may hold. Nil means no limit.
+	MaxPerCart *uint `json:"max_per_cart,omitempty"`
+	// MaxPerCustomer caps the units of the product one customer may buy
+	// across the orders they placed within the customer limit window,
+	// checked at checkout. Nil means no limit. Without authentication the
+	// customer is whatever ID the cart was given, so the cap is advisory
+	// and not enforced.
+	MaxPerCustomer *uint     `json:"max_per_customer,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
 }
 
+// Inventory policies decide what happens when a variant is out of stock.
+// Deny rejects the sale; backorder sells units that will ship once restocked;
+// preorder sells units of a product that has not been released yet.
+const (
+	InventoryPolicyDeny      = "deny"
+	InventoryPolicyBackorder = "backorder"
+	InventoryPolicyPreorder  = "preorder"
+)
+
 type ProductVariant struct {
 	ID        uint   `json:"id" gorm:"primaryKey"`
 	ProductID uint   `json:"product_id"`
 	Color     string `json:"color" validate:"required"`
 	Size      string `json:"size" validate:"required"`
-	Stock     uint   `json:"stock" validate:"required,gte=0"`
+	// SKU is the merchant's stock keeping unit, used by stock count imports.
+	SKU   string `json:"sku,omitempty" gorm:"index"`
+	Stock uint   `json:"stock" validate:"gte=0"`
+	// ArchivedAt is set when the variant is retired. Archived variants are
+	// hidden from the storefront but kept so existing cart lines still resolve.
+	ArchivedAt *time.Time `json:"archived_at,omitempty"`
+	// LowStockThreshold overrides the product's threshold. An alert is raised
+	// when available stock drops below it.
+	LowStockThreshold *uint `json:"low_stock_threshold,omitempty"`
+	// InventoryPolicy is one of the InventoryPolicy constants; empty means deny.
+	InventoryPolicy string `json:"inventory_policy" gorm:"default:deny" validate:"omitempty,oneof=deny backorder preorder"`
+	// BackorderLimit caps how many units may be sold beyond stock under the
+	// backorder and preorder policies. Zero means no limit.
+	BackorderLimit uint `json:"backorder_limit"`
+	// ExpectedShipDate is when units sold beyond stock are expected to ship.
+	// Preorders require it.
+	ExpectedShipDate *time.Time `json:"expected_ship_date,omitempty" validate:"required_if=InventoryPolicy preorder"`
+	// MaxPerCart caps the units of the variant one cart may hold. Nil means
+	// no limit.
+	MaxPerCart *uint `json:"max_per_cart,omitempty"`
+	// Available is on-hand stock minus active cart reservations. It is only
+	// computed for storefront responses.
+	Available *int `json:"available,omitempty" gorm:"-"`
+}
+
+// PersonalizationField defines customer-provided text that can be printed on a
+// product, such as a name or number on the back of a shirt.
+type PersonalizationField struct {
+	ID            uint     `json:"id" gorm:"primaryKey"`
+	ProductID     uint     `json:"product_id"`
+	Name          string   `json:"name" validate:"required"`
+	Required      bool     `json:"required"`
+	MaxLength     int      `json:"max_length" validate:"required,gt=0"`
+	AllowedFonts  []string `json:"allowed_fonts" gorm:"serializer:json"`
+	AllowedColors []string `json:"allowed_colors" gorm:"serializer:json"`
+	Surcharge     float64  `json:"surcharge" validate:"gte=0"`
+}
+
+// BundleComponent is a product included in a bundle, e.g. three of the same
+// basic tee in a 3-pack.
+type BundleComponent struct {
+	ID                 uint `json:"id" gorm:"primaryKey"`
+	BundleID           uint `json:"bundle_id" gorm:"index"`
+	ComponentProductID uint `json:"component_product_id" validate:"required"`
+	Quantity           uint `json:"quantity" validate:"required,gte=1"`
+}
+
+// AllowsOversell reports whether the variant can be sold beyond its stock.
+func (v ProductVariant) AllowsOversell() bool {
+	return v.InventoryPolicy == InventoryPolicyBackorder || v.InventoryPolicy == InventoryPolicyPreorder
 }
@@ -0,0 +1,256 @@
+// Package carts manages the lifecycle of shopping carts: idle expiry and
+// deletion, together with the stock their items hold, and the snapshots
+// they are shared through.
+package carts
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/abdelmounim-dev/go-tshirt/internal/db"
+	"github.com/abdelmounim-dev/go-tshirt/internal/models"
+	"github.com/abdelmounim-dev/go-tshirt/internal/service/inventory"
+	"gorm.io/gorm"
+)
+
+// DefaultIdleTTL is used when Options.IdleTTL is not set.
+const DefaultIdleTTL = 30 * 24 * time.Hour
+
+// DefaultShareTTL is used when Options.ShareTTL is not set.
+const DefaultShareTTL = 7 * 24 * time.Hour
+
+// CookieName is the cookie carrying the signed cart token.
+const CookieName = "cart_token"
+
+// ErrCartNotFound is returned when a cart no longer exists. It wraps
+// gorm.ErrRecordNotFound, so it can be told apart from other missing records
+// while still matching it.
+var ErrCartNotFound = fmt.Errorf("cart not found: %w", gorm.ErrRecordNotFound)
+
+// sweepBatchSize caps how many expired carts are deleted per sweep.
+const sweepBatchSize = 100
+
+// Options configures a Service.
+type Options struct {
+	// IdleTTL is how long a cart lives after it was last accessed.
+	IdleTTL time.Duration
+	// CookieSecret signs the cart cookie. No cookie is issued when it is empty.
+	CookieSecret string
+	// MaxLineQuantity caps the quantity of a single cart line. Zero means no
+	// limit.
+	MaxLineQuantity uint
+	// MaxCartQuantity caps the total quantity of a cart's lines, and
+	// MaxCartLines how many lines it may have. Zero means no limit. Lines
+	// saved for later count towards neither.
+	MaxCartQuantity uint
+	MaxCartLines    uint
+	// ShareTTL is how long a shared cart can be viewed by default.
+	ShareTTL time.Duration
+}
+
+// Service expires and deletes carts. Methods that take a *gorm.DB run against
+// it so callers can include them in their own transactions.
+type Service struct {
+	db        *gorm.DB
+	inventory *inventory.Service
+	idleTTL   time.Duration
+	secret    []byte
+
+	maxLineQuantity uint
+	maxCartQuantity uint
+	maxCartLines    uint
+	shareTTL        time.Duration
+}
+
+func NewService(db *gorm.DB, inv *inventory.Service, opts Options) *Service {
+	if opts.IdleTTL <= 0 {
+		opts.IdleTTL = DefaultIdleTTL
+	}
+	if opts.ShareTTL <= 0 {
+		opts.ShareTTL = DefaultShareTTL
+	}
+	return &Service{
+		db:              db,
+		inventory:       inv,
+		idleTTL:         opts.IdleTTL,
+		secret:          []byte(opts.CookieSecret),
+		maxLineQuantity: opts.MaxLineQuantity,
+		maxCartQuantity: opts.MaxCartQuantity,
+		maxCartLines:    opts.MaxCartLines,
+		shareTTL:        opts.ShareTTL,
+	}
+}
+
+// Cookie returns a cookie carrying the cart token signed with the cookie
+// secret, or nil when no secret is configured.
+func (s *Service) Cookie(token string) *http.Cookie {
+	if len(s.secret) == 0 {
+		return nil
+	}
+	return &http.Cookie{
+		Name:     CookieName,
+		Value:    token + "." + s.sign(token),
+		Path:     "/api/cart",
+		MaxAge:   int(s.idleTTL.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// TokenFromCookie returns the cart token in a cookie value issued by Cookie,
+// and false when the value was not signed with the current secret.
+func (s *Service) TokenFromCookie(value string) (string, bool) {
+	if len(s.secret) == 0 {
+		return "", false
+	}
+	token, signature, ok := strings.Cut(value, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(s.sign(token))) {
+		return "", false
+	}
+	return token, true
+}
+
+// sign returns the HMAC of a cart token.
+func (s *Service) sign(token string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// BackfillTokens gives a token to every cart created before carts had one.
+func (s *Service) BackfillTokens() error {
+	var pending []models.Cart
+	if err := s.db.Where("token IS NULL OR token = ''").Find(&pending).Error; err != nil {
+		return err
+	}
+	for _, cart := range pending {
+		token, err := models.NewCartToken()
+		if err != nil {
+			return err
+		}
+		// Leave updated_at alone so backfilling does not renew the cart
+		if err := s.db.Model(&models.Cart{}).Where("id = ?", cart.ID).UpdateColumn("token", token).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Expired reports whether a cart has been idle for longer than the TTL.
+func (s *Service) Expired(cart models.Cart) bool {
+	return !cart.UpdatedAt.Add(s.idleTTL).After(time.Now())
+}
+
+// FillExpiry sets the cart's ExpiresAt for responses.
+func (s *Service) FillExpiry(cart *models.Cart) {
+	expiresAt := cart.UpdatedAt.Add(s.idleTTL)
+	cart.ExpiresAt = &expiresAt
+}
+
+// Touch renews a cart's idle expiry. It returns ErrCartNotFound when the cart
+// no longer exists.
+func (s *Service) Touch(tx *gorm.DB, cartID uint) error {
+	result := tx.Model(&models.Cart{}).Where("id = ?", cartID).Update("updated_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrCartNotFound
+	}
+	return nil
+}
+
+// Delete removes a cart and its items, releasing the stock they hold, and
+// returns the variants whose stock was freed. It returns ErrCartNotFound
+// when the cart does not exist.
+func (s *Service) Delete(tx *gorm.DB, cartID uint) ([]uint, error) {
+	released, err := s.inventory.ReleaseCart(tx, cartID)
+	if err != nil {
+		return nil, err
+	}
+	itemIDs := tx.Model(&models.CartItem{}).Select("id").Where("cart_id = ?", cartID)
+	if err := tx.Where("cart_item_id IN (?)", itemIDs).Delete(&models.BundleSelection{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Where("cart_id = ?", cartID).Delete(&models.CartItem{}).Error; err != nil {
+		return nil, err
+	}
+	result := tx.Delete(&models.Cart{}, cartID)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrCartNotFound
+	}
+	return released, nil
+}
+
+// DeleteExpired deletes carts that have been idle for longer than the TTL and
+// returns how many were deleted. Each cart is deleted in its own transaction
+// and re-checked there, so a cart touched in the meantime is kept.
+func (s *Service) DeleteExpired(ctx context.Context) (int, error) {
+	cutoff := time.Now().Add(-s.idleTTL)
+	var ids []uint
+	if err := s.db.Model(&models.Cart{}).Where("updated_at <= ?", cutoff).Order("id").Limit(sweepBatchSize).Pluck("id", &ids).Error; err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	var released []uint
+	for _, id := range ids {
+		var freed []uint
+		removed := false
+		err := db.Transaction(s.db, func(tx *gorm.DB) error {
+			freed, removed = nil, false
+			var n int64
+			if err := tx.Model(&models.Cart{}).Where("id = ? AND updated_at <= ?", id, cutoff).Count(&n).Error; err != nil || n == 0 {
+				return err
+			}
+			var err error
+			freed, err = s.Delete(tx, id)
+			removed = err == nil
+			return err
+		})
+		if err != nil {
+			return deleted, err
+		}
+		if removed {
+			deleted++
+			released = append(released, freed...)
+		}
+	}
+	s.inventory.CheckLowStock(ctx, released...)
+	return deleted, nil
+}
+
+// RunSweeper deletes expired carts and shares every interval until ctx is
+// done.
+func (s *Service) RunSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.DeleteExpiredShares(); err != nil {
+				log.Printf("Failed to delete expired cart shares: %v", err)
+			}
+			n, err := s.DeleteExpired(ctx)
+			if err != nil {
+				log.Printf("Failed to delete expired carts: %v", err)
+				continue
+			}
+			if n > 0 {
+				log.Printf("Deleted %d expired carts", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package carts
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+
+	apperrors "github.com/abdelmounim-dev/go-tshirt/internal/errors"
+	"github.com/abdelmounim-dev/go-tshirt/internal/models"
+	"gorm.io/gorm"
+)
+
+// Codes of the purchase limits a cart can exceed. They are reported as
+// validation error codes and as warning codes.
+const (
+	LimitLineQuantity    = WarningQuantityLimit
+	LimitVariantQuantity = "variant_limit_exceeded"
+	LimitProductQuantity = "product_limit_exceeded"
+	LimitCartQuantity    = "cart_quantity_limit_exceeded"
+	LimitCartLines       = "cart_lines_limit_exceeded"
+)
+
+// Limit is the purchase limit that most restricts a cart line.
+type Limit struct {
+	Code string
+	// Max is the configured limit.
+	Max uint
+	// Quantity is the most the line may hold given the rest of the cart.
+	Quantity uint
+}
+
+// Message describes the limit to the shopper.
+func (l Limit) Message() string {
+	switch l.Code {
+	case LimitVariantQuantity:
+		return fmt.Sprintf("At most %d of this variant per cart", l.Max)
+	case LimitProductQuantity:
+		return fmt.Sprintf("At most %d of this product per cart", l.Max)
+	case LimitCartQuantity:
+		return fmt.Sprintf("At most %d items per cart", l.Max)
+	case LimitCartLines:
+		return fmt.Sprintf("At most %d different items per cart", l.Max)
+	}
+	return fmt.Sprintf("At most %d per item", l.Max)
+}
+
+// err returns the validation error for a line exceeding the limit.
+func (l Limit) err() error {
+	return &apperrors.ValidationError{Message: l.Message(), Code: l.Code}
+}
+
+// LineLimit returns the purchase limit that most restricts the quantity of
+// a cart line, counting what the cart's other active lines hold, and false
+// when the line is not limited. Per-variant and per-product limits count
+// bundle components too, and a bundle's own product limit counts bundles.
+// line need not be saved yet; bundle lines need their selections loaded.
+func (s *Service) LineLimit(tx *gorm.DB, line models.CartItem) (Limit, bool, error) {
+	var others []models.CartItem
+	if err := tx.Preload("BundleSelections").Where("cart_id = ? AND id <> ? AND saved_at IS NULL", line.CartID, line.ID).Find(&others).Error; err != nil {
+		return Limit{}, false, err
+	}
+	perUnit := LineVariants(line)
+	variantIDs := map[uint]bool{}
+	for id := range perUnit {
+		variantIDs[id] = true
+	}
+	for _, o := range others {
+		for id := range LineVariants(o) {
+			variantIDs[id] = true
+		}
+	}
+	var variants []models.ProductVariant
+	if err := tx.Find(&variants, slices.Sorted(maps.Keys(variantIDs))).Error; err != nil {
+		return Limit{}, false, err
+	}
+	productOf := make(map[uint]uint, len(variants))
+	for _, v := range variants {
+		productOf[v.ID] = v.ProductID
+	}
+
+	// Units of each variant and product held by the rest of the cart
+	variantHeld, productHeld, cartHeld := map[uint]uint{}, map[uint]uint{}, uint(0)
+	for _, o := range others {
+		cartHeld += o.Quantity
+		for id, units := range LineVariants(o) {
+			variantHeld[id] += units * o.Quantity
+			productHeld[productOf[id]] += units * o.Quantity
+		}
+		if o.BundleProductID != nil {
+			productHeld[*o.BundleProductID] += o.Quantity
+		}
+	}
+
+	// Units of each product one unit of the line consumes
+	productUnits := map[uint]uint{}
+	for id, units := range perUnit {
+		productUnits[productOf[id]] += units
+	}
+	if line.BundleProductID != nil {
+		productUnits[*line.BundleProductID]++
+	}
+	var products []models.Product
+	if err := tx.Find(&products, slices.Sorted(maps.Keys(productUnits))).Error; err != nil {
+		return Limit{}, false, err
+	}
+
+	limit, limited := Limit{}, false
+	consider := func(code string, max, held, units uint) {
+		quantity := uint(0)
+		if held < max {
+			quantity = (max - held) / units
+		}
+		if !limited || quantity < limit.Quantity {
+			limit, limited = Limit{Code: code, Max: max, Quantity: quantity}, true
+		}
+	}
+	if s.maxLineQuantity > 0 {
+		consider(LimitLineQuantity, s.maxLineQuantity, 0, 1)
+	}
+	for _, v := range variants {
+		if units := perUnit[v.ID]; units > 0 && v.MaxPerCart != nil {
+			consider(LimitVariantQuantity, *v.MaxPerCart, variantHeld[v.ID], units)
+		}
+	}
+	for _, p := range products {
+		if units := productUnits[p.ID]; units > 0 && p.MaxPerCart != nil {
+			consider(LimitProductQuantity, *p.MaxPerCart, productHeld[p.ID], units)
+		}
+	}
+	if s.maxCartQuantity > 0 {
+		consider(LimitCartQuantity, s.maxCartQuantity, cartHeld, 1)
+	}
+	return limit, limited, nil
+}
+
+// CheckLimits rejects setting a cart line to quantity when that would exceed
+// a purchase limit, with a validation error carrying the limit's code. A
+// line that is not in the cart yet, or not among its active lines, is also
+// rejected when the cart already has as many lines as it may.
+func (s *Service) CheckLimits(tx *gorm.DB, line models.CartItem, quantity uint) error {
+	if line.ID == 0 || line.SavedAt != nil {
+		full, err := s.linesFull(tx, line.CartID)
+		if err != nil {
+			return err
+		}
+		if full {
+			return Limit{Code: LimitCartLines, Max: s.maxCartLines}.err()
+		}
+	}
+	limit, limited, err := s.LineLimit(tx, line)
+	if err != nil {
+		return err
+	}
+	if limited && quantity > limit.Quantity {
+		return limit.err()
+	}
+	return nil
+}
+
+// linesFull reports whether a cart has as many active lines as it may.
+func (s *Service) linesFull(tx *gorm.DB, cartID uint) (bool, error) {
+	if s.maxCartLines == 0 {
+		return false, nil
+	}
+	var n int64
+	err := tx.Model(&models.CartItem{}).Where("cart_id = ? AND saved_at IS NULL", cartID).Count(&n).Error
+	return uint(n) >= s.maxCartLines, err
+}
+
+// extraLines returns the active lines of a cart beyond the lines limit, the
+// most recently added first to go.
+func (s *Service) extraLines(tx *gorm.DB, cartID uint) (map[uint]bool, error) {
+	extra := map[uint]bool{}
+	if s.maxCartLines == 0 {
+		return extra, nil
+	}
+	var ids []uint
+	if err := tx.Model(&models.CartItem{}).Where("cart_id = ? AND saved_at IS NULL", cartID).Order("id").Pluck("id", &ids).Error; err != nil {
+		return nil, err
+	}
+	for i, id := range ids {
+		if uint(i) >= s.maxCartLines {
+			extra[id] = true
+		}
+	}
+	return extra, nil
+}
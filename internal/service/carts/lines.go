@@ -0,0 +1,175 @@
+package carts
+
+import (
+	"maps"
+	"slices"
+
+	"github.com/abdelmounim-dev/go-tshirt/internal/models"
+	"gorm.io/gorm"
+)
+
+// LineVariants returns the quantity of each variant one unit of a cart line
+// consumes. Bundle lines need their selections loaded.
+func LineVariants(line models.CartItem) map[uint]uint {
+	if line.BundleProductID == nil {
+		return map[uint]uint{line.ProductVariantID: 1}
+	}
+	perUnit := make(map[uint]uint, len(line.BundleSelections))
+	for _, s := range line.BundleSelections {
+		perUnit[s.ProductVariantID] += s.Quantity
+	}
+	return perUnit
+}
+
+// FillMockupTokens sets MockupToken on the lines that have a mockup, so the
+// holder of the cart can reach a design that is not in the product gallery.
+func FillMockupTokens(tx *gorm.DB, lines []models.CartItem) error {
+	ids := map[uint]bool{}
+	for _, line := range lines {
+		if line.MockupID != nil {
+			ids[*line.MockupID] = true
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	var mockups []models.Mockup
+	if err := tx.Select("id", "token").Find(&mockups, slices.Sorted(maps.Keys(ids))).Error; err != nil {
+		return err
+	}
+	tokens := make(map[uint]string, len(mockups))
+	for _, m := range mockups {
+		tokens[m.ID] = m.Token
+	}
+	for i := range lines {
+		if lines[i].MockupID != nil {
+			lines[i].MockupToken = tokens[*lines[i].MockupID]
+		}
+	}
+	return nil
+}
+
+// ReserveLine holds stock for a cart line's full quantity, perUnit[v] units of
+// each variant v per line unit, and records on the line any part sold beyond
+// stock. Callers run it in the transaction that created or changed the line,
+// after checking the line against the purchase limits with CheckLimits.
+func (s *Service) ReserveLine(tx *gorm.DB, line *models.CartItem, perUnit map[uint]uint) error {
+	line.FulfillmentLocationID = nil
+	line.InventoryPolicy, line.BackorderedQuantity, line.ExpectedShipDate = "", 0, nil
+
+	var backordered []uint
+	for _, variantID := range slices.Sorted(maps.Keys(perUnit)) {
+		reservation, err := s.inventory.Reserve(tx, line.ID, variantID, perUnit[variantID]*line.Quantity)
+		if err != nil {
+			return err
+		}
+		// Bundle lines have no single location or backordered quantity
+		if line.BundleProductID == nil {
+			line.FulfillmentLocationID = reservation.LocationID
+			line.BackorderedQuantity = reservation.Backordered
+		}
+		if reservation.Backordered > 0 {
+			backordered = append(backordered, variantID)
+		}
+	}
+
+	// A bundle ships when its last backordered component does
+	if len(backordered) > 0 {
+		var variants []models.ProductVariant
+		if err := tx.Find(&variants, backordered).Error; err != nil {
+			return err
+		}
+		for _, v := range variants {
+			noteBackorder(line, v)
+		}
+	}
+	return tx.Model(line).Select("fulfillment_location_id", "inventory_policy", "backordered_quantity", "expected_ship_date").Updates(line).Error
+}
+
+// AddAvailable adds item to its cart within tx like an add to cart, merging
+// it into a matching line, but clamps the resulting line to the purchase
+// limits and available stock instead of failing. A line that already existed
+// is never reduced. AddAvailable returns the line, or a zero CartItem when
+// nothing could be added, with the quantity added and, when that is less
+// than requested, the reason as one of the Adjustment constants.
+func (s *Service) AddAvailable(tx *gorm.DB, item models.CartItem, perUnit map[uint]uint) (models.CartItem, uint, string, error) {
+	item.SavedAt = nil
+	line, err := s.matchingLine(tx, item.CartID, item)
+	if err != nil {
+		return line, 0, "", err
+	}
+	kept := line.Quantity
+	if line.ID == 0 {
+		full, err := s.linesFull(tx, item.CartID)
+		if err != nil {
+			return line, 0, "", err
+		}
+		if full {
+			return models.CartItem{}, 0, AdjustmentLineLimit, nil
+		}
+		line = item
+		if err := tx.Create(&line).Error; err != nil {
+			return line, 0, "", err
+		}
+	}
+
+	requested := kept + item.Quantity
+	quantity, reason, err := s.mergedQuantity(tx, line, perUnit, requested, kept)
+	if err != nil {
+		return line, 0, "", err
+	}
+	quantity = max(quantity, kept)
+	if quantity == 0 {
+		return models.CartItem{}, 0, reason, s.deleteLine(tx, line)
+	}
+	line.Quantity = quantity
+	if err := tx.Model(&line).Update("quantity", quantity).Error; err != nil {
+		return line, 0, "", err
+	}
+	return line, quantity - kept, reason, s.ReserveLine(tx, &line, perUnit)
+}
+
+// MaxQuantity returns the largest quantity a cart line could be set to given
+// current stock, and true when its variants can all be sold without limit.
+func (s *Service) MaxQuantity(tx *gorm.DB, lineID uint, perUnit map[uint]uint) (uint, bool, error) {
+	limit, limited := uint(0), false
+	for variantID, units := range perUnit {
+		n, unlimited, err := s.inventory.Reservable(tx, variantID, lineID)
+		if err != nil {
+			return 0, false, err
+		}
+		if unlimited || units == 0 {
+			continue
+		}
+		if lines := uint(n) / units; !limited || lines < limit {
+			limit, limited = lines, true
+		}
+	}
+	return limit, !limited, nil
+}
+
+// variantsExist reports whether every variant in perUnit still exists.
+func variantsExist(tx *gorm.DB, perUnit map[uint]uint) (bool, error) {
+	var found int64
+	err := tx.Model(&models.ProductVariant{}).Where("id IN ?", slices.Sorted(maps.Keys(perUnit))).Count(&found).Error
+	return int(found) == len(perUnit), err
+}
+
+// hasArchived reports whether any of the variants in perUnit is archived.
+func hasArchived(tx *gorm.DB, perUnit map[uint]uint) (bool, error) {
+	var archived int64
+	err := tx.Model(&models.ProductVariant{}).Where("id IN ? AND archived_at IS NOT NULL", slices.Sorted(maps.Keys(perUnit))).Count(&archived).Error
+	return archived > 0, err
+}
+
+// noteBackorder marks a cart item as containing units of variant sold beyond
+// stock. Preorders take precedence over backorders, and the latest expected
+// ship date wins.
+func noteBackorder(item *models.CartItem, variant models.ProductVariant) {
+	if item.InventoryPolicy != models.InventoryPolicyPreorder {
+		item.InventoryPolicy = variant.InventoryPolicy
+	}
+	if variant.ExpectedShipDate != nil && (item.ExpectedShipDate == nil || variant.ExpectedShipDate.After(*item.ExpectedShipDate)) {
+		item.ExpectedShipDate = variant.ExpectedShipDate
+	}
+}
@@ -0,0 +1,219 @@
+package carts
+
+import (
+	"maps"
+	"slices"
+	"time"
+
+	apperrors "github.com/abdelmounim-dev/go-tshirt/internal/errors"
+	"github.com/abdelmounim-dev/go-tshirt/internal/models"
+	"gorm.io/gorm"
+)
+
+// Reasons a merged line could not keep the requested quantity.
+const (
+	AdjustmentInsufficientStock = "insufficient_stock"
+	AdjustmentArchived          = "archived"
+	AdjustmentQuantityLimit     = "quantity_limit"
+	AdjustmentLineLimit         = "line_limit"
+	AdjustmentUnavailable       = "unavailable"
+)
+
+// Adjustment reports a cart line that was given less than the requested
+// quantity. CartItemID is zero when the line was dropped altogether.
+type Adjustment struct {
+	CartItemID       uint   `json:"cart_item_id,omitempty"`
+	ProductVariantID uint   `json:"product_variant_id,omitempty"`
+	BundleProductID  *uint  `json:"bundle_product_id,omitempty"`
+	Requested        uint   `json:"requested"`
+	Quantity         uint   `json:"quantity"`
+	Reason           string `json:"reason"`
+}
+
+// Merge combines the anonymous cart from into the customer's cart into and
+// deletes it. Lines for the same variant, personalization and mockup are
+// summed; bundle lines are moved as they are. Lines saved for later join the
+// customer's saved lines. Each resulting line is clamped to the purchase
+// limits and the stock it can hold, lines that would take the cart over its
+// lines limit are dropped, and lines of archived variants are never increased
+// beyond their larger quantity; every line that was cut back is reported. Both
+// carts must belong to customerID or to nobody, and into is tagged with it.
+// When into is the zero Cart, from becomes the customer's instead. Merge
+// returns the customer's cart, the adjustments and the variants whose
+// reservations changed.
+func (s *Service) Merge(tx *gorm.DB, from, into models.Cart, customerID string) (models.Cart, []Adjustment, []uint, error) {
+	for _, cart := range []models.Cart{from, into} {
+		if cart.CustomerID != "" && cart.CustomerID != customerID {
+			return from, nil, nil, &apperrors.ValidationError{Message: "Cart belongs to another customer"}
+		}
+	}
+	if into.ID == 0 || into.ID == from.ID {
+		from.CustomerID = customerID
+		err := tx.Model(&from).Updates(map[string]interface{}{"customer_id": customerID, "updated_at": time.Now()}).Error
+		return from, nil, nil, err
+	}
+	if into.CustomerID == "" {
+		into.CustomerID = customerID
+		if err := tx.Model(&into).Update("customer_id", customerID).Error; err != nil {
+			return into, nil, nil, err
+		}
+	}
+
+	var items []models.CartItem
+	if err := tx.Preload("BundleSelections").Where("cart_id = ?", from.ID).Order("id").Find(&items).Error; err != nil {
+		return into, nil, nil, err
+	}
+	adjustments := []Adjustment{}
+	changed := map[uint]bool{}
+	for _, item := range items {
+		if item.SavedAt != nil {
+			if _, err := s.mergeLine(tx, into.ID, item); err != nil {
+				return into, nil, nil, err
+			}
+			continue
+		}
+		perUnit := LineVariants(item)
+		for id := range perUnit {
+			changed[id] = true
+		}
+
+		target, err := s.matchingLine(tx, into.ID, item)
+		if err != nil {
+			return into, nil, nil, err
+		}
+		line, kept := item, uint(0)
+		if target.ID == 0 {
+			full, err := s.linesFull(tx, into.ID)
+			if err != nil {
+				return into, nil, nil, err
+			}
+			if full {
+				adjustments = append(adjustments, Adjustment{
+					ProductVariantID: item.ProductVariantID,
+					BundleProductID:  item.BundleProductID,
+					Requested:        item.Quantity,
+					Reason:           AdjustmentLineLimit,
+				})
+				if err := s.deleteLine(tx, item); err != nil {
+					return into, nil, nil, err
+				}
+				continue
+			}
+		}
+		if target.ID != 0 {
+			// The customer's line absorbs the anonymous one
+			if _, err := s.inventory.Release(tx, item.ID); err != nil {
+				return into, nil, nil, err
+			}
+			if err := tx.Delete(&item).Error; err != nil {
+				return into, nil, nil, err
+			}
+			line, kept = target, target.Quantity
+		} else if err := tx.Model(&item).Update("cart_id", into.ID).Error; err != nil {
+			return into, nil, nil, err
+		}
+		line.CartID = into.ID
+
+		requested := item.Quantity + kept
+		quantity, reason, err := s.mergedQuantity(tx, line, perUnit, requested, max(item.Quantity, kept))
+		if err != nil {
+			return into, nil, nil, err
+		}
+		if quantity < requested {
+			adjustments = append(adjustments, Adjustment{
+				CartItemID:       line.ID,
+				ProductVariantID: line.ProductVariantID,
+				BundleProductID:  line.BundleProductID,
+				Requested:        requested,
+				Quantity:         quantity,
+				Reason:           reason,
+			})
+		}
+
+		if quantity == 0 {
+			adjustments[len(adjustments)-1].CartItemID = 0
+			if err := s.deleteLine(tx, line); err != nil {
+				return into, nil, nil, err
+			}
+			continue
+		}
+		line.Quantity = quantity
+		if err := tx.Model(&line).Update("quantity", quantity).Error; err != nil {
+			return into, nil, nil, err
+		}
+		if err := s.ReserveLine(tx, &line, perUnit); err != nil {
+			return into, nil, nil, err
+		}
+	}
+
+	if _, err := s.Delete(tx, from.ID); err != nil {
+		return into, nil, nil, err
+	}
+	if err := s.Touch(tx, into.ID); err != nil {
+		return into, nil, nil, err
+	}
+	return into, adjustments, slices.Sorted(maps.Keys(changed)), nil
+}
+
+// matchingLine returns the line of cart cartID that item would merge into, or
+// a zero CartItem when there is none. Only lines in the same section, saved
+// or not, match, and bundle lines never merge.
+func (s *Service) matchingLine(tx *gorm.DB, cartID uint, item models.CartItem) (models.CartItem, error) {
+	var line models.CartItem
+	if item.BundleProductID != nil {
+		return line, nil
+	}
+	query := tx.Where("cart_id = ? AND id <> ? AND product_variant_id = ? AND personalization_key = ?", cartID, item.ID, item.ProductVariantID, item.PersonalizationKey)
+	if item.SavedAt != nil {
+		query = query.Where("saved_at IS NOT NULL")
+	} else {
+		query = query.Where("saved_at IS NULL")
+	}
+	if item.MockupID != nil {
+		query = query.Where("mockup_id = ?", *item.MockupID)
+	} else {
+		query = query.Where("mockup_id IS NULL")
+	}
+	err := query.Limit(1).Find(&line).Error
+	return line, err
+}
+
+// mergedQuantity clamps the requested quantity of a merged line to the
+// purchase limits and to what its variants can cover. Archived variants are
+// capped at archivedCap instead.
+func (s *Service) mergedQuantity(tx *gorm.DB, line models.CartItem, perUnit map[uint]uint, requested, archivedCap uint) (uint, string, error) {
+	archived, err := hasArchived(tx, perUnit)
+	if err != nil {
+		return 0, "", err
+	}
+	quantity, reason := requested, ""
+	if archived && archivedCap < quantity {
+		quantity, reason = archivedCap, AdjustmentArchived
+	}
+	purchaseLimit, limited, err := s.LineLimit(tx, line)
+	if err != nil {
+		return 0, "", err
+	}
+	if limited && purchaseLimit.Quantity < quantity {
+		quantity, reason = purchaseLimit.Quantity, AdjustmentQuantityLimit
+	}
+	limit, unlimited, err := s.MaxQuantity(tx, line.ID, perUnit)
+	if err != nil {
+		return 0, "", err
+	}
+	if !unlimited && limit < quantity {
+		quantity, reason = limit, AdjustmentInsufficientStock
+	}
+	return quantity, reason, nil
+}
+
+// deleteLine removes a cart line and releases the stock it holds.
+func (s *Service) deleteLine(tx *gorm.DB, line models.CartItem) error {
+	if _, err := s.inventory.Release(tx, line.ID); err != nil {
+		return err
+	}
+	if err := tx.Where("cart_item_id = ?", line.ID).Delete(&models.BundleSelection{}).Error; err != nil {
+		return err
+	}
+	return tx.Delete(&line).Error
+}
@@ -0,0 +1,103 @@
+package carts
+
+import (
+	"maps"
+	"slices"
+	"time"
+
+	apperrors "github.com/abdelmounim-dev/go-tshirt/internal/errors"
+	"github.com/abdelmounim-dev/go-tshirt/internal/models"
+	"gorm.io/gorm"
+)
+
+// SaveForLater moves a cart line to the saved-for-later section and releases
+// the stock it holds. It is merged into a saved line for the same item when
+// there is one. SaveForLater returns the saved line and the variants whose
+// stock was freed.
+func (s *Service) SaveForLater(tx *gorm.DB, line models.CartItem) (models.CartItem, []uint, error) {
+	released, err := s.inventory.Release(tx, line.ID)
+	if err != nil {
+		return line, nil, err
+	}
+	now := time.Now()
+	line.SavedAt = &now
+	line.FulfillmentLocationID = nil
+	line.InventoryPolicy, line.BackorderedQuantity, line.ExpectedShipDate = "", 0, nil
+	if merged, err := s.mergeLine(tx, line.CartID, line); err != nil || merged.ID != 0 {
+		return merged, released, err
+	}
+	err = tx.Model(&line).Select("saved_at", "fulfillment_location_id", "inventory_policy", "backordered_quantity", "expected_ship_date").Updates(&line).Error
+	return line, released, err
+}
+
+// MoveToCart moves a saved line back into the cart and holds stock for it
+// again, merging it into a cart line for the same item when there is one.
+// Lines whose variants were archived or deleted in the meantime, or that
+// would exceed a purchase limit, stay saved.
+// MoveToCart returns the cart line and the variants whose stock it holds.
+func (s *Service) MoveToCart(tx *gorm.DB, line models.CartItem) (models.CartItem, []uint, error) {
+	perUnit := LineVariants(line)
+	exist, err := variantsExist(tx, perUnit)
+	if err != nil {
+		return line, nil, err
+	}
+	if !exist {
+		return line, nil, &apperrors.ValidationError{Message: "Product variant no longer exists"}
+	}
+	archived, err := hasArchived(tx, perUnit)
+	if err != nil {
+		return line, nil, err
+	}
+	if archived {
+		return line, nil, &apperrors.ValidationError{Message: "Product variant is archived"}
+	}
+
+	// The limits apply to the line the saved one would become
+	active := line
+	active.SavedAt = nil
+	target, err := s.matchingLine(tx, line.CartID, active)
+	if err != nil {
+		return line, nil, err
+	}
+	check := line
+	if target.ID != 0 {
+		check = target
+	}
+	if err := s.CheckLimits(tx, check, target.Quantity+line.Quantity); err != nil {
+		return line, nil, err
+	}
+
+	line.SavedAt = nil
+	merged, err := s.mergeLine(tx, line.CartID, line)
+	if err != nil {
+		return line, nil, err
+	}
+	if merged.ID != 0 {
+		line = merged
+	} else if err := tx.Model(&line).Update("saved_at", nil).Error; err != nil {
+		return line, nil, err
+	}
+	return line, slices.Sorted(maps.Keys(perUnit)), s.ReserveLine(tx, &line, perUnit)
+}
+
+// mergeLine folds item into the matching line of cart cartID in item's
+// section and deletes item, or moves item to the cart when nothing matches.
+// It returns the line item was merged into, or a zero CartItem when it was
+// moved. Stock held by item is released; the caller reserves for the result.
+func (s *Service) mergeLine(tx *gorm.DB, cartID uint, item models.CartItem) (models.CartItem, error) {
+	target, err := s.matchingLine(tx, cartID, item)
+	if err != nil {
+		return target, err
+	}
+	if target.ID == 0 {
+		if item.CartID != cartID {
+			err = tx.Model(&item).Update("cart_id", cartID).Error
+		}
+		return target, err
+	}
+	target.Quantity += item.Quantity
+	if err := tx.Model(&target).Update("quantity", target.Quantity).Error; err != nil {
+		return target, err
+	}
+	return target, s.deleteLine(tx, item)
+}
@@ -0,0 +1,80 @@
+package carts
+
+import (
+	"errors"
+	"time"
+
+	apperrors "github.com/abdelmounim-dev/go-tshirt/internal/errors"
+	"github.com/abdelmounim-dev/go-tshirt/internal/models"
+	"gorm.io/gorm"
+)
+
+// Share snapshots the lines being bought in a cart into a new share that
+// expires after ttl, or after the default share TTL when ttl is zero. Later
+// changes to the cart do not affect the share. Mockups are shared by token so
+// the lines can be cloned with them.
+func (s *Service) Share(tx *gorm.DB, cartID uint, ttl time.Duration) (models.CartShare, error) {
+	if ttl <= 0 {
+		ttl = s.shareTTL
+	}
+	var items []models.CartItem
+	if err := tx.Preload("BundleSelections").Where("cart_id = ? AND saved_at IS NULL", cartID).Order("id").Find(&items).Error; err != nil {
+		return models.CartShare{}, err
+	}
+	if len(items) == 0 {
+		return models.CartShare{}, &apperrors.ValidationError{Message: "Cart is empty"}
+	}
+	if err := FillMockupTokens(tx, items); err != nil {
+		return models.CartShare{}, err
+	}
+
+	// Keep what describes the item, not the state of the line
+	for i := range items {
+		items[i] = models.CartItem{
+			ProductVariantID: items[i].ProductVariantID,
+			Quantity:         items[i].Quantity,
+			Personalization:  items[i].Personalization,
+			UnitPrice:        items[i].UnitPrice,
+			MockupID:         items[i].MockupID,
+			MockupToken:      items[i].MockupToken,
+			BundleProductID:  items[i].BundleProductID,
+			BundleSelections: shareSelections(items[i].BundleSelections),
+		}
+	}
+	share := models.CartShare{Items: items, ExpiresAt: time.Now().Add(ttl)}
+	err := tx.Create(&share).Error
+	return share, err
+}
+
+// shareSelections copies the variant choices of bundle selections.
+func shareSelections(selections []models.BundleSelection) []models.BundleSelection {
+	if len(selections) == 0 {
+		return nil
+	}
+	copied := make([]models.BundleSelection, len(selections))
+	for i, sel := range selections {
+		copied[i] = models.BundleSelection{ProductVariantID: sel.ProductVariantID, Quantity: sel.Quantity}
+	}
+	return copied
+}
+
+// SharedCart returns the share with the given token. A share that does not
+// exist or has expired is reported as not found.
+func (s *Service) SharedCart(tx *gorm.DB, token string) (models.CartShare, error) {
+	var share models.CartShare
+	if err := tx.Where("token = ?", token).First(&share).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return share, &apperrors.NotFoundError{Message: "Shared cart not found"}
+		}
+		return share, err
+	}
+	if !share.ExpiresAt.After(time.Now()) {
+		return share, &apperrors.NotFoundError{Message: "Shared cart has expired"}
+	}
+	return share, nil
+}
+
+// DeleteExpiredShares deletes shares that can no longer be viewed.
+func (s *Service) DeleteExpiredShares() error {
+	return s.db.Where("expires_at <= ?", time.Now()).Delete(&models.CartShare{}).Error
+}
@@ -0,0 +1,245 @@
+package carts
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/abdelmounim-dev/go-tshirt/internal/models"
+	"github.com/abdelmounim-dev/go-tshirt/internal/service/pricing"
+	"gorm.io/gorm"
+)
+
+// Codes of the warnings reported on cart lines.
+const (
+	WarningPriceIncreased    = "price_increased"
+	WarningPriceDecreased    = "price_decreased"
+	WarningVariantArchived   = "variant_archived"
+	WarningVariantMissing    = "variant_missing"
+	WarningProductMissing    = "product_missing"
+	WarningInsufficientStock = "insufficient_stock"
+	WarningQuantityLimit     = "quantity_limit_exceeded"
+)
+
+// Fixes applied to cart lines by Fix.
+const (
+	FixRemoved  = "removed"
+	FixClamped  = "clamped"
+	FixRepriced = "repriced"
+)
+
+// Warning tells the shopper that a cart line changed since it was added.
+type Warning struct {
+	CartItemID uint   `json:"cart_item_id"`
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	// Blocking warnings prevent the line from being checked out as it is.
+	Blocking bool `json:"blocking"`
+	// PreviousPrice and CurrentPrice are set for price changes.
+	PreviousPrice float64 `json:"previous_price,omitempty"`
+	CurrentPrice  float64 `json:"current_price,omitempty"`
+	// Available is the quantity the line can hold, set when stock is short.
+	Available *uint `json:"available,omitempty"`
+	// Limit is the most a line may hold, set when it is exceeded.
+	Limit *uint `json:"limit,omitempty"`
+	// Fix is how the line was corrected, when it was.
+	Fix string `json:"fix,omitempty"`
+}
+
+// Warnings compares the priced lines of a cart with their variants' status
+// and stock, the purchase limits and the unit price each line was added at.
+// Lines need their bundle selections loaded.
+func (s *Service) Warnings(tx *gorm.DB, quote pricing.Quote) ([]Warning, error) {
+	warnings := []Warning{}
+	if len(quote.Lines) == 0 {
+		return warnings, nil
+	}
+	extra, err := s.extraLines(tx, quote.Lines[0].Item.CartID)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range quote.Lines {
+		perUnit := LineVariants(l.Item)
+		exist, err := variantsExist(tx, perUnit)
+		if err != nil {
+			return nil, err
+		}
+		if !exist {
+			warnings = append(warnings, Warning{
+				CartItemID: l.CartItemID,
+				Code:       WarningVariantMissing,
+				Message:    "Product variant no longer exists",
+				Blocking:   true,
+			})
+			continue
+		}
+		if l.Product.ID == 0 {
+			warnings = append(warnings, Warning{
+				CartItemID: l.CartItemID,
+				Code:       WarningProductMissing,
+				Message:    "Product no longer exists",
+				Blocking:   true,
+			})
+			continue
+		}
+
+		archived, err := hasArchived(tx, perUnit)
+		if err != nil {
+			return nil, err
+		}
+		if archived {
+			warnings = append(warnings, Warning{
+				CartItemID: l.CartItemID,
+				Code:       WarningVariantArchived,
+				Message:    "Product variant is archived",
+			})
+		}
+
+		if extra[l.CartItemID] {
+			limit := Limit{Code: LimitCartLines, Max: s.maxCartLines}
+			warnings = append(warnings, Warning{
+				CartItemID: l.CartItemID,
+				Code:       limit.Code,
+				Message:    limit.Message(),
+				Blocking:   true,
+				Limit:      &limit.Max,
+			})
+		}
+		limit, limited, err := s.LineLimit(tx, l.Item)
+		if err != nil {
+			return nil, err
+		}
+		if limited && l.Quantity > limit.Quantity {
+			warnings = append(warnings, Warning{
+				CartItemID: l.CartItemID,
+				Code:       limit.Code,
+				Message:    limit.Message(),
+				Blocking:   true,
+				Limit:      &limit.Quantity,
+			})
+		}
+
+		available, unlimited, err := s.MaxQuantity(tx, l.CartItemID, perUnit)
+		if err != nil {
+			return nil, err
+		}
+		if !unlimited && available < l.Quantity {
+			warnings = append(warnings, Warning{
+				CartItemID: l.CartItemID,
+				Code:       WarningInsufficientStock,
+				Message:    fmt.Sprintf("Only %d available", available),
+				Blocking:   true,
+				Available:  &available,
+			})
+		}
+
+		// Lines added before prices were recorded have nothing to compare
+		previous := l.Item.UnitPrice
+		if previous == 0 || l.UnitPrice == previous {
+			continue
+		}
+		w := Warning{CartItemID: l.CartItemID, PreviousPrice: previous, CurrentPrice: l.UnitPrice}
+		if l.UnitPrice > previous {
+			// The shopper must accept a higher price before paying it
+			w.Code, w.Message = WarningPriceIncreased, fmt.Sprintf("Price increased from %.2f to %.2f", previous, l.UnitPrice)
+			w.Blocking = true
+		} else {
+			w.Code, w.Message = WarningPriceDecreased, fmt.Sprintf("Price decreased from %.2f to %.2f", previous, l.UnitPrice)
+		}
+		warnings = append(warnings, w)
+	}
+	return warnings, nil
+}
+
+// Fix corrects the lines the warnings are about and records on each warning
+// how: lines whose variant or product is gone, or beyond the cart's lines
+// limit, are removed, lines over a purchase limit or available stock are
+// clamped (and removed when nothing is left), and changed prices are accepted
+// as the line's new unit price. Lines are removed first, and purchase limits
+// are re-checked as the lines before are clamped, so a shared limit is not
+// cut back twice. Archived variants are left alone while they have stock.
+// Fix returns the variants whose reservations changed.
+func (s *Service) Fix(tx *gorm.DB, quote pricing.Quote, warnings []Warning) ([]uint, error) {
+	byLine := map[uint][]int{}
+	for i, w := range warnings {
+		byLine[w.CartItemID] = append(byLine[w.CartItemID], i)
+	}
+	removes := func(indexes []int) bool {
+		for _, i := range indexes {
+			switch warnings[i].Code {
+			case WarningVariantMissing, WarningProductMissing, LimitCartLines:
+				return true
+			}
+		}
+		return false
+	}
+
+	changed := map[uint]bool{}
+	for _, removal := range []bool{true, false} {
+		for _, l := range quote.Lines {
+			indexes := byLine[l.CartItemID]
+			if len(indexes) == 0 || removes(indexes) != removal {
+				continue
+			}
+			if err := s.fixLine(tx, l.Item, warnings, indexes, changed); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return slices.Sorted(maps.Keys(changed)), nil
+}
+
+// fixLine corrects one line for the warnings at indexes, adding the variants
+// whose reservations changed to changed.
+func (s *Service) fixLine(tx *gorm.DB, line models.CartItem, warnings []Warning, indexes []int, changed map[uint]bool) error {
+	quantity, fix := line.Quantity, ""
+	for _, i := range indexes {
+		w := &warnings[i]
+		switch w.Code {
+		case WarningVariantMissing, WarningProductMissing, LimitCartLines:
+			quantity, fix = 0, FixRemoved
+		case LimitLineQuantity, LimitVariantQuantity, LimitProductQuantity, LimitCartQuantity:
+			limit, limited, err := s.LineLimit(tx, line)
+			if err != nil {
+				return err
+			}
+			if limited {
+				quantity = min(quantity, limit.Quantity)
+			}
+			fix = cmp.Or(fix, FixClamped)
+		case WarningInsufficientStock:
+			quantity, fix = min(quantity, *w.Available), cmp.Or(fix, FixClamped)
+		case WarningPriceIncreased, WarningPriceDecreased:
+			line.UnitPrice, w.Fix = w.CurrentPrice, FixRepriced
+			if err := tx.Model(&line).Update("unit_price", line.UnitPrice).Error; err != nil {
+				return err
+			}
+		}
+	}
+	if fix == "" {
+		return nil
+	}
+	if quantity == 0 {
+		fix = FixRemoved
+	}
+	// Warnings already fixed, such as a repriced line, keep their own fix
+	for _, i := range indexes {
+		if warnings[i].Blocking && warnings[i].Fix == "" {
+			warnings[i].Fix = fix
+		}
+	}
+
+	perUnit := LineVariants(line)
+	for id := range perUnit {
+		changed[id] = true
+	}
+	if quantity == 0 {
+		return s.deleteLine(tx, line)
+	}
+	line.Quantity = quantity
+	if err := tx.Model(&line).Update("quantity", quantity).Error; err != nil {
+		return err
+	}
+	return s.ReserveLine(tx, &line, perUnit)
+}
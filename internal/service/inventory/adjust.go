@@ -0,0 +1,230 @@
+package inventory
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	apperrors "github.com/abdelmounim-dev/go-tshirt/internal/errors"
+	"github.com/abdelmounim-dev/go-tshirt/internal/models"
+	"gorm.io/gorm"
+)
+
+// Adjustment is a manual stock correction. Exactly one of Delta (relative) and
+// Quantity (absolute) is set. When LocationID is set the correction applies to
+// the stock level at that location.
+type Adjustment struct {
+	ProductVariantID uint
+	LocationID       *uint
+	Delta            *int
+	Quantity         *uint
+	ReasonCode       string
+	Note             string
+	Actor            string
+}
+
+// Adjust applies a manual stock correction and returns the movement it
+// recorded, or nil when an absolute quantity already matched.
+func (s *Service) Adjust(tx *gorm.DB, a Adjustment) (*models.InventoryMovement, error) {
+	if (a.Delta == nil) == (a.Quantity == nil) {
+		return nil, &apperrors.ValidationError{Message: "Exactly one of delta and quantity is required"}
+	}
+	m := models.InventoryMovement{
+		Type:       movementTypeFor(a.ReasonCode),
+		LocationID: a.LocationID,
+		Reason:     a.ReasonCode,
+		Actor:      a.Actor,
+	}
+	if a.Note != "" {
+		m.Reason += ": " + a.Note
+	}
+
+	if a.Quantity != nil {
+		return s.SetStock(tx, a.ProductVariantID, *a.Quantity, m)
+	}
+	if *a.Delta == 0 {
+		return nil, nil
+	}
+	m.ProductVariantID = a.ProductVariantID
+	m.Quantity = *a.Delta
+	if err := s.Record(tx, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// movementTypeFor returns the ledger movement type for an adjustment reason code.
+func movementTypeFor(reasonCode string) string {
+	switch reasonCode {
+	case models.ReasonDamage:
+		return models.MovementDamage
+	case models.ReasonReturn:
+		return models.MovementReturn
+	default:
+		return models.MovementAdjustment
+	}
+}
+
+// StockCountLine is one counted variant from a stock count upload. The
+// variant is identified by ProductVariantID or, when that is zero, by SKU.
+type StockCountLine struct {
+	Line             int    `json:"line"`
+	ProductVariantID uint   `json:"product_variant_id"`
+	SKU              string `json:"sku,omitempty"`
+	Expected         uint   `json:"expected"`
+	Counted          uint   `json:"counted"`
+	Difference       int    `json:"difference"`
+}
+
+// StockCountReport lists every counted variant and how many differed from the
+// recorded stock.
+type StockCountReport struct {
+	Applied       bool             `json:"applied"`
+	Discrepancies int              `json:"discrepancies"`
+	Lines         []StockCountLine `json:"lines"`
+}
+
+// ParseStockCount reads a stock count CSV. The header must name a quantity
+// column and a variant_id and/or sku column; other columns are ignored.
+func ParseStockCount(r io.Reader) ([]StockCountLine, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, &apperrors.ValidationError{Message: "Stock count is empty"}
+	}
+	if err != nil {
+		return nil, &apperrors.ValidationError{Message: fmt.Sprintf("Invalid CSV: %v", err)}
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	quantityCol, ok := columns["quantity"]
+	if !ok {
+		return nil, &apperrors.ValidationError{Message: "Stock count requires a quantity column"}
+	}
+	variantCol, hasVariant := columns["variant_id"]
+	skuCol, hasSKU := columns["sku"]
+	if !hasVariant && !hasSKU {
+		return nil, &apperrors.ValidationError{Message: "Stock count requires a variant_id or sku column"}
+	}
+
+	var lines []StockCountLine
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, &apperrors.ValidationError{Message: fmt.Sprintf("Invalid CSV: %v", err)}
+		}
+		lineNo, _ := reader.FieldPos(0)
+
+		line := StockCountLine{Line: lineNo}
+		if hasVariant && strings.TrimSpace(record[variantCol]) != "" {
+			id, err := strconv.ParseUint(strings.TrimSpace(record[variantCol]), 10, 0)
+			if err != nil {
+				return nil, &apperrors.ValidationError{Message: fmt.Sprintf("Line %d: invalid variant_id", lineNo)}
+			}
+			line.ProductVariantID = uint(id)
+		}
+		if hasSKU {
+			line.SKU = strings.TrimSpace(record[skuCol])
+		}
+		if line.ProductVariantID == 0 && line.SKU == "" {
+			return nil, &apperrors.ValidationError{Message: fmt.Sprintf("Line %d: variant_id or sku is required", lineNo)}
+		}
+		counted, err := strconv.ParseUint(strings.TrimSpace(record[quantityCol]), 10, 0)
+		if err != nil {
+			return nil, &apperrors.ValidationError{Message: fmt.Sprintf("Line %d: invalid quantity", lineNo)}
+		}
+		line.Counted = uint(counted)
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 {
+		return nil, &apperrors.ValidationError{Message: "Stock count is empty"}
+	}
+	return lines, nil
+}
+
+// ApplyStockCount compares counted quantities with recorded stock, at
+// locationID when it is set, and sets stock to the counted quantity for each
+// discrepancy. Callers run it in a transaction so a count is applied in full
+// or not at all.
+func (s *Service) ApplyStockCount(tx *gorm.DB, lines []StockCountLine, locationID *uint, actor string) (StockCountReport, error) {
+	report := StockCountReport{Lines: lines}
+	seen := map[uint]int{}
+	for i := range report.Lines {
+		line := &report.Lines[i]
+
+		variant, err := s.countedVariant(tx, *line)
+		if err != nil {
+			return report, err
+		}
+		if first, ok := seen[variant.ID]; ok {
+			return report, &apperrors.ValidationError{Message: fmt.Sprintf("Line %d: variant %d was already counted on line %d", line.Line, variant.ID, first)}
+		}
+		seen[variant.ID] = line.Line
+		line.ProductVariantID = variant.ID
+		line.SKU = variant.SKU
+
+		line.Expected = variant.Stock
+		if locationID != nil {
+			var level models.StockLevel
+			err := tx.Where("location_id = ? AND product_variant_id = ?", *locationID, variant.ID).Limit(1).Find(&level).Error
+			if err != nil {
+				return report, err
+			}
+			line.Expected = level.Quantity
+		}
+		line.Difference = int(line.Counted) - int(line.Expected)
+		if line.Difference == 0 {
+			continue
+		}
+		report.Discrepancies++
+
+		_, err = s.SetStock(tx, variant.ID, line.Counted, models.InventoryMovement{
+			Type:       models.MovementAdjustment,
+			LocationID: locationID,
+			Reason:     models.ReasonCount,
+			Actor:      actor,
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+	report.Applied = true
+	return report, nil
+}
+
+// countedVariant finds the variant a stock count line refers to.
+func (s *Service) countedVariant(tx *gorm.DB, line StockCountLine) (models.ProductVariant, error) {
+	var variant models.ProductVariant
+	if line.ProductVariantID != 0 {
+		if err := tx.First(&variant, line.ProductVariantID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return variant, &apperrors.ValidationError{Message: fmt.Sprintf("Line %d: variant %d not found", line.Line, line.ProductVariantID)}
+			}
+			return variant, err
+		}
+		return variant, nil
+	}
+
+	var variants []models.ProductVariant
+	if err := tx.Where("sku = ?", line.SKU).Limit(2).Find(&variants).Error; err != nil {
+		return variant, err
+	}
+	switch len(variants) {
+	case 0:
+		return variant, &apperrors.ValidationError{Message: fmt.Sprintf("Line %d: SKU %q not found", line.Line, line.SKU)}
+	case 1:
+		return variants[0], nil
+	default:
+		return variant, &apperrors.ValidationError{Message: fmt.Sprintf("Line %d: SKU %q matches more than one variant", line.Line, line.SKU)}
+	}
+}
@@ -0,0 +1,159 @@
+package inventory
+
+import (
+	"fmt"
+	"net/mail"
+	"net/url"
+	"time"
+
+	"github.com/abdelmounim-dev/go-tshirt/internal/db"
+	apperrors "github.com/abdelmounim-dev/go-tshirt/internal/errors"
+	"github.com/abdelmounim-dev/go-tshirt/internal/models"
+	"github.com/abdelmounim-dev/go-tshirt/internal/service/notify"
+	"gorm.io/gorm"
+)
+
+// EventBackInStock is the outbox event queued for back-in-stock subscribers.
+const EventBackInStock = "inventory.back_in_stock"
+
+// DefaultBackInStockCooldown is used when Options.BackInStockCooldown is not set.
+const DefaultBackInStockCooldown = time.Hour
+
+// Subscribe records a request to be notified when a variant with no stock
+// available is back in stock. A pending subscription for the same target is
+// returned as is, with created set to false.
+func (s *Service) Subscribe(tx *gorm.DB, sub models.StockSubscription) (models.StockSubscription, bool, error) {
+	if err := validateTarget(sub.Channel, sub.Target); err != nil {
+		return sub, false, err
+	}
+
+	available, err := s.Available(tx, sub.ProductVariantID)
+	if err != nil {
+		return sub, false, err
+	}
+	if available > 0 {
+		return sub, false, &apperrors.ValidationError{Message: "Product variant is in stock"}
+	}
+
+	var existing models.StockSubscription
+	err = tx.Where("product_variant_id = ? AND channel = ? AND target = ? AND notified_at IS NULL", sub.ProductVariantID, sub.Channel, sub.Target).
+		Limit(1).Find(&existing).Error
+	if err != nil {
+		return sub, false, err
+	}
+	if existing.ID != 0 {
+		return existing, false, nil
+	}
+
+	sub.ID = 0
+	sub.NotifiedAt = nil
+	if err := tx.Create(&sub).Error; err != nil {
+		return sub, false, err
+	}
+	return sub, true, nil
+}
+
+// validateTarget checks that target suits the subscription channel.
+func validateTarget(channel, target string) error {
+	switch channel {
+	case notify.ChannelEmail:
+		if _, err := mail.ParseAddress(target); err != nil {
+			return &apperrors.ValidationError{Message: "target must be an email address"}
+		}
+	case notify.ChannelWebhook:
+		u, err := url.Parse(target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return &apperrors.ValidationError{Message: "target must be an http or https URL"}
+		}
+		if !notify.PublicHost(u.Hostname()) {
+			return &apperrors.ValidationError{Message: "target must not be a local or private address"}
+		}
+	}
+	return nil
+}
+
+// QueueBackInStock queues messages for the pending subscribers of every
+// variant that is available again and past its cooldown, and returns how many
+// were queued. It picks up the subscribers a restock during the cooldown left
+// pending.
+func (s *Service) QueueBackInStock() (int, error) {
+	var variantIDs []uint
+	err := s.db.Model(&models.StockSubscription{}).
+		Where("notified_at IS NULL").
+		Distinct().
+		Order("product_variant_id").
+		Pluck("product_variant_id", &variantIDs).Error
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, id := range variantIDs {
+		var queued int
+		err := db.Transaction(s.db, func(tx *gorm.DB) error {
+			var err error
+			queued, err = s.queueBackInStock(tx, id)
+			return err
+		})
+		if err != nil {
+			return total, err
+		}
+		total += queued
+	}
+	return total, nil
+}
+
+// queueBackInStock queues a message in the outbox for every pending
+// subscriber of a variant that has stock available, and returns how many
+// were queued. Subscriptions are one-shot: each is marked notified as it is
+// queued. A variant notifies at most once per cooldown, so stock flapping
+// around zero does not flood the outbox; subscribers are left pending until
+// the cooldown is over and QueueBackInStock picks them up.
+func (s *Service) queueBackInStock(tx *gorm.DB, variantID uint) (int, error) {
+	var subs []models.StockSubscription
+	if err := tx.Where("product_variant_id = ? AND notified_at IS NULL", variantID).Order("id").Find(&subs).Error; err != nil {
+		return 0, err
+	}
+	if len(subs) == 0 {
+		return 0, nil
+	}
+
+	now := time.Now()
+	var recent int64
+	err := tx.Model(&models.StockSubscription{}).
+		Where("product_variant_id = ? AND notified_at > ?", variantID, now.Add(-s.backInStockCooldown)).
+		Count(&recent).Error
+	if err != nil || recent > 0 {
+		return 0, err
+	}
+	available, err := s.Available(tx, variantID)
+	if err != nil || available <= 0 {
+		return 0, err
+	}
+
+	var variant models.ProductVariant
+	if err := tx.First(&variant, variantID).Error; err != nil {
+		return 0, err
+	}
+	var product models.Product
+	if err := tx.Select("name").First(&product, variant.ProductID).Error; err != nil {
+		return 0, err
+	}
+	subject := fmt.Sprintf("Back in stock: %s (%s, %s)", product.Name, variant.Color, variant.Size)
+	body := fmt.Sprintf("%s in %s, size %s, is available again.", product.Name, variant.Color, variant.Size)
+
+	ids := make([]uint, len(subs))
+	for i, sub := range subs {
+		ids[i] = sub.ID
+		err := tx.Create(&models.OutboxMessage{
+			Channel:   sub.Channel,
+			Event:     EventBackInStock,
+			Recipient: sub.Target,
+			Subject:   subject,
+			Body:      body,
+		}).Error
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(subs), tx.Model(&models.StockSubscription{}).Where("id IN ?", ids).Update("notified_at", now).Error
+}
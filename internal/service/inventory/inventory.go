@@ -0,0 +1,893 @@
+// Package inventory tracks variant stock, the reservations that cart items
+// hold against it and the ledger of every change.
+package inventory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/abdelmounim-dev/go-tshirt/internal/db"
+	apperrors "github.com/abdelmounim-dev/go-tshirt/internal/errors"
+	"github.com/abdelmounim-dev/go-tshirt/internal/models"
+	"github.com/abdelmounim-dev/go-tshirt/internal/service/notify"
+	"gorm.io/gorm"
+)
+
+// DefaultReservationTTL is used when Options.ReservationTTL is not set.
+const DefaultReservationTTL = 30 * time.Minute
+
+// SystemActor is recorded on movements that are not caused by a person.
+const SystemActor = "system"
+
+// ErrInsufficientStock is returned when a variant cannot cover a reservation.
+var ErrInsufficientStock = &apperrors.ValidationError{Message: "Insufficient stock", Code: "insufficient_stock"}
+
+// ErrLocationRequired is returned when a stock change without a location
+// would leave a variant's stock levels out of step with its total.
+var ErrLocationRequired = &apperrors.ValidationError{Message: "A location is required to change the stock of a variant held at locations", Code: "location_required"}
+
+// Options configures a Service.
+type Options struct {
+	// ReservationTTL is how long a cart item holds stock after it was last changed.
+	ReservationTTL time.Duration
+	// Notifier receives low-stock alerts. Alerts are logged when it is nil.
+	Notifier notify.Notifier
+	// BackInStockCooldown is the minimum time between two back-in-stock
+	// notification rounds for the same variant.
+	BackInStockCooldown time.Duration
+}
+
+// Service manages stock levels and reservations. Methods that take a *gorm.DB
+// run against it so callers can include them in their own transactions.
+type Service struct {
+	db                  *gorm.DB
+	ttl                 time.Duration
+	notifier            notify.Notifier
+	backInStockCooldown time.Duration
+}
+
+func NewService(db *gorm.DB, opts Options) *Service {
+	if opts.ReservationTTL <= 0 {
+		opts.ReservationTTL = DefaultReservationTTL
+	}
+	if opts.Notifier == nil {
+		opts.Notifier = notify.LogNotifier{}
+	}
+	if opts.BackInStockCooldown <= 0 {
+		opts.BackInStockCooldown = DefaultBackInStockCooldown
+	}
+	return &Service{
+		db:                  db,
+		ttl:                 opts.ReservationTTL,
+		notifier:            opts.Notifier,
+		backInStockCooldown: opts.BackInStockCooldown,
+	}
+}
+
+// Available returns the on-hand stock of a variant, less the stock at disabled
+// locations, the units owed to backorders and its active reservations.
+func (s *Service) Available(tx *gorm.DB, variantID uint) (int, error) {
+	var variant models.ProductVariant
+	if err := tx.First(&variant, variantID).Error; err != nil {
+		return 0, err
+	}
+	sellable, err := s.sellable(tx, variant)
+	if err != nil {
+		return 0, err
+	}
+	reserved, err := s.reserved(tx, variantID, 0)
+	if err != nil {
+		return 0, err
+	}
+	return sellable - reserved, nil
+}
+
+// FillAvailability sets Available on each variant.
+func (s *Service) FillAvailability(tx *gorm.DB, variants []models.ProductVariant) error {
+	if len(variants) == 0 {
+		return nil
+	}
+	ids := make([]uint, len(variants))
+	for i, v := range variants {
+		ids[i] = v.ID
+	}
+
+	var rows []struct {
+		ProductVariantID uint
+		Reserved         int
+	}
+	err := tx.Model(&models.StockReservation{}).
+		Select("product_variant_id, SUM(quantity) AS reserved").
+		Where("product_variant_id IN ? AND expires_at > ?", ids, time.Now()).
+		Group("product_variant_id").
+		Scan(&rows).Error
+	if err != nil {
+		return err
+	}
+	reserved := make(map[uint]int, len(rows))
+	for _, r := range rows {
+		reserved[r.ProductVariantID] = r.Reserved
+	}
+	disabled, err := s.disabledStock(tx, ids...)
+	if err != nil {
+		return err
+	}
+	owed, err := s.outstanding(tx, ids...)
+	if err != nil {
+		return err
+	}
+
+	for i := range variants {
+		id := variants[i].ID
+		available := int(variants[i].Stock) - disabled[id] - owed[id] - reserved[id]
+		variants[i].Available = &available
+	}
+	return nil
+}
+
+// Record appends m to the ledger. Movements that change on-hand stock are
+// applied to the variant first; a decrement that would take stock below zero
+// returns ErrInsufficientStock. Stock freed by an increment of any kind is
+// allocated to outstanding backorders first, and what is left available
+// queues back-in-stock notifications. Once a variant has stock levels, on-hand
+// movements without a location may only draw down the stock not assigned to
+// a location; others return ErrLocationRequired.
+func (s *Service) Record(tx *gorm.DB, m *models.InventoryMovement) error {
+	if m.Actor == "" {
+		m.Actor = SystemActor
+	}
+	if m.ChangesOnHand() && m.LocationID == nil && m.Quantity != 0 {
+		unassigned, located, err := s.unassigned(tx, m.ProductVariantID)
+		if err != nil {
+			return err
+		}
+		if located && (m.Quantity > 0 || -m.Quantity > unassigned) {
+			return ErrLocationRequired
+		}
+	}
+	if m.ChangesLocation() && m.Quantity != 0 {
+		if err := s.adjustLevel(tx, *m.LocationID, m.ProductVariantID, m.Quantity); err != nil {
+			return err
+		}
+	}
+	if m.ChangesOnHand() && m.Quantity != 0 {
+		result := tx.Model(&models.ProductVariant{}).
+			Where("id = ? AND stock + ? >= 0", m.ProductVariantID, m.Quantity).
+			Update("stock", gorm.Expr("stock + ?", m.Quantity))
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			if err := tx.First(&models.ProductVariant{}, m.ProductVariantID).Error; err != nil {
+				return err
+			}
+			return ErrInsufficientStock
+		}
+	}
+	if err := tx.Create(m).Error; err != nil {
+		return err
+	}
+	if m.Quantity <= 0 {
+		return nil
+	}
+	if err := s.fillBackorders(tx, m.ProductVariantID); err != nil {
+		return err
+	}
+	_, err := s.queueBackInStock(tx, m.ProductVariantID)
+	return err
+}
+
+// RecordInitialStock logs a receipt for stock that was set directly when the
+// variant was created.
+func (s *Service) RecordInitialStock(tx *gorm.DB, variant models.ProductVariant, actor string) error {
+	if variant.Stock == 0 {
+		return nil
+	}
+	if actor == "" {
+		actor = SystemActor
+	}
+	return tx.Create(&models.InventoryMovement{
+		ProductVariantID: variant.ID,
+		Type:             models.MovementReceipt,
+		Quantity:         int(variant.Stock),
+		Reason:           "initial stock",
+		Actor:            actor,
+	}).Error
+}
+
+// SetStock records the movement needed to bring a variant's on-hand stock to
+// quantity, using m for its type, reason, actor and reference. When m has a
+// LocationID the stock level at that location is set instead of the total,
+// which variants held at locations require. It returns nil when the stock
+// already matches.
+func (s *Service) SetStock(tx *gorm.DB, variantID, quantity uint, m models.InventoryMovement) (*models.InventoryMovement, error) {
+	var variant models.ProductVariant
+	if err := tx.First(&variant, variantID).Error; err != nil {
+		return nil, err
+	}
+	current := variant.Stock
+	if m.LocationID != nil {
+		var level models.StockLevel
+		err := tx.Where("location_id = ? AND product_variant_id = ?", *m.LocationID, variantID).Limit(1).Find(&level).Error
+		if err != nil {
+			return nil, err
+		}
+		current = level.Quantity
+	}
+	delta := int(quantity) - int(current)
+	if delta == 0 {
+		return nil, nil
+	}
+	m.ProductVariantID = variantID
+	m.Quantity = delta
+	if err := s.Record(tx, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// Reconciliation compares a variant's stored stock with the stock derived from
+// its ledger.
+type Reconciliation struct {
+	Stock       uint `json:"stock"`
+	LedgerStock int  `json:"ledger_stock"`
+	Difference  int  `json:"difference"`
+}
+
+// Reconcile sums the on-hand movements of a variant and compares them with its
+// stored stock.
+func (s *Service) Reconcile(tx *gorm.DB, variantID uint) (Reconciliation, error) {
+	var variant models.ProductVariant
+	if err := tx.First(&variant, variantID).Error; err != nil {
+		return Reconciliation{}, err
+	}
+	var ledger int
+	err := tx.Model(&models.InventoryMovement{}).
+		Select("COALESCE(SUM(quantity), 0)").
+		Where("product_variant_id = ? AND type NOT IN ?", variantID, []string{models.MovementReservation, models.MovementRelease, models.MovementTransfer}).
+		Scan(&ledger).Error
+	if err != nil {
+		return Reconciliation{}, err
+	}
+	return Reconciliation{
+		Stock:       variant.Stock,
+		LedgerStock: ledger,
+		Difference:  int(variant.Stock) - ledger,
+	}, nil
+}
+
+// BackfillOpeningBalances records an adjustment for variants whose stock
+// predates the ledger, so that reconciliation starts from zero difference.
+func (s *Service) BackfillOpeningBalances() error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var variants []models.ProductVariant
+		err := tx.Where("stock > 0 AND id NOT IN (?)", tx.Model(&models.InventoryMovement{}).Select("product_variant_id")).
+			Find(&variants).Error
+		if err != nil {
+			return err
+		}
+		for _, v := range variants {
+			err := tx.Create(&models.InventoryMovement{
+				ProductVariantID: v.ID,
+				Type:             models.MovementAdjustment,
+				Quantity:         int(v.Stock),
+				Reason:           "opening balance",
+				Actor:            SystemActor,
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Reserve sets the quantity of a variant held by a cart item and renews the
+// reservation's expiry. It returns ErrInsufficientStock when the variant's
+// stock, less what other cart items hold and what is owed to backorders,
+// cannot cover quantity, unless the
+// variant's policy allows backorders or preorders within its limit; the
+// uncovered part is then recorded as Backordered. The reservation is assigned
+// to the highest priority location able to fulfil it, or to no location when
+// none can on its own.
+func (s *Service) Reserve(tx *gorm.DB, cartItemID, variantID, quantity uint) (models.StockReservation, error) {
+	var reservation models.StockReservation
+
+	var variant models.ProductVariant
+	if err := tx.First(&variant, variantID).Error; err != nil {
+		return reservation, err
+	}
+
+	now := time.Now()
+	err := tx.Where("cart_item_id = ? AND product_variant_id = ?", cartItemID, variantID).
+		Attrs(models.StockReservation{CartItemID: cartItemID, ProductVariantID: variantID, ExpiresAt: now}).
+		FirstOrCreate(&reservation).Error
+	if err != nil {
+		return reservation, err
+	}
+	// A hold that lapsed without being swept is released below, once the new
+	// one is claimed, so the ledger records its stock coming back
+	held, lapsed, lapsedAt := 0, uint(0), reservation.LocationID
+	if reservation.ExpiresAt.After(now) {
+		held = int(reservation.Quantity)
+	} else {
+		lapsed = reservation.Quantity
+	}
+
+	// Claim the stock with a single conditional update, so that two carts
+	// cannot both see the last units as free and take them. Shrinking a hold
+	// always succeeds, even if stock has since dropped below it.
+	claim := tx.Model(&models.StockReservation{}).Where("id = ?", reservation.ID)
+	if int(quantity) > held && (!variant.AllowsOversell() || variant.BackorderLimit > 0) {
+		allowance := 0
+		if variant.AllowsOversell() {
+			allowance = int(variant.BackorderLimit)
+		}
+		stock := tx.Model(&models.ProductVariant{}).Select("stock").Where("id = ?", variantID)
+		disabled := disabledLevels(tx).
+			Select("COALESCE(SUM(stock_levels.quantity), 0)").
+			Where("stock_levels.product_variant_id = ?", variantID)
+		owed := tx.Model(&models.Backorder{}).
+			Select("COALESCE(SUM(outstanding), 0)").
+			Where("product_variant_id = ?", variantID)
+		others := tx.Model(&models.StockReservation{}).
+			Select("COALESCE(SUM(quantity), 0)").
+			Where("product_variant_id = ? AND cart_item_id <> ? AND expires_at > ?", variantID, cartItemID, now)
+		claim = claim.Where("(?) - (?) - (?) - (?) + ? >= ?", stock, disabled, owed, others, allowance, quantity)
+	}
+	result := claim.Updates(map[string]interface{}{"quantity": quantity, "expires_at": now.Add(s.ttl)})
+	if result.Error != nil {
+		return reservation, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return reservation, ErrInsufficientStock
+	}
+	reservation.Quantity = quantity
+	reservation.ExpiresAt = now.Add(s.ttl)
+
+	// The claim holds the write lock, so these reads are consistent with it
+	sellable, err := s.sellable(tx, variant)
+	if err != nil {
+		return reservation, err
+	}
+	reserved, err := s.reserved(tx, variantID, cartItemID)
+	if err != nil {
+		return reservation, err
+	}
+	free := sellable - reserved
+	reservation.Backordered = uint(max(int(quantity)-max(free, 0), 0))
+	if reservation.LocationID, err = s.fulfillmentLocation(tx, variantID, cartItemID, quantity); err != nil {
+		return reservation, err
+	}
+	err = tx.Model(&reservation).Select("backordered", "location_id").Updates(&reservation).Error
+	if err != nil {
+		return reservation, err
+	}
+
+	if lapsed > 0 {
+		err := s.Record(tx, &models.InventoryMovement{
+			ProductVariantID: variantID,
+			Type:             models.MovementRelease,
+			Quantity:         int(lapsed),
+			Reason:           "expired",
+			LocationID:       lapsedAt,
+			Reference:        cartItemReference(cartItemID),
+		})
+		if err != nil {
+			return reservation, err
+		}
+	}
+
+	delta := int(quantity) - held
+	if delta == 0 {
+		return reservation, nil
+	}
+	movement := models.InventoryMovement{
+		ProductVariantID: variantID,
+		Type:             models.MovementReservation,
+		Quantity:         -delta,
+		LocationID:       reservation.LocationID,
+		Reference:        cartItemReference(cartItemID),
+	}
+	if delta < 0 {
+		movement.Type = models.MovementRelease
+	}
+	return reservation, s.Record(tx, &movement)
+}
+
+// Reservable returns the most units of a variant a cart item could hold: the
+// sellable stock other cart items do not hold plus, for variants sold beyond stock,
+// what remains of the backorder limit. It returns true instead when the variant can be sold
+// beyond stock without limit.
+func (s *Service) Reservable(tx *gorm.DB, variantID, cartItemID uint) (int, bool, error) {
+	var variant models.ProductVariant
+	if err := tx.First(&variant, variantID).Error; err != nil {
+		return 0, false, err
+	}
+	if variant.AllowsOversell() && variant.BackorderLimit == 0 {
+		return 0, true, nil
+	}
+	sellable, err := s.sellable(tx, variant)
+	if err != nil {
+		return 0, false, err
+	}
+	reserved, err := s.reserved(tx, variantID, cartItemID)
+	if err != nil {
+		return 0, false, err
+	}
+	n := sellable - reserved
+	if variant.AllowsOversell() {
+		n += int(variant.BackorderLimit)
+	}
+	return max(n, 0), false, nil
+}
+
+// Transfer moves stock of a variant between two locations, recording a
+// transfer out of one and into the other.
+func (s *Service) Transfer(tx *gorm.DB, variantID, fromID, toID, quantity uint, reason, actor string) error {
+	if fromID == toID {
+		return &apperrors.ValidationError{Message: "Cannot transfer stock to the same location"}
+	}
+	if quantity == 0 {
+		return &apperrors.ValidationError{Message: "Transfer quantity must be positive"}
+	}
+	for _, id := range []uint{fromID, toID} {
+		if err := tx.First(&models.Location{}, id).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return &apperrors.NotFoundError{Message: fmt.Sprintf("Location %d not found", id)}
+			}
+			return err
+		}
+	}
+
+	reference := fmt.Sprintf("transfer:%d->%d", fromID, toID)
+	out := models.InventoryMovement{
+		ProductVariantID: variantID,
+		Type:             models.MovementTransfer,
+		Quantity:         -int(quantity),
+		LocationID:       &fromID,
+		Reason:           reason,
+		Actor:            actor,
+		Reference:        reference,
+	}
+	if err := s.Record(tx, &out); err != nil {
+		return err
+	}
+	in := out
+	in.ID = 0
+	in.Quantity = int(quantity)
+	in.LocationID = &toID
+	return s.Record(tx, &in)
+}
+
+// Release drops every reservation held by a cart item and returns the
+// variants whose stock was freed.
+func (s *Service) Release(tx *gorm.DB, cartItemID uint) ([]uint, error) {
+	released, err := s.release(tx, tx.Where("cart_item_id = ?", cartItemID), "")
+	return reservedVariants(released), err
+}
+
+// ReleaseCart drops every reservation held by the items of a cart and returns
+// the variants whose stock was freed.
+func (s *Service) ReleaseCart(tx *gorm.DB, cartID uint) ([]uint, error) {
+	itemIDs := tx.Model(&models.CartItem{}).Select("id").Where("cart_id = ?", cartID)
+	released, err := s.release(tx, tx.Where("cart_item_id IN (?)", itemIDs), "")
+	return reservedVariants(released), err
+}
+
+// Commit turns a cart item's reservations into permanent stock decrements.
+// Expired reservations are re-checked against current availability first.
+// Backordered units are not decremented; they are recorded as a backorder
+// under reference and allocated stock when it is received.
+// A reservation is sold from its location; one without a location, or whose
+// location can no longer cover it, is sold from the stock not assigned to a
+// location first and then from enabled locations in priority order.
+func (s *Service) Commit(tx *gorm.DB, cartItemID uint, reference string) error {
+	var reservations []models.StockReservation
+	if err := tx.Where("cart_item_id = ?", cartItemID).Order("product_variant_id").Find(&reservations).Error; err != nil {
+		return err
+	}
+	for _, r := range reservations {
+		if !r.ExpiresAt.After(time.Now()) {
+			var err error
+			if r, err = s.Reserve(tx, cartItemID, r.ProductVariantID, r.Quantity); err != nil {
+				return err
+			}
+		}
+		if r.Backordered > 0 {
+			err := tx.Create(&models.Backorder{
+				ProductVariantID: r.ProductVariantID,
+				Reference:        reference,
+				Quantity:         r.Backordered,
+				Outstanding:      r.Backordered,
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+		if r.Quantity == r.Backordered {
+			continue
+		}
+		sources, err := s.saleSources(tx, r.ProductVariantID, r.Quantity-r.Backordered, r.LocationID)
+		if err != nil {
+			return err
+		}
+		for _, src := range sources {
+			err := s.Record(tx, &models.InventoryMovement{
+				ProductVariantID: r.ProductVariantID,
+				Type:             models.MovementSale,
+				Quantity:         -int(src.Quantity),
+				LocationID:       src.LocationID,
+				Reference:        reference,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Where("cart_item_id = ?", cartItemID).Delete(&models.StockReservation{}).Error
+}
+
+// ReleaseExpired deletes reservations whose expiry has passed.
+func (s *Service) ReleaseExpired() (int, error) {
+	var released []models.StockReservation
+	err := db.Transaction(s.db, func(tx *gorm.DB) error {
+		var err error
+		released, err = s.release(tx, tx.Where("expires_at <= ?", time.Now()), "expired")
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	s.CheckLowStock(context.Background(), reservedVariants(released)...)
+	return len(released), nil
+}
+
+// RunSweeper releases expired reservations and queues the back-in-stock
+// messages left pending by the cooldown every interval until ctx is done.
+func (s *Service) RunSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := s.ReleaseExpired()
+			if err != nil {
+				log.Printf("Failed to release expired reservations: %v", err)
+				continue
+			}
+			if n > 0 {
+				log.Printf("Released %d expired reservations", n)
+			}
+			queued, err := s.QueueBackInStock()
+			if err != nil {
+				log.Printf("Failed to queue back-in-stock messages: %v", err)
+			} else if queued > 0 {
+				log.Printf("Queued %d back-in-stock messages", queued)
+			}
+		}
+	}
+}
+
+// release deletes the reservations matched by scope, logging a release
+// movement for each, and returns them. Reservations that had already expired
+// released their stock when they lapsed and are logged with reason "expired".
+func (s *Service) release(tx *gorm.DB, scope *gorm.DB, reason string) ([]models.StockReservation, error) {
+	var reservations []models.StockReservation
+	if err := scope.Find(&reservations).Error; err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, r := range reservations {
+		movementReason := reason
+		if movementReason == "" && !r.ExpiresAt.After(now) {
+			movementReason = "expired"
+		}
+		err := s.Record(tx, &models.InventoryMovement{
+			ProductVariantID: r.ProductVariantID,
+			Type:             models.MovementRelease,
+			Quantity:         int(r.Quantity),
+			Reason:           movementReason,
+			LocationID:       r.LocationID,
+			Reference:        cartItemReference(r.CartItemID),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := tx.Delete(&r).Error; err != nil {
+			return nil, err
+		}
+	}
+	return reservations, nil
+}
+
+// reserved sums the active reservations of a variant, ignoring those held by
+// excludeItemID.
+func (s *Service) reserved(tx *gorm.DB, variantID, excludeItemID uint) (int, error) {
+	var total int
+	err := tx.Model(&models.StockReservation{}).
+		Select("COALESCE(SUM(quantity), 0)").
+		Where("product_variant_id = ? AND cart_item_id <> ? AND expires_at > ?", variantID, excludeItemID, time.Now()).
+		Scan(&total).Error
+	return total, err
+}
+
+// sellable returns the stock of a variant that can be sold: its on-hand stock
+// less the stock held at disabled locations and the units owed to backorders.
+func (s *Service) sellable(tx *gorm.DB, variant models.ProductVariant) (int, error) {
+	disabled, err := s.disabledStock(tx, variant.ID)
+	if err != nil {
+		return 0, err
+	}
+	owed, err := s.outstanding(tx, variant.ID)
+	if err != nil {
+		return 0, err
+	}
+	return int(variant.Stock) - disabled[variant.ID] - owed[variant.ID], nil
+}
+
+// outstanding sums the units of each variant owed to backorders.
+func (s *Service) outstanding(tx *gorm.DB, variantIDs ...uint) (map[uint]int, error) {
+	var rows []struct {
+		ProductVariantID uint
+		Outstanding      int
+	}
+	err := tx.Model(&models.Backorder{}).
+		Select("product_variant_id, SUM(outstanding) AS outstanding").
+		Where("product_variant_id IN ? AND outstanding > 0", variantIDs).
+		Group("product_variant_id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	owed := make(map[uint]int, len(rows))
+	for _, r := range rows {
+		owed[r.ProductVariantID] = r.Outstanding
+	}
+	return owed, nil
+}
+
+// fillBackorders allocates the free stock of a variant to its outstanding
+// backorders, oldest first, recording a sale under each backorder's reference.
+// Stock is free when it is not held at a
+// disabled location or covered by a cart item's reservation.
+func (s *Service) fillBackorders(tx *gorm.DB, variantID uint) error {
+	var backorders []models.Backorder
+	if err := tx.Where("product_variant_id = ? AND outstanding > 0", variantID).Order("id").Find(&backorders).Error; err != nil {
+		return err
+	}
+	if len(backorders) == 0 {
+		return nil
+	}
+
+	var variant models.ProductVariant
+	if err := tx.First(&variant, variantID).Error; err != nil {
+		return err
+	}
+	disabled, err := s.disabledStock(tx, variantID)
+	if err != nil {
+		return err
+	}
+	// Backordered units of a reservation are not covered by stock
+	var covered int
+	err = tx.Model(&models.StockReservation{}).
+		Select("COALESCE(SUM(quantity - backordered), 0)").
+		Where("product_variant_id = ? AND expires_at > ?", variantID, time.Now()).
+		Scan(&covered).Error
+	if err != nil {
+		return err
+	}
+	free := int(variant.Stock) - disabled[variantID] - covered
+
+	filled := 0
+	for _, b := range backorders {
+		n := min(int(b.Outstanding), free-filled)
+		if n <= 0 {
+			break
+		}
+		sources, err := s.saleSources(tx, variantID, uint(n), nil)
+		if err != nil {
+			return err
+		}
+		for _, src := range sources {
+			err := s.Record(tx, &models.InventoryMovement{
+				ProductVariantID: variantID,
+				Type:             models.MovementSale,
+				Quantity:         -int(src.Quantity),
+				LocationID:       src.LocationID,
+				Reason:           "backorder",
+				Reference:        b.Reference,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if err := tx.Model(&b).Update("outstanding", b.Outstanding-uint(n)).Error; err != nil {
+			return err
+		}
+		filled += n
+	}
+	return nil
+}
+
+// disabledStock sums the stock of each variant held at disabled locations.
+func (s *Service) disabledStock(tx *gorm.DB, variantIDs ...uint) (map[uint]int, error) {
+	var rows []struct {
+		ProductVariantID uint
+		Quantity         int
+	}
+	err := disabledLevels(tx).
+		Select("stock_levels.product_variant_id, SUM(stock_levels.quantity) AS quantity").
+		Where("stock_levels.product_variant_id IN ?", variantIDs).
+		Group("stock_levels.product_variant_id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	disabled := make(map[uint]int, len(rows))
+	for _, r := range rows {
+		disabled[r.ProductVariantID] = r.Quantity
+	}
+	return disabled, nil
+}
+
+// disabledLevels scopes a query to stock levels at disabled locations.
+func disabledLevels(tx *gorm.DB) *gorm.DB {
+	return tx.Model(&models.StockLevel{}).
+		Joins("JOIN locations ON locations.id = stock_levels.location_id").
+		Where("locations.disabled = ?", true)
+}
+
+// unassigned returns the stock of a variant not held at any location, and
+// whether the variant has stock levels at all.
+func (s *Service) unassigned(tx *gorm.DB, variantID uint) (int, bool, error) {
+	var variant models.ProductVariant
+	if err := tx.First(&variant, variantID).Error; err != nil {
+		return 0, false, err
+	}
+	var levels struct {
+		Count    int
+		Quantity int
+	}
+	err := tx.Model(&models.StockLevel{}).
+		Select("COUNT(*) AS count, COALESCE(SUM(quantity), 0) AS quantity").
+		Where("product_variant_id = ?", variantID).
+		Scan(&levels).Error
+	return int(variant.Stock) - levels.Quantity, levels.Count > 0, err
+}
+
+// stockSource is part of a sale drawn from one location, or from the stock
+// not assigned to a location when LocationID is nil.
+type stockSource struct {
+	LocationID *uint
+	Quantity   uint
+}
+
+// saleSources splits a sale of a variant over the places its stock is held:
+// locationID when it is set and, still enabled, holds quantity; otherwise the
+// stock not assigned to a location first and then enabled locations in
+// priority order. It returns ErrInsufficientStock when they cannot cover
+// quantity.
+func (s *Service) saleSources(tx *gorm.DB, variantID, quantity uint, locationID *uint) ([]stockSource, error) {
+	if locationID != nil {
+		// The location may have been disabled or emptied since the stock was
+		// reserved there
+		var level models.StockLevel
+		err := tx.Joins("Location").
+			Where("stock_levels.product_variant_id = ? AND stock_levels.location_id = ? AND Location.disabled = ?", variantID, *locationID, false).
+			Limit(1).Find(&level).Error
+		if err != nil {
+			return nil, err
+		}
+		if level.ID != 0 && level.Quantity >= quantity {
+			return []stockSource{{LocationID: locationID, Quantity: quantity}}, nil
+		}
+	}
+	unassigned, located, err := s.unassigned(tx, variantID)
+	if err != nil {
+		return nil, err
+	}
+	if !located {
+		return []stockSource{{Quantity: quantity}}, nil
+	}
+
+	var sources []stockSource
+	if n := uint(min(max(unassigned, 0), int(quantity))); n > 0 {
+		sources = append(sources, stockSource{Quantity: n})
+		quantity -= n
+	}
+	var levels []models.StockLevel
+	err = tx.Joins("Location").
+		Where("stock_levels.product_variant_id = ? AND Location.disabled = ?", variantID, false).
+		Order("Location.priority, Location.id").
+		Find(&levels).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, level := range levels {
+		if quantity == 0 {
+			break
+		}
+		if n := min(level.Quantity, quantity); n > 0 {
+			id := level.LocationID
+			sources = append(sources, stockSource{LocationID: &id, Quantity: n})
+			quantity -= n
+		}
+	}
+	if quantity > 0 {
+		return nil, ErrInsufficientStock
+	}
+	return sources, nil
+}
+
+// fulfillmentLocation returns the enabled location with the lowest priority
+// whose stock, less what other cart items hold there, covers quantity.
+func (s *Service) fulfillmentLocation(tx *gorm.DB, variantID, cartItemID, quantity uint) (*uint, error) {
+	var levels []models.StockLevel
+	err := tx.Joins("Location").
+		Where("stock_levels.product_variant_id = ? AND Location.disabled = ?", variantID, false).
+		Order("Location.priority, Location.id").
+		Find(&levels).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, level := range levels {
+		var held int
+		err := tx.Model(&models.StockReservation{}).
+			Select("COALESCE(SUM(quantity), 0)").
+			Where("product_variant_id = ? AND location_id = ? AND cart_item_id <> ? AND expires_at > ?", variantID, level.LocationID, cartItemID, time.Now()).
+			Scan(&held).Error
+		if err != nil {
+			return nil, err
+		}
+		if int(level.Quantity)-held >= int(quantity) {
+			locationID := level.LocationID
+			return &locationID, nil
+		}
+	}
+	return nil, nil
+}
+
+// adjustLevel applies delta to a variant's stock level at a location,
+// creating the level on first receipt.
+func (s *Service) adjustLevel(tx *gorm.DB, locationID, variantID uint, delta int) error {
+	var level models.StockLevel
+	err := tx.Where("location_id = ? AND product_variant_id = ?", locationID, variantID).
+		Attrs(models.StockLevel{LocationID: locationID, ProductVariantID: variantID}).
+		FirstOrCreate(&level).Error
+	if err != nil {
+		return err
+	}
+	result := tx.Model(&models.StockLevel{}).
+		Where("id = ? AND quantity + ? >= 0", level.ID, delta).
+		Update("quantity", gorm.Expr("quantity + ?", delta))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInsufficientStock
+	}
+	return nil
+}
+
+// reservedVariants returns the distinct variants of reservations.
+func reservedVariants(reservations []models.StockReservation) []uint {
+	seen := map[uint]bool{}
+	var ids []uint
+	for _, r := range reservations {
+		if !seen[r.ProductVariantID] {
+			seen[r.ProductVariantID] = true
+			ids = append(ids, r.ProductVariantID)
+		}
+	}
+	return ids
+}
+
+func cartItemReference(cartItemID uint) string {
+	return fmt.Sprintf("cart_item:%d", cartItemID)
+}
@@ -0,0 +1,180 @@
+package inventory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/abdelmounim-dev/go-tshirt/internal/db"
+	"github.com/abdelmounim-dev/go-tshirt/internal/models"
+	"github.com/abdelmounim-dev/go-tshirt/internal/service/notify"
+	"gorm.io/gorm"
+)
+
+// EventLowStock is the notification event raised when a variant runs low.
+const EventLowStock = "inventory.low_stock"
+
+// LowStockEntry is a variant whose available stock is below its threshold.
+type LowStockEntry struct {
+	ProductID        uint       `json:"product_id"`
+	ProductName      string     `json:"product_name"`
+	ProductVariantID uint       `json:"product_variant_id"`
+	Color            string     `json:"color"`
+	Size             string     `json:"size"`
+	Stock            uint       `json:"stock"`
+	Available        int        `json:"available"`
+	Threshold        uint       `json:"threshold"`
+	AlertedAt        *time.Time `json:"alerted_at,omitempty"`
+}
+
+// thresholdRow is a variant joined with the threshold that applies to it.
+type thresholdRow struct {
+	ProductID        uint
+	ProductName      string
+	ProductVariantID uint
+	Color            string
+	Size             string
+	Stock            uint
+	Threshold        uint
+}
+
+// thresholds returns the active variants among variantIDs, or all active
+// variants when none are given, that have a low-stock threshold of their own
+// or through their product.
+func (s *Service) thresholds(tx *gorm.DB, variantIDs []uint) ([]thresholdRow, error) {
+	query := tx.Table("product_variants").
+		Select("products.id AS product_id, products.name AS product_name, product_variants.id AS product_variant_id, " +
+			"product_variants.color, product_variants.size, product_variants.stock, " +
+			"COALESCE(product_variants.low_stock_threshold, products.low_stock_threshold) AS threshold").
+		Joins("JOIN products ON products.id = product_variants.product_id").
+		Where("product_variants.archived_at IS NULL").
+		Where("COALESCE(product_variants.low_stock_threshold, products.low_stock_threshold) IS NOT NULL").
+		Order("products.id, product_variants.id")
+	if len(variantIDs) > 0 {
+		query = query.Where("product_variants.id IN ?", variantIDs)
+	}
+	var rows []thresholdRow
+	return rows, query.Scan(&rows).Error
+}
+
+// LowStock reports every variant whose available stock is below its threshold.
+func (s *Service) LowStock(tx *gorm.DB) ([]LowStockEntry, error) {
+	rows, err := s.thresholds(tx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []LowStockEntry{}
+	for _, row := range rows {
+		available, err := s.Available(tx, row.ProductVariantID)
+		if err != nil {
+			return nil, err
+		}
+		if available >= int(row.Threshold) {
+			continue
+		}
+		entry := LowStockEntry{
+			ProductID:        row.ProductID,
+			ProductName:      row.ProductName,
+			ProductVariantID: row.ProductVariantID,
+			Color:            row.Color,
+			Size:             row.Size,
+			Stock:            row.Stock,
+			Available:        available,
+			Threshold:        row.Threshold,
+		}
+		var alert models.LowStockAlert
+		err = tx.Where("product_variant_id = ? AND resolved_at IS NULL", row.ProductVariantID).Limit(1).Find(&alert).Error
+		if err != nil {
+			return nil, err
+		}
+		if alert.ID != 0 {
+			entry.AlertedAt = &alert.CreatedAt
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// CheckLowStock raises an alert for each of the variants whose available stock
+// has dropped below its threshold, and resolves the open alerts of those that
+// have recovered. A variant is only notified again after it recovers. It runs
+// after the stock change has been committed, so failures are logged rather
+// than returned.
+func (s *Service) CheckLowStock(ctx context.Context, variantIDs ...uint) {
+	if len(variantIDs) == 0 {
+		return
+	}
+	rows, err := s.thresholds(s.db, variantIDs)
+	if err != nil {
+		log.Printf("Failed to check low stock: %v", err)
+		return
+	}
+	for _, row := range rows {
+		alert, err := s.updateLowStockAlert(row)
+		if err != nil {
+			log.Printf("Failed to check low stock of variant %d: %v", row.ProductVariantID, err)
+			continue
+		}
+		if alert == nil {
+			continue
+		}
+		err = s.notifier.Notify(ctx, notify.Message{
+			Event:   EventLowStock,
+			Subject: fmt.Sprintf("Low stock: %s (%s, %s)", row.ProductName, row.Color, row.Size),
+			Body:    fmt.Sprintf("%d available, below the threshold of %d.", alert.Available, alert.Threshold),
+			Data: LowStockEntry{
+				ProductID:        row.ProductID,
+				ProductName:      row.ProductName,
+				ProductVariantID: row.ProductVariantID,
+				Color:            row.Color,
+				Size:             row.Size,
+				Stock:            row.Stock,
+				Available:        alert.Available,
+				Threshold:        alert.Threshold,
+				AlertedAt:        &alert.CreatedAt,
+			},
+		})
+		if err != nil {
+			log.Printf("Failed to send low stock alert for variant %d: %v", row.ProductVariantID, err)
+		}
+	}
+}
+
+// updateLowStockAlert opens or resolves the variant's alert to match its
+// available stock. It returns the alert when a new one was opened.
+func (s *Service) updateLowStockAlert(row thresholdRow) (*models.LowStockAlert, error) {
+	var opened *models.LowStockAlert
+	err := db.Transaction(s.db, func(tx *gorm.DB) error {
+		opened = nil
+		available, err := s.Available(tx, row.ProductVariantID)
+		if err != nil {
+			return err
+		}
+		var alert models.LowStockAlert
+		err = tx.Where("product_variant_id = ? AND resolved_at IS NULL", row.ProductVariantID).First(&alert).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		open := err == nil
+
+		switch {
+		case available < int(row.Threshold) && !open:
+			alert = models.LowStockAlert{
+				ProductVariantID: row.ProductVariantID,
+				Threshold:        row.Threshold,
+				Available:        available,
+			}
+			if err := tx.Create(&alert).Error; err != nil {
+				return err
+			}
+			opened = &alert
+		case available >= int(row.Threshold) && open:
+			return tx.Model(&alert).Update("resolved_at", time.Now()).Error
+		}
+		return nil
+	})
+	return opened, err
+}
@@ -0,0 +1,92 @@
+// Package mockup composites customer designs onto blank product templates to
+// produce preview images.
+package mockup
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+
+	apperrors "github.com/abdelmounim-dev/go-tshirt/internal/errors"
+)
+
+// PrintArea describes where on a template a design may be printed.
+type PrintArea struct {
+	// Bounds is the printable rectangle in template pixel coordinates.
+	Bounds image.Rectangle
+	// WidthInches is the physical width of the printable rectangle.
+	WidthInches float64
+	// MinDPI and MaxDPI bound the effective print resolution of a design.
+	// A zero value disables the corresponding check.
+	MinDPI int
+	MaxDPI int
+}
+
+// Placement positions a design inside a print area. X and Y are the offset of
+// the design's top-left corner as a fraction of the print area's width and
+// height; Scale is the design width as a fraction of the print area's width.
+type Placement struct {
+	X     float64
+	Y     float64
+	Scale float64
+}
+
+// Render draws design onto a copy of base inside area according to p. It
+// returns a ValidationError when the design does not fit the print area or its
+// effective resolution falls outside the configured DPI range.
+func Render(base, design image.Image, area PrintArea, p Placement) (*image.RGBA, error) {
+	if !area.Bounds.In(base.Bounds()) || area.Bounds.Empty() {
+		return nil, fmt.Errorf("print area %v is outside template bounds %v", area.Bounds, base.Bounds())
+	}
+	if p.Scale <= 0 || p.Scale > 1 {
+		return nil, &apperrors.ValidationError{Message: "Scale must be greater than 0 and at most 1"}
+	}
+	if p.X < 0 || p.Y < 0 {
+		return nil, &apperrors.ValidationError{Message: "Position must not be negative"}
+	}
+
+	src := design.Bounds()
+	width := int(float64(area.Bounds.Dx()) * p.Scale)
+	height := src.Dy() * width / src.Dx()
+	if width == 0 || height == 0 {
+		return nil, &apperrors.ValidationError{Message: "Design is too small to print"}
+	}
+
+	origin := image.Pt(
+		area.Bounds.Min.X+int(p.X*float64(area.Bounds.Dx())),
+		area.Bounds.Min.Y+int(p.Y*float64(area.Bounds.Dy())),
+	)
+	target := image.Rectangle{Min: origin, Max: origin.Add(image.Pt(width, height))}
+	if !target.In(area.Bounds) {
+		return nil, &apperrors.ValidationError{Message: "Design does not fit inside the print area"}
+	}
+
+	if area.WidthInches > 0 {
+		dpi := float64(src.Dx()) / (area.WidthInches * p.Scale)
+		if area.MinDPI > 0 && dpi < float64(area.MinDPI) {
+			return nil, &apperrors.ValidationError{Message: fmt.Sprintf("Design resolution is %.0f DPI, minimum is %d", dpi, area.MinDPI)}
+		}
+		if area.MaxDPI > 0 && dpi > float64(area.MaxDPI) {
+			return nil, &apperrors.ValidationError{Message: fmt.Sprintf("Design resolution is %.0f DPI, maximum is %d", dpi, area.MaxDPI)}
+		}
+	}
+
+	out := image.NewRGBA(base.Bounds())
+	draw.Draw(out, out.Bounds(), base, base.Bounds().Min, draw.Src)
+	draw.Draw(out, target, scale(design, width, height), image.Point{}, draw.Over)
+	return out, nil
+}
+
+// scale resizes img to width x height using nearest-neighbour sampling.
+func scale(img image.Image, width, height int) *image.RGBA {
+	src := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		sy := src.Min.Y + y*src.Dy()/height
+		for x := 0; x < width; x++ {
+			sx := src.Min.X + x*src.Dx()/width
+			dst.Set(x, y, img.At(sx, sy))
+		}
+	}
+	return dst
+}
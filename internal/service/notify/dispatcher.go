@@ -0,0 +1,156 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/abdelmounim-dev/go-tshirt/internal/models"
+	"gorm.io/gorm"
+)
+
+// MaxDeliveryAttempts is how many times a webhook message is tried before it
+// is left in the outbox for inspection.
+const MaxDeliveryAttempts = 5
+
+// ErrPrivateAddress is returned for webhooks to a host that is not a public
+// address.
+var ErrPrivateAddress = errors.New("webhook host is not a public address")
+
+// Dispatcher delivers webhook messages queued in the outbox. Webhook URLs can
+// come from shoppers, so only trusted recipients may be on a loopback,
+// private or link-local address; any other connection is refused when the
+// host resolves to one.
+type Dispatcher struct {
+	db      *gorm.DB
+	client  *http.Client
+	public  *http.Client
+	trusted map[string]bool
+}
+
+// NewDispatcher returns a Dispatcher that posts with client, or with a default
+// client when it is nil. Messages to the trusted recipient URLs, such as the
+// configured low-stock webhook, are posted to any address.
+func NewDispatcher(db *gorm.DB, client *http.Client, trusted ...string) *Dispatcher {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	d := &Dispatcher{db: db, client: client, public: publicOnly(client), trusted: map[string]bool{}}
+	for _, url := range trusted {
+		if url != "" {
+			d.trusted[url] = true
+		}
+	}
+	return d
+}
+
+// DeliverPending posts each unsent webhook message to its recipient URL and
+// returns how many were delivered. Failed deliveries are retried on later
+// calls until MaxDeliveryAttempts is reached.
+func (d *Dispatcher) DeliverPending(ctx context.Context) (int, error) {
+	var messages []models.OutboxMessage
+	err := d.db.WithContext(ctx).
+		Where("channel = ? AND sent_at IS NULL AND attempts < ?", ChannelWebhook, MaxDeliveryAttempts).
+		Order("id").
+		Find(&messages).Error
+	if err != nil {
+		return 0, err
+	}
+
+	delivered := 0
+	for _, m := range messages {
+		message := Message{Event: m.Event, To: m.Recipient, Subject: m.Subject, Body: m.Body}
+		if m.Data != "" {
+			message.Data = json.RawMessage(m.Data)
+		}
+		webhook := &WebhookNotifier{URL: m.Recipient, Client: d.public}
+		if d.trusted[m.Recipient] {
+			webhook.Client = d.client
+		}
+		sendErr := webhook.Notify(ctx, message)
+
+		updates := map[string]interface{}{"attempts": m.Attempts + 1}
+		if sendErr != nil {
+			updates["last_error"] = sendErr.Error()
+		} else {
+			updates["sent_at"] = time.Now()
+			updates["last_error"] = ""
+			delivered++
+		}
+		if err := d.db.WithContext(ctx).Model(&m).Updates(updates).Error; err != nil {
+			return delivered, err
+		}
+	}
+	return delivered, nil
+}
+
+// Run delivers pending messages every interval until ctx is done.
+func (d *Dispatcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := d.DeliverPending(ctx); err != nil {
+				log.Printf("Failed to deliver outbox messages: %v", err)
+			}
+		}
+	}
+}
+
+// PublicHost reports whether a webhook host, a name or an IP address, may be
+// public. Names other than localhost can only be told apart once resolved,
+// which the Dispatcher does when it connects.
+func PublicHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return publicIP(ip)
+	}
+	return true
+}
+
+func publicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified()
+}
+
+// publicOnly returns a copy of client that refuses to connect to addresses
+// that are not public. The check is made on the resolved address as the
+// connection is opened, so redirects and DNS answers that change between
+// lookups are covered too. Proxies are bypassed, since they would connect on
+// the client's behalf.
+func publicOnly(client *http.Client) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if t, ok := client.Transport.(*http.Transport); ok {
+		transport = t.Clone()
+	}
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+				return ErrPrivateAddress
+			}
+			return nil
+		},
+	}
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	public := *client
+	public.Transport = transport
+	return &public
+}
@@ -0,0 +1,145 @@
+// Package notify delivers operational notifications, such as low-stock
+// alerts, through a configurable channel. Webhook and email notifications are
+// queued in the outbox, so a slow receiver never holds up a request.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/abdelmounim-dev/go-tshirt/internal/models"
+	"gorm.io/gorm"
+)
+
+// Notifier kinds accepted by New.
+const (
+	KindLog     = "log"
+	KindWebhook = "webhook"
+	KindEmail   = "email"
+)
+
+// Outbox channels. Email messages are left for a mail sender; webhook
+// messages are delivered by a Dispatcher.
+const (
+	ChannelEmail   = "email"
+	ChannelWebhook = "webhook"
+)
+
+// Message is a notification about an event. Data carries the event's details
+// for machine consumers such as webhooks.
+type Message struct {
+	Event   string `json:"event"`
+	To      string `json:"to,omitempty"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+	Data    any    `json:"data,omitempty"`
+}
+
+// Notifier delivers messages.
+type Notifier interface {
+	Notify(ctx context.Context, m Message) error
+}
+
+// Options configures the notifier built by New.
+type Options struct {
+	// Kind selects the notifier: "log" (default), "webhook" or "email".
+	Kind string
+	// WebhookURL is where webhook notifications are posted.
+	WebhookURL string
+	// EmailRecipient receives email notifications that have no recipient of
+	// their own.
+	EmailRecipient string
+}
+
+// New builds the notifier selected by opts.
+func New(db *gorm.DB, opts Options) (Notifier, error) {
+	switch opts.Kind {
+	case "", KindLog:
+		return LogNotifier{}, nil
+	case KindWebhook:
+		if opts.WebhookURL == "" {
+			return nil, fmt.Errorf("webhook notifier requires a URL")
+		}
+		return NewOutboxNotifier(db, ChannelWebhook, opts.WebhookURL), nil
+	case KindEmail:
+		return NewOutboxNotifier(db, ChannelEmail, opts.EmailRecipient), nil
+	default:
+		return nil, fmt.Errorf("unknown notifier %q", opts.Kind)
+	}
+}
+
+// LogNotifier writes messages to the standard logger.
+type LogNotifier struct{}
+
+func (LogNotifier) Notify(_ context.Context, m Message) error {
+	log.Printf("[%s] %s: %s", m.Event, m.Subject, m.Body)
+	return nil
+}
+
+// WebhookNotifier posts messages as JSON to a URL. It delivers immediately;
+// the Dispatcher uses it to send the webhook messages queued in the outbox.
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+func (n *WebhookNotifier) Notify(ctx context.Context, m Message) error {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// OutboxNotifier queues messages in the outbox table on one channel, for the
+// Dispatcher or a mail sender to deliver.
+type OutboxNotifier struct {
+	db      *gorm.DB
+	Channel string
+	// Recipient is used for messages without a recipient of their own.
+	Recipient string
+}
+
+func NewOutboxNotifier(db *gorm.DB, channel, recipient string) *OutboxNotifier {
+	return &OutboxNotifier{db: db, Channel: channel, Recipient: recipient}
+}
+
+func (n *OutboxNotifier) Notify(ctx context.Context, m Message) error {
+	recipient := m.To
+	if recipient == "" {
+		recipient = n.Recipient
+	}
+	var data []byte
+	if m.Data != nil {
+		var err error
+		if data, err = json.Marshal(m.Data); err != nil {
+			return err
+		}
+	}
+	return n.db.WithContext(ctx).Create(&models.OutboxMessage{
+		Channel:   n.Channel,
+		Event:     m.Event,
+		Recipient: recipient,
+		Subject:   m.Subject,
+		Body:      m.Body,
+		Data:      string(data),
+	}).Error
+}
@@ -0,0 +1,283 @@
+// Package orders turns carts into orders: it re-checks a cart, prices it,
+// converts the stock its lines hold into sales and records what was bought.
+package orders
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	apperrors "github.com/abdelmounim-dev/go-tshirt/internal/errors"
+	"github.com/abdelmounim-dev/go-tshirt/internal/models"
+	"github.com/abdelmounim-dev/go-tshirt/internal/service/carts"
+	"github.com/abdelmounim-dev/go-tshirt/internal/service/inventory"
+	"github.com/abdelmounim-dev/go-tshirt/internal/service/pricing"
+	"gorm.io/gorm"
+)
+
+// Codes of the errors that prevent a checkout.
+const (
+	CodeCartEmpty     = "cart_empty"
+	CodeCartInvalid   = "cart_invalid"
+	CodeCustomerLimit = "customer_limit_exceeded"
+)
+
+// DefaultCustomerLimitWindow is used when Options.CustomerLimitWindow is not set.
+const DefaultCustomerLimitWindow = 30 * 24 * time.Hour
+
+// Details is what the shopper provides at checkout.
+type Details struct {
+	Email           string
+	ShippingAddress models.Address
+	// BillingAddress defaults to the shipping address.
+	BillingAddress *models.Address
+}
+
+// Options configures a Service.
+type Options struct {
+	// CustomerLimitWindow is how far back the orders counted against a
+	// product's MaxPerCustomer go.
+	CustomerLimitWindow time.Duration
+}
+
+// Service places orders. Methods that take a *gorm.DB run against it so
+// callers can include them in their own transactions.
+type Service struct {
+	inventory           *inventory.Service
+	carts               *carts.Service
+	pricing             *pricing.Engine
+	customerLimitWindow time.Duration
+}
+
+func NewService(inv *inventory.Service, cartService *carts.Service, prices *pricing.Engine, opts Options) *Service {
+	if opts.CustomerLimitWindow <= 0 {
+		opts.CustomerLimitWindow = DefaultCustomerLimitWindow
+	}
+	return &Service{inventory: inv, carts: cartService, pricing: prices, customerLimitWindow: opts.CustomerLimitWindow}
+}
+
+// Checkout places an order for the lines of a cart that are not saved for
+// later. The cart must have no blocking warnings; otherwise they are returned
+// with a validation error, as is a cart that would take its customer over a
+// product's MaxPerCustomer, an advisory limit (see checkCustomerLimits). Each line's stock is held again and committed as a
+// sale, the lines are copied onto the order at current prices and removed
+// from the cart, and lines saved for later stay behind. Checkout returns the
+// order and the variants whose stock changed.
+func (s *Service) Checkout(tx *gorm.DB, cart models.Cart, details Details) (models.Order, []carts.Warning, []uint, error) {
+	var order models.Order
+	var items []models.CartItem
+	if err := tx.Preload("BundleSelections").Where("cart_id = ? AND saved_at IS NULL", cart.ID).Order("id").Find(&items).Error; err != nil {
+		return order, nil, nil, err
+	}
+	if len(items) == 0 {
+		return order, nil, nil, &apperrors.ValidationError{Message: "Cart is empty", Code: CodeCartEmpty}
+	}
+
+	quote, err := s.pricing.Price(tx, items)
+	if err != nil {
+		return order, nil, nil, err
+	}
+	warnings, err := s.carts.Warnings(tx, quote)
+	if err != nil {
+		return order, nil, nil, err
+	}
+	for _, w := range warnings {
+		if w.Blocking {
+			return order, warnings, nil, &apperrors.ValidationError{Message: "Cart has problems that must be resolved first", Code: CodeCartInvalid}
+		}
+	}
+	variants, products, err := catalog(tx, items)
+	if err != nil {
+		return order, nil, nil, err
+	}
+	if err := s.checkCustomerLimits(tx, cart.CustomerID, items, variants, products); err != nil {
+		return order, nil, nil, err
+	}
+
+	order = models.Order{
+		CustomerID:      cart.CustomerID,
+		Email:           details.Email,
+		Status:          models.OrderStatusPlaced,
+		ShippingAddress: details.ShippingAddress,
+		BillingAddress:  details.ShippingAddress,
+		Subtotal:        quote.Subtotal,
+		Discount:        quote.Discount,
+		Shipping:        quote.Shipping,
+		Tax:             quote.Tax,
+		Total:           quote.Total,
+	}
+	if details.BillingAddress != nil {
+		order.BillingAddress = *details.BillingAddress
+	}
+	if err := tx.Create(&order).Error; err != nil {
+		return order, nil, nil, err
+	}
+
+	changed := map[uint]bool{}
+	reference := fmt.Sprintf("order:%d", order.ID)
+	for _, l := range quote.Lines {
+		item := l.Item
+		perUnit := carts.LineVariants(item)
+		for id := range perUnit {
+			changed[id] = true
+		}
+		// Renew the hold so an expired reservation is checked against current
+		// stock, then turn it into a sale
+		if err := s.carts.ReserveLine(tx, &item, perUnit); err != nil {
+			return order, nil, nil, err
+		}
+		if err := s.inventory.Commit(tx, item.ID, reference); err != nil {
+			return order, nil, nil, err
+		}
+		order.Lines = append(order.Lines, orderLine(order.ID, l, item, variants, products))
+	}
+	if err := tx.Create(&order.Lines).Error; err != nil {
+		return order, nil, nil, err
+	}
+
+	itemIDs := make([]uint, len(items))
+	for i, item := range items {
+		itemIDs[i] = item.ID
+	}
+	if err := tx.Where("cart_item_id IN ?", itemIDs).Delete(&models.BundleSelection{}).Error; err != nil {
+		return order, nil, nil, err
+	}
+	if err := tx.Delete(&models.CartItem{}, itemIDs).Error; err != nil {
+		return order, nil, nil, err
+	}
+	return order, nil, slices.Sorted(maps.Keys(changed)), nil
+}
+
+// checkCustomerLimits rejects a checkout that would take a customer over a
+// product's MaxPerCustomer, counting the units of the product in the cart and
+// in the customer's orders placed within the window. As for cart limits,
+// bundle components count towards their products and bundles towards the
+// bundle product. Carts without a customer are not limited.
+//
+// The limit is advisory and not enforced: there is no authenticated identity
+// yet, so the customer is the cart's CustomerID, which callers set freely
+// when merging carts. A shopper can get around it by using another customer
+// ID or none. Once requests carry an authenticated customer, it should be
+// keyed on that instead.
+func (s *Service) checkCustomerLimits(tx *gorm.DB, customerID string, items []models.CartItem, variants map[uint]models.ProductVariant, products map[uint]models.Product) error {
+	if customerID == "" {
+		return nil
+	}
+	units := map[uint]uint{}
+	for _, item := range items {
+		for id, perUnit := range carts.LineVariants(item) {
+			units[variants[id].ProductID] += perUnit * item.Quantity
+		}
+		if item.BundleProductID != nil {
+			units[*item.BundleProductID] += item.Quantity
+		}
+	}
+	var limited []uint
+	for id := range units {
+		if products[id].MaxPerCustomer != nil {
+			limited = append(limited, id)
+		}
+	}
+	if len(limited) == 0 {
+		return nil
+	}
+
+	var lines []models.OrderLine
+	err := tx.Joins("JOIN orders ON orders.id = order_lines.order_id").
+		Where("orders.customer_id = ? AND orders.created_at > ?", customerID, time.Now().Add(-s.customerLimitWindow)).
+		Find(&lines).Error
+	if err != nil {
+		return err
+	}
+	bought := map[uint]uint{}
+	for _, l := range lines {
+		bought[l.ProductID] += l.Quantity
+		for _, c := range l.Components {
+			bought[c.ProductID] += c.Quantity * l.Quantity
+		}
+	}
+
+	for _, id := range slices.Sorted(slices.Values(limited)) {
+		p := products[id]
+		if bought[id]+units[id] > *p.MaxPerCustomer {
+			return &apperrors.ValidationError{
+				Message: fmt.Sprintf("At most %d of %s per customer; %d already ordered", *p.MaxPerCustomer, p.Name, bought[id]),
+				Code:    CodeCustomerLimit,
+			}
+		}
+	}
+	return nil
+}
+
+// catalog loads the variants of the cart lines, bundle components included,
+// and the products of those variants and bundles, by ID.
+func catalog(tx *gorm.DB, items []models.CartItem) (map[uint]models.ProductVariant, map[uint]models.Product, error) {
+	variantIDs, productIDs := map[uint]bool{}, map[uint]bool{}
+	for _, item := range items {
+		for id := range carts.LineVariants(item) {
+			variantIDs[id] = true
+		}
+		if item.BundleProductID != nil {
+			productIDs[*item.BundleProductID] = true
+		}
+	}
+	var found []models.ProductVariant
+	if err := tx.Find(&found, slices.Sorted(maps.Keys(variantIDs))).Error; err != nil {
+		return nil, nil, err
+	}
+	variants := make(map[uint]models.ProductVariant, len(found))
+	for _, v := range found {
+		variants[v.ID] = v
+		productIDs[v.ProductID] = true
+	}
+	var foundProducts []models.Product
+	if err := tx.Find(&foundProducts, slices.Sorted(maps.Keys(productIDs))).Error; err != nil {
+		return nil, nil, err
+	}
+	products := make(map[uint]models.Product, len(foundProducts))
+	for _, p := range foundProducts {
+		products[p.ID] = p
+	}
+	return variants, products, nil
+}
+
+// orderLine copies a priced cart line, as last reserved, onto an order.
+func orderLine(orderID uint, l pricing.Line, item models.CartItem, variants map[uint]models.ProductVariant, products map[uint]models.Product) models.OrderLine {
+	line := models.OrderLine{
+		OrderID:                  orderID,
+		ProductID:                l.Product.ID,
+		ProductName:              l.Product.Name,
+		Personalization:          item.Personalization,
+		MockupID:                 item.MockupID,
+		Quantity:                 l.Quantity,
+		UnitPrice:                l.UnitPrice,
+		PersonalizationSurcharge: item.PersonalizationSurcharge,
+		Subtotal:                 l.Subtotal,
+		Discount:                 l.Discount,
+		Total:                    l.Total,
+		FulfillmentLocationID:    item.FulfillmentLocationID,
+		InventoryPolicy:          item.InventoryPolicy,
+		BackorderedQuantity:      item.BackorderedQuantity,
+		ExpectedShipDate:         item.ExpectedShipDate,
+	}
+	if item.BundleProductID == nil {
+		v := variants[item.ProductVariantID]
+		line.ProductVariantID = &item.ProductVariantID
+		line.SKU, line.Color, line.Size = v.SKU, v.Color, v.Size
+		return line
+	}
+	for _, sel := range item.BundleSelections {
+		v := variants[sel.ProductVariantID]
+		line.Components = append(line.Components, models.OrderLineComponent{
+			ProductID:        v.ProductID,
+			ProductVariantID: v.ID,
+			ProductName:      products[v.ProductID].Name,
+			SKU:              v.SKU,
+			Color:            v.Color,
+			Size:             v.Size,
+			Quantity:         sel.Quantity,
+		})
+	}
+	return line
+}
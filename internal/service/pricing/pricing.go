@@ -0,0 +1,124 @@
+// Package pricing computes the money figures of a set of cart lines: line
+// totals, discounts, shipping, tax and the grand total. Prices are worked out
+// by a pipeline of stages so that rules can be added or swapped without
+// touching the handlers, and so the same calculation can price an order.
+package pricing
+
+import (
+	"math"
+
+	"github.com/abdelmounim-dev/go-tshirt/internal/models"
+	"gorm.io/gorm"
+)
+
+// Quote is the price breakdown of a set of cart lines. All amounts are in the
+// store currency and rounded to cents.
+type Quote struct {
+	Lines []Line `json:"lines"`
+	// Subtotal is the sum of the lines before discounts.
+	Subtotal float64 `json:"subtotal"`
+	Discount float64 `json:"discount"`
+	Shipping float64 `json:"shipping"`
+	Tax      float64 `json:"tax"`
+	Total    float64 `json:"total"`
+}
+
+// Line is the price of one cart line.
+type Line struct {
+	CartItemID uint `json:"cart_item_id"`
+	Quantity   uint `json:"quantity"`
+	// UnitPrice includes the personalization surcharge.
+	UnitPrice float64 `json:"unit_price"`
+	Subtotal  float64 `json:"subtotal"`
+	Discount  float64 `json:"discount"`
+	Total     float64 `json:"total"`
+
+	// Item and Product are the line being priced and its product (the bundle
+	// for bundle lines), for stages that need more than the figures.
+	Item    models.CartItem `json:"-"`
+	Product models.Product  `json:"-"`
+}
+
+// Net returns the value of the lines after discounts, before shipping and tax.
+func (q *Quote) Net() float64 {
+	var net float64
+	for _, l := range q.Lines {
+		net += l.Subtotal - l.Discount
+	}
+	return Round(net)
+}
+
+// A Stage is one step of the pricing pipeline. Stages run in order, each
+// seeing the figures left by the ones before it.
+type Stage interface {
+	Apply(tx *gorm.DB, q *Quote) error
+}
+
+// StageFunc adapts a function to the Stage interface.
+type StageFunc func(tx *gorm.DB, q *Quote) error
+
+func (f StageFunc) Apply(tx *gorm.DB, q *Quote) error {
+	return f(tx, q)
+}
+
+// Engine prices cart lines by running them through its stages.
+type Engine struct {
+	stages []Stage
+}
+
+// NewEngine returns an engine running the given stages in order.
+func NewEngine(stages ...Stage) *Engine {
+	return &Engine{stages: stages}
+}
+
+// Options configures the default pipeline built by New.
+type Options struct {
+	// ShippingRate is the flat shipping charge for a non-empty cart.
+	ShippingRate float64
+	// FreeShippingThreshold waives shipping when the discounted lines reach
+	// it. Zero means shipping is always charged.
+	FreeShippingThreshold float64
+	// TaxRate is applied to the discounted lines, e.g. 0.2 for 20%.
+	TaxRate float64
+}
+
+// New returns the store's default pipeline: catalog prices, bundle discounts,
+// a flat shipping estimate and tax.
+func New(opts Options) *Engine {
+	return NewEngine(
+		StageFunc(UnitPrices),
+		StageFunc(BundleDiscounts),
+		FlatShipping{Rate: opts.ShippingRate, FreeOver: opts.FreeShippingThreshold},
+		Tax{Rate: opts.TaxRate},
+	)
+}
+
+// Price quotes items. Items are expected to have their bundle selections
+// loaded.
+func (e *Engine) Price(tx *gorm.DB, items []models.CartItem) (Quote, error) {
+	q := Quote{Lines: make([]Line, len(items))}
+	for i, item := range items {
+		q.Lines[i] = Line{CartItemID: item.ID, Quantity: item.Quantity, Item: item}
+	}
+	for _, stage := range e.stages {
+		if err := stage.Apply(tx, &q); err != nil {
+			return q, err
+		}
+	}
+
+	q.Subtotal, q.Discount = 0, 0
+	for i := range q.Lines {
+		l := &q.Lines[i]
+		l.Total = Round(l.Subtotal - l.Discount)
+		q.Subtotal += l.Subtotal
+		q.Discount += l.Discount
+	}
+	q.Subtotal, q.Discount = Round(q.Subtotal), Round(q.Discount)
+	q.Total = Round(q.Subtotal - q.Discount + q.Shipping + q.Tax)
+	return q, nil
+}
+
+// Round rounds an amount to cents.
+func Round(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
@@ -0,0 +1,106 @@
+package pricing
+
+import (
+	"github.com/abdelmounim-dev/go-tshirt/internal/models"
+	"gorm.io/gorm"
+)
+
+// UnitPrices sets each line's unit price from the catalog: the product price
+// plus the personalization surcharge. A bundle is priced at its own price, or
+// at the sum of its selected components when it has a bundle discount
+// percentage. Lines whose product no longer exists are priced at zero.
+func UnitPrices(tx *gorm.DB, q *Quote) error {
+	var variantIDs, productIDs []uint
+	for _, l := range q.Lines {
+		if l.Item.BundleProductID != nil {
+			productIDs = append(productIDs, *l.Item.BundleProductID)
+			for _, s := range l.Item.BundleSelections {
+				variantIDs = append(variantIDs, s.ProductVariantID)
+			}
+			continue
+		}
+		variantIDs = append(variantIDs, l.Item.ProductVariantID)
+	}
+
+	variants := map[uint]models.ProductVariant{}
+	if len(variantIDs) > 0 {
+		var found []models.ProductVariant
+		if err := tx.Find(&found, variantIDs).Error; err != nil {
+			return err
+		}
+		for _, v := range found {
+			variants[v.ID] = v
+			productIDs = append(productIDs, v.ProductID)
+		}
+	}
+	products := map[uint]models.Product{}
+	if len(productIDs) > 0 {
+		var found []models.Product
+		if err := tx.Find(&found, productIDs).Error; err != nil {
+			return err
+		}
+		for _, p := range found {
+			products[p.ID] = p
+		}
+	}
+
+	for i := range q.Lines {
+		l := &q.Lines[i]
+		var base float64
+		if l.Item.BundleProductID != nil {
+			l.Product = products[*l.Item.BundleProductID]
+			base = l.Product.Price
+			if l.Product.BundleDiscountPercent > 0 {
+				base = 0
+				for _, s := range l.Item.BundleSelections {
+					base += products[variants[s.ProductVariantID].ProductID].Price * float64(s.Quantity)
+				}
+			}
+		} else if v, ok := variants[l.Item.ProductVariantID]; ok {
+			l.Product = products[v.ProductID]
+			base = l.Product.Price
+		}
+		if l.Product.ID == 0 {
+			continue
+		}
+		l.UnitPrice = Round(base + l.Item.PersonalizationSurcharge)
+		l.Subtotal = Round(l.UnitPrice * float64(l.Quantity))
+	}
+	return nil
+}
+
+// BundleDiscounts takes each bundle's discount percentage off its line.
+func BundleDiscounts(tx *gorm.DB, q *Quote) error {
+	for i := range q.Lines {
+		l := &q.Lines[i]
+		if l.Product.Type == models.ProductTypeBundle && l.Product.BundleDiscountPercent > 0 {
+			l.Discount += Round(l.Subtotal * l.Product.BundleDiscountPercent / 100)
+		}
+	}
+	return nil
+}
+
+// FlatShipping estimates shipping as a flat rate per cart, waived once the
+// discounted lines reach FreeOver. Empty carts ship for free.
+type FlatShipping struct {
+	Rate     float64
+	FreeOver float64
+}
+
+func (s FlatShipping) Apply(tx *gorm.DB, q *Quote) error {
+	q.Shipping = Round(s.Rate)
+	if len(q.Lines) == 0 || (s.FreeOver > 0 && q.Net() >= s.FreeOver) {
+		q.Shipping = 0
+	}
+	return nil
+}
+
+// Tax charges Rate on the discounted lines. Shipping is not taxed.
+type Tax struct {
+	Rate float64
+}
+
+func (t Tax) Apply(tx *gorm.DB, q *Quote) error {
+	q.Tax = Round(q.Net() * t.Rate)
+	return nil
+}